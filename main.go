@@ -1,17 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/confluentinc/bincover"
 	"github.com/coreos/go-systemd/daemon"
-	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
 	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/config"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/expansion"
 	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/firewall"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/lapi"
 	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
 	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/providers"
 	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/providers/aws"
@@ -40,71 +46,94 @@ func termHandler(sig os.Signal, fb *firewall.Bouncer) error {
 	return nil
 }
 
-func handleSignals(firewallBouncers []*firewall.Bouncer, done chan struct{}) {
+func handleSignals(running *runningBouncers, reloadChan chan<- struct{}, done chan struct{}) {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan)
 
-	exitChan := make(chan int)
 	go func() {
 		for {
 			s := <-signalChan
 			switch s {
+			// kill -SIGHUP XXXX
+			case syscall.SIGHUP:
+				log.Infof("reloading configuration")
+				select {
+				case reloadChan <- struct{}{}:
+				default:
+					// a reload is already pending and will read the latest configuration
+				}
 			// kill -SIGTERM XXXX
 			case syscall.SIGABRT:
 				fallthrough
 			case syscall.SIGINT:
 				fallthrough
 			case syscall.SIGTERM:
-				for _, fb := range firewallBouncers {
+				// stop processing decisions before shutting down, so that the rules are not updated while being deleted
+				t.Kill(nil)
+				<-t.Dead()
+				// the removals held down would be lost by the restart, leaving their sources blocked
+				if released := running.durations.ReleaseHeld(); len(released.Deleted) > 0 {
+					log.Infof("removing %d decision(s) held down", len(released.Deleted))
+					running.update(released)
+				}
+				code := 0
+				for _, fb := range running.bouncers {
 					if err := termHandler(s, fb); err != nil {
 						log.Errorf("shutdown fail: %s", err)
-						exitChan <- 1
-					} else {
-						exitChan <- 0
+						code = 1
 					}
 				}
+				log.Infof("shutting down bouncer service")
+				done <- struct{}{}
+				if isTest == "true" {
+					bincover.ExitCode = code
+				} else {
+					os.Exit(code)
+				}
+				return
 			}
 		}
 	}()
-	go func() {
-		code := 0
-		for range firewallBouncers {
-			if <-exitChan == 1 {
-				code = 1
-			}
-		}
-		log.Infof("shutting down bouncer service")
-		done <- struct{}{}
-		if isTest == "true" {
-			bincover.ExitCode = code
-		} else {
-			os.Exit(code)
-		}
-	}()
 }
 
-func getProviderClients(config config.BouncerConfig) ([]providers.CloudClient, error) {
-	cloudClients := []providers.CloudClient{}
-	if (models.GCPConfig{}) != config.CloudProviders.GCP && !config.CloudProviders.GCP.Disabled {
-		gcpClient, err := gcp.NewClient(&config.CloudProviders.GCP)
-		if err != nil {
-			return nil, err
-		}
-		cloudClients = append(cloudClients, gcpClient)
+// isProviderEnabled returns whether the provider is configured and not disabled.
+func isProviderEnabled(config config.BouncerConfig, providerName string) bool {
+	switch providerName {
+	case "gcp":
+		return !reflect.DeepEqual(models.GCPConfig{}, config.CloudProviders.GCP) && !config.CloudProviders.GCP.Disabled
+	case "aws":
+		return !reflect.DeepEqual(models.AWSConfig{}, config.CloudProviders.AWS) && !config.CloudProviders.AWS.Disabled
+	case "cloudarmor":
+		return !reflect.DeepEqual(models.CloudArmorConfig{}, config.CloudProviders.CloudArmor) && !config.CloudProviders.CloudArmor.Disabled
 	}
-	if (models.AWSConfig{}) != config.CloudProviders.AWS && !config.CloudProviders.AWS.Disabled {
-		awsClient, err := aws.NewClient(&config.CloudProviders.AWS)
-		if err != nil {
-			return nil, err
-		}
-		cloudClients = append(cloudClients, awsClient)
+	return false
+}
+
+// newProviderClient returns the client of the provider. The configuration is a copy, so that the defaults set by the
+// client are not visible to the caller.
+func newProviderClient(config config.BouncerConfig, providerName string) (providers.CloudClient, error) {
+	switch providerName {
+	case "gcp":
+		return gcp.NewClient(&config.CloudProviders.GCP)
+	case "aws":
+		return aws.NewClient(&config.CloudProviders.AWS)
+	case "cloudarmor":
+		return cloudarmor.NewClient(&config.CloudProviders.CloudArmor)
 	}
-	if (models.CloudArmorConfig{}) != config.CloudProviders.CloudArmor && !config.CloudProviders.CloudArmor.Disabled {
-		cloudArmorClient, err := cloudarmor.NewClient(&config.CloudProviders.CloudArmor)
+	return nil, fmt.Errorf("unknown provider %s", providerName)
+}
+
+func getProviderClients(bouncerConfig config.BouncerConfig) ([]providers.CloudClient, error) {
+	cloudClients := []providers.CloudClient{}
+	for _, providerName := range config.ProviderNames {
+		if !isProviderEnabled(bouncerConfig, providerName) {
+			continue
+		}
+		client, err := newProviderClient(bouncerConfig, providerName)
 		if err != nil {
 			return nil, err
 		}
-		cloudClients = append(cloudClients, cloudArmorClient)
+		cloudClients = append(cloudClients, client)
 	}
 	if len(cloudClients) == 0 {
 		return nil, fmt.Errorf("at least one cloud provider must be configured")
@@ -112,17 +141,217 @@ func getProviderClients(config config.BouncerConfig) ([]providers.CloudClient, e
 	return cloudClients, nil
 }
 
+// getEgressOnlyFilter returns the filter of the decisions only blocked as destinations by the provider.
+func getEgressOnlyFilter(config config.BouncerConfig, providerName string) models.DecisionFilter {
+	switch providerName {
+	case "gcp":
+		return config.CloudProviders.GCP.EgressOnly
+	case "aws":
+		return config.CloudProviders.AWS.EgressOnly
+	}
+	return models.DecisionFilter{}
+}
+
+// getBatchConfig returns the batching of the decisions sent to the provider.
+func getBatchConfig(config config.BouncerConfig, providerName string) models.BatchConfig {
+	switch providerName {
+	case "gcp":
+		return config.CloudProviders.GCP.Batch
+	case "aws":
+		return config.CloudProviders.AWS.Batch
+	case "cloudarmor":
+		return config.CloudProviders.CloudArmor.Batch
+	}
+	return models.BatchConfig{}
+}
+
 func getFirewallBouncers(config config.BouncerConfig) ([]*firewall.Bouncer, error) {
 	clients, err := getProviderClients(config)
 	if err != nil {
 		log.Fatalf("unable to get provider client: %s", err.Error())
 		return nil, err
 	}
+	expander, err := getExpander(config)
+	if err != nil {
+		return nil, err
+	}
+	firewallBouncers := []*firewall.Bouncer{}
+	for _, client := range clients {
+		fb := newFirewallBouncer(config, client, expander)
+		if err := fb.CheckTiers(); err != nil {
+			return nil, fmt.Errorf("%s: %s", client.GetProviderName(), err)
+		}
+		firewallBouncers = append(firewallBouncers, fb)
+	}
+	return runPreflight(firewallBouncers, config.Preflight)
+}
+
+// getExpander returns the expander of the decisions, or nil when decision expansion is not configured.
+func getExpander(config config.BouncerConfig) (firewall.DecisionExpander, error) {
+	if len(config.DecisionExpansion.Databases) == 0 {
+		return nil, nil
+	}
+	expander, err := expansion.NewExpander(&config.DecisionExpansion)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load decision expansion databases: %s", err)
+	}
+	return expander, nil
+}
+
+func newFirewallBouncer(config config.BouncerConfig, client providers.CloudClient, expander firewall.DecisionExpander) *firewall.Bouncer {
+	batch := getBatchConfig(config, client.GetProviderName())
+	// the flush window is checked when validating the configuration
+	flushWindow, _ := time.ParseDuration(batch.FlushWindow)
+	return &firewall.Bouncer{
+		Client:            client,
+		RuleNamePrefix:    config.RuleNamePrefix,
+		Expander:          expander,
+		EgressOnly:        getEgressOnlyFilter(config, client.GetProviderName()),
+		CleanupOnShutdown: config.CleanupOnShutdown,
+		Tiers:             config.Tiers,
+		FlushWindow:       flushWindow,
+		MaxBatchSize:      batch.MaxBatchSize,
+		Immediate:         batch.Immediate,
+	}
+}
+
+// runPreflight runs the pre-flight checks of the bouncers. Depending on the mode, a failed check either stops the
+// bouncer or only the bouncers of the other providers are started.
+func runPreflight(firewallBouncers []*firewall.Bouncer, mode string) ([]*firewall.Bouncer, error) {
+	if mode == config.PreflightDisabled {
+		return firewallBouncers, nil
+	}
+	passed := []*firewall.Bouncer{}
+	for _, fb := range firewallBouncers {
+		if err := fb.Preflight(); err != nil {
+			if mode == config.PreflightFailFast {
+				return nil, fmt.Errorf("%s: %s", fb.Client.GetProviderName(), err)
+			}
+			log.Warningf("%s provider is disabled: %s", fb.Client.GetProviderName(), err)
+			continue
+		}
+		passed = append(passed, fb)
+	}
+	if len(passed) == 0 {
+		return nil, fmt.Errorf("the pre-flight checks of all the cloud providers failed")
+	}
+	return passed, nil
+}
+
+// promoteRules switches the rules created in preview mode to enforcing for the providers supporting it.
+func promoteRules(config config.BouncerConfig) error {
+	clients, err := getProviderClients(config)
+	if err != nil {
+		return err
+	}
+	supported := false
+	for _, client := range clients {
+		previewClient, ok := client.(providers.PreviewClient)
+		if !ok {
+			continue
+		}
+		supported = true
+		promoted, err := previewClient.PromoteRules(config.RuleNamePrefix)
+		if err != nil {
+			return fmt.Errorf("unable to promote %s rules: %s", client.GetProviderName(), err)
+		}
+		log.Infof("promoted %d %s rule(s) to enforcing", promoted, client.GetProviderName())
+	}
+	if !supported {
+		return fmt.Errorf("none of the configured cloud providers supports preview mode")
+	}
+	return nil
+}
+
+// confirm asks the question on the standard output and returns whether the answer read from in is yes.
+func confirm(in io.Reader, question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// flushRules deletes all the rules owned by the bouncer from the configured providers, after listing them and asking
+// for confirmation.
+func flushRules(config config.BouncerConfig, args []string) error {
+	flushFlags := flag.NewFlagSet("flush", flag.ExitOnError)
+	dryRun := flushFlags.Bool("dry-run", false, "list the rules that would be deleted without deleting them")
+	yes := flushFlags.Bool("y", false, "delete the rules without asking for confirmation")
+	flushFlags.Parse(args)
+
+	clients, err := getProviderClients(config)
+	if err != nil {
+		return err
+	}
 	firewallBouncers := []*firewall.Bouncer{}
+	total := 0
 	for _, client := range clients {
-		firewallBouncers = append(firewallBouncers, &firewall.Bouncer{Client: client, RuleNamePrefix: config.RuleNamePrefix})
+		fb := newFirewallBouncer(config, client, nil)
+		rules, err := fb.GetManagedRules()
+		if err != nil {
+			return fmt.Errorf("unable to list %s rules: %s", client.GetProviderName(), err)
+		}
+		for _, rule := range rules {
+			fmt.Printf("%s\t%s\n", client.GetProviderName(), rule.Name)
+		}
+		total += len(rules)
+		firewallBouncers = append(firewallBouncers, fb)
+	}
+	if total == 0 {
+		log.Infof("no rule to delete")
+		return nil
+	}
+	if *dryRun {
+		log.Infof("dry run, %d rule(s) would be deleted", total)
+		return nil
+	}
+	if !*yes && !confirm(os.Stdin, fmt.Sprintf("Delete these %d rule(s)?", total)) {
+		log.Infof("no rule deleted")
+		return nil
+	}
+	errs := []string{}
+	for _, fb := range firewallBouncers {
+		deleted, err := fb.Flush()
+		log.Infof("deleted %d %s rule(s)", deleted, fb.Client.GetProviderName())
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", fb.Client.GetProviderName(), err))
+		}
 	}
-	return firewallBouncers, nil
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// validateConfig validates the configuration file without contacting any API, logging every error found.
+func validateConfig(configPath string) error {
+	err := config.CheckConfig(configPath)
+	if errs, ok := err.(config.ValidationErrors); ok {
+		for _, fieldErr := range errs {
+			log.Error(fieldErr)
+		}
+		return fmt.Errorf("configuration file %s is invalid, %d error(s) found", configPath, len(errs))
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("configuration file %s is valid", configPath)
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -c <config> [command]\n\n", name)
+	fmt.Fprintf(flag.CommandLine.Output(), "Commands:\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  validate\tvalidate the configuration without contacting any API and exit\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  promote\tswitch the rules created in preview mode to enforcing and exit\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  flush [-dry-run] [-y]\tdelete all the rules created by the bouncer and exit\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  status [-o table|json|csv] [-sources]\tprint the rules created by the bouncer and their utilisation and exit\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  lookup [-o table|json|csv] <ip>\tprint the rules created by the bouncer containing the IP address and exit\n\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "Without command, the bouncer runs until it is stopped.\n\nFlags:\n")
+	flag.PrintDefaults()
 }
 
 func main() {
@@ -132,13 +361,22 @@ func main() {
 	log.Infof("%s %s", name, version.Version)
 	configPath := flag.String("c", "", "path to config file")
 	verbose := flag.Bool("v", false, "set verbose mode")
+	testConfig := flag.Bool("t", false, "validate the configuration and exit, same as the validate command")
 
+	flag.Usage = usage
 	flag.Parse()
 
 	if configPath == nil || *configPath == "" {
 		log.Fatalf("configuration file is required")
 	}
 
+	if *testConfig || flag.Arg(0) == "validate" {
+		if err := validateConfig(*configPath); err != nil {
+			log.Fatalf("%s", err)
+		}
+		return
+	}
+
 	config, err := config.NewConfig(*configPath)
 	if err != nil {
 		log.Fatalf("unable to load configuration: %s", err)
@@ -148,41 +386,66 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	switch flag.Arg(0) {
+	case "":
+	case "promote":
+		if err := promoteRules(*config); err != nil {
+			log.Fatalf("unable to promote preview rules: %s", err)
+		}
+		return
+	case "flush":
+		if err := flushRules(*config, flag.Args()[1:]); err != nil {
+			log.Fatalf("unable to flush rules: %s", err)
+		}
+		return
+	case "status":
+		if err := printStatus(*config, flag.Args()[1:]); err != nil {
+			log.Fatalf("unable to get status: %s", err)
+		}
+		return
+	case "lookup":
+		if err := lookupAddress(*config, flag.Args()[1:]); err != nil {
+			log.Fatalf("unable to lookup address: %s", err)
+		}
+		return
+	default:
+		flag.Usage()
+		log.Fatalf("unknown command %s", flag.Arg(0))
+	}
+
 	firewallBouncers, err := getFirewallBouncers(*config)
 	if err != nil {
 		log.Fatalf("unable to get provider firewall bouncers: %s", err.Error())
 	}
-
-	bouncer := &csbouncer.StreamBouncer{
-		APIKey:         config.APIKey,
-		APIUrl:         config.APIUrl,
-		TickerInterval: config.UpdateFrequency,
-		UserAgent:      fmt.Sprintf("%s/%s", name, version.VersionStr()),
+	running, err := newRunningBouncers(*config, firewallBouncers)
+	if err != nil {
+		log.Fatalf("unable to load routes and durations: %s", err)
 	}
-	if err := bouncer.Init(); err != nil {
+
+	bouncer, err := lapi.NewStreamBouncer(config, fmt.Sprintf("%s/%s", name, version.VersionStr()))
+	if err != nil {
 		log.Fatalf(err.Error())
 	}
 
 	go bouncer.Run()
 
+	reloadChan := make(chan struct{}, 1)
 	t.Go(func() error {
 		for {
 			select {
 			case <-t.Dying():
 				log.Infoln("terminating bouncer process")
 				return nil
+			case <-reloadChan:
+				if err := running.reload(*configPath); err != nil {
+					log.Errorf("unable to reload configuration, the running configuration is kept: %s", err)
+				}
 			case decisions := <-bouncer.Stream:
 				log.Debugf("processing '%d' delete and '%d' new decisions", len(decisions.Deleted), len(decisions.New))
 				if len(decisions.Deleted) > 0 || len(decisions.New) > 0 {
 					log.Infof("processing '%d' delete and '%d' new decisions", len(decisions.Deleted), len(decisions.New))
-					for _, fb := range firewallBouncers {
-						if err := fb.Update(decisions); err != nil {
-							log.Errorf("unable to process decisions : %s", err)
-						} else {
-							log.Debugf("process completed")
-						}
-					}
 				}
+				running.update(decisions)
 			}
 		}
 	})
@@ -193,7 +456,7 @@ func main() {
 			log.Errorf("failed to notify: %s", err)
 		}
 	}
-	handleSignals(firewallBouncers, done)
+	handleSignals(running, reloadChan, done)
 
 	go func() {
 		err = t.Wait()
@@ -2,9 +2,13 @@ package config
 
 import (
 	"fmt"
-	"io/ioutil"
+	"net"
+	"net/url"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/types"
 	log "github.com/sirupsen/logrus"
@@ -24,14 +28,36 @@ type BouncerConfig struct {
 	LogLevel        log.Level             `yaml:"log_level"`
 	APIUrl          string                `yaml:"api_url"`
 	APIKey          string                `yaml:"api_key"`
+	// APIKeyFile is a file containing the API key, such as a mounted secret.
+	APIKeyFile string `yaml:"api_key_file"`
+	// CACertPath is a CA certificate verifying the LAPI certificate, in addition to the system CAs.
+	CACertPath string `yaml:"ca_cert_path"`
+	// CertPath and KeyPath are the client certificate and key authenticating the bouncer, as an alternative to the API key.
+	CertPath string `yaml:"cert_path"`
+	KeyPath  string `yaml:"key_path"`
+	// InsecureSkipVerify disables the verification of the LAPI certificate.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+	// CleanupOnShutdown deletes all the rules owned by the bouncer when it is stopped.
+	CleanupOnShutdown bool `yaml:"cleanup_on_shutdown"`
+	// Preflight is the behaviour of the bouncer when the pre-flight checks of a cloud provider fail at startup.
+	Preflight string `yaml:"preflight"`
+	// Routes select the providers receiving each decision. Decisions matching no route are sent to all the providers.
+	Routes []models.DecisionRoute `yaml:"routes"`
+	// Tiers split the rules by decision origin, from the most trusted to the least trusted. Rules are not split when
+	// empty.
+	Tiers []models.DecisionTier `yaml:"tiers"`
+	// Durations bound the duration of the enforced decisions and delay their removal.
+	Durations models.DurationPolicy `yaml:"durations"`
+	// DecisionExpansion expands Country and AS scoped decisions into IP ranges for the providers that do not support them.
+	DecisionExpansion models.ExpansionConfig `yaml:"decision_expansion"`
 }
 
 // checkRuleNamePrefixValid validates that the rule name prefix complies specific requirements.
-// The rule name generated must comply with RFC1035. Since two random words (maximum 19 characters)
-// are appended to the rule name prefix to create unique rule names, this checks that
-// the rule name prefix be 1-44 characters long and match the regular expression `^(?:[a-z](?:[-a-z0-9]{0,43})?)$. The first
-// character must be a lowercase letter, and all following characters must be a dash, lowercase letter, or
-// digit. The name cannot contain two consecutive dash ('-') characters.
+// The rule names generated must comply with RFC1035 (maximum 63 characters). Since rule names are the prefix followed by
+// the provider name and an index, such as prefix-cloudarmor-12 where -cloudarmor- is the longest suffix (12 characters),
+// this checks that the rule name prefix be 1-44 characters long, leaving up to 7 digits for the index, and match the
+// regular expression `^(?:[a-z](?:[-a-z0-9]{0,43})?)$. The first character must be a lowercase letter, and all following
+// characters must be a dash, lowercase letter, or digit. The name cannot contain two consecutive dash ('-') characters.
 func checkRuleNamePrefixValid(ruleNamePrefix string) error {
 	if strings.Contains(ruleNamePrefix, "--") {
 		return fmt.Errorf("rule_name_prefix %s must not have two consecutive dash ('-') characters", ruleNamePrefix)
@@ -44,20 +70,505 @@ func checkRuleNamePrefixValid(ruleNamePrefix string) error {
 	return nil
 }
 
-func GenerateConfig(configBuff []byte) (*BouncerConfig, error) {
+const (
+	// PreflightFailFast stops the bouncer when a pre-flight check fails.
+	PreflightFailFast = "fail_fast"
+	// PreflightDegraded starts the bouncer without the cloud providers whose pre-flight checks fail. This is the default.
+	PreflightDegraded = "degraded"
+	// PreflightDisabled starts the bouncer without running the pre-flight checks.
+	PreflightDisabled = "disabled"
+)
+
+// ProviderNames are the names of the cloud providers, in the order their clients are created.
+var ProviderNames = []string{"gcp", "aws", "cloudarmor"}
+
+var (
+	preflightModes        = []string{PreflightFailFast, PreflightDegraded, PreflightDisabled}
+	gcpProtocols          = []string{"all", "tcp", "udp", "icmp", "esp", "ah", "sctp", "ipip"}
+	gcpProtocolsWithPorts = []string{"tcp", "udp", "sctp"}
+	gcpLogMetadata        = []string{"INCLUDE_ALL_METADATA", "EXCLUDE_ALL_METADATA"}
+	directions            = []string{"ingress", "egress", "both"}
+	cloudArmorActions     = []string{"deny(403)", "deny(404)", "deny(502)", "redirect", "throttle"}
+	cloudArmorPolicyTypes = []string{"CLOUD_ARMOR", "CLOUD_ARMOR_EDGE"}
+	cloudArmorRedirects   = []string{"GOOGLE_RECAPTCHA", "EXTERNAL_302"}
+	cloudArmorExceeds     = []string{"deny(403)", "deny(404)", "deny(429)", "deny(502)"}
+	cloudArmorKeys        = []string{"ALL", "IP", "XFF_IP"}
+	cloudArmorIntervals   = []int64{10, 30, 60, 120, 180, 240, 300, 600, 900, 1200, 1800, 2700, 3600}
+	awsActions            = []string{"aws:drop", "aws:forward_to_sfe"}
+)
+
+var (
+	// rfc1035Name matches the names of GCP resources such as networks and security policies.
+	rfc1035Name = regexp.MustCompile(`^[a-z](?:[-a-z0-9]{0,61}[a-z0-9])?$`)
+	awsRegion   = regexp.MustCompile(`^[a-z]{2}(?:-[a-z]+)+-[0-9]+$`)
+	// awsName matches the names of AWS Network Firewall resources such as firewall policies.
+	awsName = regexp.MustCompile(`^[a-zA-Z0-9-]{1,128}$`)
+	// gcpServiceAccount matches the emails of GCP service accounts.
+	gcpServiceAccount = regexp.MustCompile(`^[a-z0-9-]+@[a-z0-9.-]+\.gserviceaccount\.com$`)
+	awsRoleARN        = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:role/[\w+=,.@/-]+$`)
+	awsSessionName    = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+	awsExternalID     = regexp.MustCompile(`^[\w+=,.@:/-]+$`)
+)
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(values []int64, value int64) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPortValid validates that a GCP port is either a single port or a port range such as 8000-9000.
+func checkPortValid(port string) error {
+	re := regexp.MustCompile(`^(\d{1,5})(?:-(\d{1,5}))?$`)
+	match := re.FindStringSubmatch(port)
+	if match == nil {
+		return fmt.Errorf("port %s must be a port number or a port range", port)
+	}
+	from, _ := strconv.Atoi(match[1])
+	to := from
+	if match[2] != "" {
+		to, _ = strconv.Atoi(match[2])
+	}
+	if from > 65535 || to > 65535 || from > to {
+		return fmt.Errorf("port %s is not a valid port or port range", port)
+	}
+	return nil
+}
+
+// checkGCPConfigValid validates the gcp settings that can be checked without contacting GCP.
+func checkGCPConfigValid(v *validator, config *models.GCPConfig) {
+	if config.Network != "" && !rfc1035Name.MatchString(config.Network) {
+		v.errorf("cloud_providers.gcp.network", "gcp network %s does not match the following regex: %s", config.Network, rfc1035Name.String())
+	}
+	if config.MaxRules < 0 {
+		v.errorf("cloud_providers.gcp.max_rules", "gcp max_rules must be positive")
+	}
+	if config.Action != "" && config.Action != "deny" {
+		v.errorf("cloud_providers.gcp.action", "gcp action %s is invalid, only deny is supported", config.Action)
+	}
+	for i, p := range config.Protocols {
+		field := fmt.Sprintf("cloud_providers.gcp.protocols.%d", i)
+		protocol := strings.ToLower(p.Protocol)
+		if number, err := strconv.Atoi(protocol); err == nil {
+			if number < 0 || number > 255 {
+				v.errorf(field+".protocol", "gcp protocol number %d must be between 0 and 255", number)
+			}
+		} else if !contains(gcpProtocols, protocol) {
+			v.errorf(field+".protocol", "gcp protocol %s is invalid, expecting one of %v or a protocol number", p.Protocol, gcpProtocols)
+		}
+		if len(p.Ports) > 0 && !contains(gcpProtocolsWithPorts, protocol) {
+			v.errorf(field+".ports", "gcp ports can only be specified with protocols %v", gcpProtocolsWithPorts)
+		}
+		for j, port := range p.Ports {
+			if err := checkPortValid(port); err != nil {
+				v.errorf(fmt.Sprintf("%s.ports.%d", field, j), "gcp %s", err)
+			}
+		}
+	}
+	if len(config.TargetTags) > 0 && len(config.TargetServiceAccounts) > 0 {
+		v.errorf("cloud_providers.gcp.target_service_accounts", "gcp target_tags and target_service_accounts cannot be specified together")
+	}
+	if config.LogMetadata != "" {
+		if !config.EnableLogging {
+			v.errorf("cloud_providers.gcp.log_metadata", "gcp log_metadata can only be specified when enable_logging is true")
+		} else if !contains(gcpLogMetadata, config.LogMetadata) {
+			v.errorf("cloud_providers.gcp.log_metadata", "gcp log_metadata %s is invalid, expecting one of %v", config.LogMetadata, gcpLogMetadata)
+		}
+	}
+	if config.Direction != "" && !contains(directions, config.Direction) {
+		v.errorf("cloud_providers.gcp.direction", "gcp direction %s is invalid, expecting one of %v", config.Direction, directions)
+	}
+	if checkPriorityRangeValid(v, "gcp", "cloud_providers.gcp", config.PriorityRange) {
+		checkPriorityWithinRange(v, "gcp", "cloud_providers.gcp.priority", config.PriorityRange, config.Priority)
+	}
+}
+
+// checkCloudArmorConfigValid validates the cloudarmor settings that can be checked without contacting GCP.
+func checkCloudArmorConfigValid(v *validator, config *models.CloudArmorConfig) {
+	if config.Policy != "" && !rfc1035Name.MatchString(config.Policy) {
+		v.errorf("cloud_providers.cloudarmor.policy", "cloudarmor policy %s does not match the following regex: %s", config.Policy, rfc1035Name.String())
+	}
+	if config.MaxRules < 0 {
+		v.errorf("cloud_providers.cloudarmor.max_rules", "cloudarmor max_rules must be positive")
+	}
+	if config.Action != "" && !contains(cloudArmorActions, config.Action) {
+		v.errorf("cloud_providers.cloudarmor.action", "cloudarmor action %s is invalid, expecting one of %v", config.Action, cloudArmorActions)
+	}
+	switch config.Action {
+	case "redirect":
+		if !contains(cloudArmorRedirects, config.Redirect.Type) {
+			v.errorf("cloud_providers.cloudarmor.redirect.type", "cloudarmor redirect type %s is invalid, expecting one of %v", config.Redirect.Type, cloudArmorRedirects)
+		}
+		if config.Redirect.Type == "EXTERNAL_302" && config.Redirect.Target == "" {
+			v.errorf("cloud_providers.cloudarmor.redirect.target", "cloudarmor redirect target must be specified with EXTERNAL_302")
+		}
+		if config.Redirect.Type == "GOOGLE_RECAPTCHA" && config.Redirect.Target != "" {
+			v.errorf("cloud_providers.cloudarmor.redirect.target", "cloudarmor redirect target cannot be specified with GOOGLE_RECAPTCHA")
+		}
+	case "throttle":
+		rateLimit := config.RateLimit
+		if rateLimit.ThresholdCount <= 0 {
+			v.errorf("cloud_providers.cloudarmor.rate_limit.threshold_count", "cloudarmor rate_limit threshold_count must be greater than 0")
+		}
+		if !containsInt(cloudArmorIntervals, rateLimit.IntervalSec) {
+			v.errorf("cloud_providers.cloudarmor.rate_limit.interval_sec", "cloudarmor rate_limit interval_sec %d is invalid, expecting one of %v", rateLimit.IntervalSec, cloudArmorIntervals)
+		}
+		if rateLimit.ExceedAction != "" && !contains(cloudArmorExceeds, rateLimit.ExceedAction) {
+			v.errorf("cloud_providers.cloudarmor.rate_limit.exceed_action", "cloudarmor rate_limit exceed_action %s is invalid, expecting one of %v", rateLimit.ExceedAction, cloudArmorExceeds)
+		}
+		if rateLimit.EnforceOnKey != "" && !contains(cloudArmorKeys, rateLimit.EnforceOnKey) {
+			v.errorf("cloud_providers.cloudarmor.rate_limit.enforce_on_key", "cloudarmor rate_limit enforce_on_key %s is invalid, expecting one of %v", rateLimit.EnforceOnKey, cloudArmorKeys)
+		}
+	}
+	if config.Action != "redirect" && (config.Redirect != models.CloudArmorRedirectConfig{}) {
+		v.errorf("cloud_providers.cloudarmor.redirect", "cloudarmor redirect can only be specified with the redirect action")
+	}
+	if config.Action != "throttle" && (config.RateLimit != models.CloudArmorRateLimitConfig{}) {
+		v.errorf("cloud_providers.cloudarmor.rate_limit", "cloudarmor rate_limit can only be specified with the throttle action")
+	}
+	if config.Captcha.Enabled && config.Action == "redirect" && config.Redirect.Type == "GOOGLE_RECAPTCHA" {
+		v.errorf("cloud_providers.cloudarmor.captcha.enabled", "cloudarmor action cannot be a GOOGLE_RECAPTCHA redirect when captcha is enabled")
+	}
+	if config.PolicyType != "" && !contains(cloudArmorPolicyTypes, config.PolicyType) {
+		v.errorf("cloud_providers.cloudarmor.policy_type", "cloudarmor policy_type %s is invalid, expecting one of %v", config.PolicyType, cloudArmorPolicyTypes)
+	}
+	if config.PolicyType == "CLOUD_ARMOR_EDGE" {
+		if config.Region != "" {
+			v.errorf("cloud_providers.cloudarmor.region", "cloudarmor edge security policies cannot be regional")
+		}
+		if config.Action == "redirect" || config.Action == "throttle" {
+			v.errorf("cloud_providers.cloudarmor.action", "cloudarmor edge security policies only support deny actions")
+		}
+		if config.Captcha.Enabled {
+			v.errorf("cloud_providers.cloudarmor.captcha.enabled", "cloudarmor edge security policies do not support captcha")
+		}
+	}
+	if config.Captcha.MaxRules < 0 {
+		v.errorf("cloud_providers.cloudarmor.captcha.max_rules", "cloudarmor captcha max_rules must be positive")
+	}
+	if config.Expressions.MaxRules < 0 {
+		v.errorf("cloud_providers.cloudarmor.expressions.max_rules", "cloudarmor expressions max_rules must be positive")
+	}
+	if config.AddressGroups.Capacity < 0 {
+		v.errorf("cloud_providers.cloudarmor.address_groups.capacity", "cloudarmor address_groups capacity must be positive")
+	}
+	if checkPriorityRangeValid(v, "cloudarmor", "cloud_providers.cloudarmor", config.PriorityRange) {
+		checkPriorityWithinRange(v, "cloudarmor", "cloud_providers.cloudarmor.priority", config.PriorityRange, config.Priority)
+		checkPriorityWithinRange(v, "cloudarmor", "cloud_providers.cloudarmor.captcha.priority", config.PriorityRange, config.Captcha.Priority)
+		checkPriorityWithinRange(v, "cloudarmor", "cloud_providers.cloudarmor.expressions.priority", config.PriorityRange, config.Expressions.Priority)
+	}
+}
+
+// checkAWSConfigValid validates the aws settings that can be checked without contacting AWS.
+func checkAWSConfigValid(v *validator, config *models.AWSConfig) {
+	if config.Region != "" && !awsRegion.MatchString(config.Region) {
+		v.errorf("cloud_providers.aws.region", "aws region %s does not match the following regex: %s", config.Region, awsRegion.String())
+	}
+	if config.FirewallPolicy != "" && !awsName.MatchString(config.FirewallPolicy) {
+		v.errorf("cloud_providers.aws.firewall_policy", "aws firewall_policy %s does not match the following regex: %s", config.FirewallPolicy, awsName.String())
+	}
+	if config.Capacity < 0 {
+		v.errorf("cloud_providers.aws.capacity", "aws capacity must be positive")
+	}
+	if config.Action != "" && !contains(awsActions, config.Action) {
+		v.errorf("cloud_providers.aws.action", "aws action %s is invalid, expecting one of %v", config.Action, awsActions)
+	}
+	if config.Direction != "" && !contains(directions, config.Direction) {
+		v.errorf("cloud_providers.aws.direction", "aws direction %s is invalid, expecting one of %v", config.Direction, directions)
+	}
+	if checkPriorityRangeValid(v, "aws", "cloud_providers.aws", config.PriorityRange) {
+		checkPriorityWithinRange(v, "aws", "cloud_providers.aws.priority", config.PriorityRange, config.RuleGroupPriority)
+	}
+	customAction := config.CustomAction
+	if customAction.Name == "" {
+		if len(customAction.Dimensions) > 0 {
+			v.errorf("cloud_providers.aws.custom_action.name", "aws custom_action name must be specified with dimensions")
+		}
+		return
+	}
+	if !regexp.MustCompile(`^[a-zA-Z0-9]{1,128}$`).MatchString(customAction.Name) {
+		v.errorf("cloud_providers.aws.custom_action.name", "aws custom_action name %s must be 1-128 alphanumeric characters", customAction.Name)
+	}
+	if len(customAction.Dimensions) == 0 {
+		v.errorf("cloud_providers.aws.custom_action.dimensions", "aws custom_action must have at least one dimension")
+	}
+	re := regexp.MustCompile(`^[a-zA-Z0-9-_ ]{1,128}$`)
+	for i, dimension := range customAction.Dimensions {
+		if !re.MatchString(dimension) {
+			v.errorf(fmt.Sprintf("cloud_providers.aws.custom_action.dimensions.%d", i), "aws custom_action dimension %s does not match the following regex: %s", dimension, re.String())
+		}
+	}
+}
+
+// checkGCPCredentialsValid checks the credentials settings shared by the gcp and cloudarmor providers.
+func checkGCPCredentialsValid(v *validator, provider string, impersonateServiceAccount string) {
+	if impersonateServiceAccount != "" && !gcpServiceAccount.MatchString(impersonateServiceAccount) {
+		v.errorf(fmt.Sprintf("cloud_providers.%s.impersonate_service_account", provider), "%s impersonate_service_account %s must be the email of a service account", provider, impersonateServiceAccount)
+	}
+}
+
+func checkAWSCredentialsValid(v *validator, config *models.AWSConfig) {
+	if (config.AccessKeyIDFile == "") != (config.SecretAccessKeyFile == "") {
+		v.errorf("cloud_providers.aws.access_key_id_file", "aws access_key_id_file and secret_access_key_file must be specified together")
+	}
+	if config.Profile != "" && config.AccessKeyIDFile != "" {
+		v.errorf("cloud_providers.aws.profile", "aws profile and access_key_id_file cannot be specified together")
+	}
+	if config.AssumeRoleARN == "" {
+		if config.ExternalID != "" || config.RoleSessionName != "" {
+			v.errorf("cloud_providers.aws.assume_role_arn", "aws assume_role_arn must be specified with external_id or role_session_name")
+		}
+		return
+	}
+	if !awsRoleARN.MatchString(config.AssumeRoleARN) {
+		v.errorf("cloud_providers.aws.assume_role_arn", "aws assume_role_arn %s does not match the following regex: %s", config.AssumeRoleARN, awsRoleARN.String())
+	}
+	if config.ExternalID != "" && (len(config.ExternalID) < 2 || len(config.ExternalID) > 1224 || !awsExternalID.MatchString(config.ExternalID)) {
+		v.errorf("cloud_providers.aws.external_id", "aws external_id must be 2-1224 characters matching the following regex: %s", awsExternalID.String())
+	}
+	if config.RoleSessionName != "" && !awsSessionName.MatchString(config.RoleSessionName) {
+		v.errorf("cloud_providers.aws.role_session_name", "aws role_session_name %s does not match the following regex: %s", config.RoleSessionName, awsSessionName.String())
+	}
+}
+
+// checkCredentialsValid checks the credentials settings of the cloud providers. The credentials files are only read
+// when the clients are created.
+func checkCredentialsValid(v *validator, providers *models.CloudProviders) {
+	checkGCPCredentialsValid(v, "gcp", providers.GCP.ImpersonateServiceAccount)
+	checkGCPCredentialsValid(v, "cloudarmor", providers.CloudArmor.ImpersonateServiceAccount)
+	checkAWSCredentialsValid(v, &providers.AWS)
+}
+
+// checkPriorityRangeValid checks that the priority range is valid. It returns false if the priority range is not
+// configured or is invalid.
+func checkPriorityRangeValid(v *validator, provider string, field string, priorityRange models.PriorityRange) bool {
+	if priorityRange.Min == 0 && priorityRange.Max == 0 {
+		return false
+	}
+	if priorityRange.Min < 0 || priorityRange.Max < priorityRange.Min {
+		v.errorf(field+".priority_range", "%s priority_range %d-%d is invalid, max must be greater than or equal to min", provider, priorityRange.Min, priorityRange.Max)
+		return false
+	}
+	return true
+}
+
+// checkPriorityWithinRange checks that a configured priority is within the priority range.
+// Priorities that are not configured (0) default to the start of the range.
+func checkPriorityWithinRange(v *validator, provider string, field string, priorityRange models.PriorityRange, priority int64) {
+	if priority != 0 && !priorityRange.Contains(priority) {
+		v.errorf(field, "%s priority %d is not within priority_range %d-%d", provider, priority, priorityRange.Min, priorityRange.Max)
+	}
+}
+
+// checkCloudProvidersRequired validates that at least one cloud provider is enabled and that the enabled providers
+// have their mandatory settings.
+func checkCloudProvidersRequired(v *validator, providers *models.CloudProviders) {
+	enabled := 0
+	if !reflect.DeepEqual(models.GCPConfig{}, providers.GCP) && !providers.GCP.Disabled {
+		enabled++
+		if providers.GCP.Network == "" {
+			v.errorf("cloud_providers.gcp.network", "network must be specified in gcp config")
+		}
+	}
+	if !reflect.DeepEqual(models.AWSConfig{}, providers.AWS) && !providers.AWS.Disabled {
+		enabled++
+		if providers.AWS.Region == "" {
+			v.errorf("cloud_providers.aws.region", "region must be specified in aws config")
+		}
+		if providers.AWS.FirewallPolicy == "" {
+			v.errorf("cloud_providers.aws.firewall_policy", "firewall_policy must be specified in aws config")
+		}
+	}
+	if !reflect.DeepEqual(models.CloudArmorConfig{}, providers.CloudArmor) && !providers.CloudArmor.Disabled {
+		enabled++
+		if providers.CloudArmor.Policy == "" {
+			v.errorf("cloud_providers.cloudarmor.policy", "policy must be specified in cloudarmor config")
+		}
+	}
+	if enabled == 0 {
+		v.errorf("cloud_providers", "at least one cloud provider must be configured")
+	}
+}
+
+// checkDecisionExpansionValid validates the decision expansion settings.
+func checkDecisionExpansionValid(v *validator, config *models.ExpansionConfig) {
+	if config.MaxPrefixes < 0 {
+		v.errorf("decision_expansion.max_prefixes", "decision_expansion max_prefixes must be positive")
+	}
+	if config.MaxPrefixes > 0 && len(config.Databases) == 0 {
+		v.errorf("decision_expansion.databases", "decision_expansion databases must be specified")
+	}
+}
+
+// checkBouncerSettingsValid validates the settings of the bouncer itself, such as the LAPI connection and logging.
+func checkBouncerSettingsValid(v *validator, config *BouncerConfig) {
+	if config.RuleNamePrefix == "" {
+		v.errorf("rule_name_prefix", "rule_name_prefix must be specified")
+	} else if err := checkRuleNamePrefixValid(config.RuleNamePrefix); err != nil {
+		v.errorf("rule_name_prefix", "%s", err)
+	}
+	if config.UpdateFrequency == "" {
+		v.errorf("update_frequency", "update_frequency must be specified")
+	} else if d, err := time.ParseDuration(config.UpdateFrequency); err != nil || d <= 0 {
+		v.errorf("update_frequency", "update_frequency %s must be a positive duration such as 10s", config.UpdateFrequency)
+	}
+	if config.APIUrl == "" {
+		v.errorf("api_url", "api_url must be specified")
+	} else if u, err := url.Parse(config.APIUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.errorf("api_url", "api_url %s must be an http or https URL such as http://localhost:8080/", config.APIUrl)
+	}
+	if config.APIKey == "" && config.APIKeyFile == "" && config.CertPath == "" {
+		v.errorf("api_key", "api_key, api_key_file or cert_path must be specified")
+	}
+	checkLAPITLSValid(v, config)
+	if config.Preflight != "" && !contains(preflightModes, config.Preflight) {
+		v.errorf("preflight", "preflight %s is invalid, expecting one of %v", config.Preflight, preflightModes)
+	}
+	if config.LogMode != "file" && config.LogMode != "stdout" {
+		v.errorf("log_mode", "log mode '%s' unknown, expecting 'file' or 'stdout'", config.LogMode)
+	}
+}
+
+// checkDurationValid checks that the duration is empty or positive, and returns it.
+func checkDurationValid(v *validator, field string, duration string) (time.Duration, bool) {
+	if duration == "" {
+		return 0, true
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil || d <= 0 {
+		v.errorf(field, "duration %s must be a positive duration such as 24h", duration)
+		return 0, false
+	}
+	return d, true
+}
+
+// checkDurationPolicyValid checks the durations of the policy, the minimum duration being at most the maximum one.
+func checkDurationPolicyValid(v *validator, policy *models.DurationPolicy) {
+	minDuration, minValid := checkDurationValid(v, "durations.min_duration", policy.MinDuration)
+	maxDuration, maxValid := checkDurationValid(v, "durations.max_duration", policy.MaxDuration)
+	if minValid && maxValid && maxDuration > 0 && minDuration > maxDuration {
+		v.errorf("durations.min_duration", "min_duration %s must not be greater than max_duration %s", policy.MinDuration, policy.MaxDuration)
+	}
+	checkDurationValid(v, "durations.hold_down", policy.HoldDown)
+}
+
+// checkRoutesValid checks the matchers and the providers of the decision routes.
+func checkRoutesValid(v *validator, routes []models.DecisionRoute) {
+	for i, route := range routes {
+		field := fmt.Sprintf("routes.%d", i)
+		minDuration, minValid := checkDurationValid(v, field+".min_duration", route.MinDuration)
+		maxDuration, maxValid := checkDurationValid(v, field+".max_duration", route.MaxDuration)
+		if minValid && maxValid && maxDuration > 0 && minDuration > maxDuration {
+			v.errorf(field+".min_duration", "route min_duration %s must not be greater than max_duration %s", route.MinDuration, route.MaxDuration)
+		}
+		for j, cidr := range route.CIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				v.errorf(fmt.Sprintf("%s.cidrs.%d", field, j), "route cidr %s is not a valid IP range such as 10.0.0.0/8", cidr)
+			}
+		}
+		for j, provider := range route.Providers {
+			if !contains(ProviderNames, provider) {
+				v.errorf(fmt.Sprintf("%s.providers.%d", field, j), "route provider %s is invalid, expecting one of %v", provider, ProviderNames)
+			}
+		}
+	}
+}
+
+// checkBatchValid checks the flush window and the batch size of a provider.
+func checkBatchValid(v *validator, field string, batch *models.BatchConfig) {
+	checkDurationValid(v, field+".flush_window", batch.FlushWindow)
+	if batch.MaxBatchSize < 0 {
+		v.errorf(field+".max_batch_size", "max_batch_size %d must not be negative", batch.MaxBatchSize)
+	}
+}
+
+// checkTiersValid checks that the tiers have unique names and that only the last tier matches all the origins.
+func checkTiersValid(v *validator, tiers []models.DecisionTier) {
+	names := make(map[string]bool)
+	for i, tier := range tiers {
+		field := fmt.Sprintf("tiers.%d", i)
+		if tier.Name == "" {
+			v.errorf(field+".name", "tier name must be specified")
+		} else if names[tier.Name] {
+			v.errorf(field+".name", "tier name %s is already used", tier.Name)
+		}
+		names[tier.Name] = true
+		if len(tier.Origins) == 0 && i < len(tiers)-1 {
+			v.errorf(field+".origins", "tier %s has no origins and matches all the decisions, it must be the last tier", tier.Name)
+		}
+	}
+}
+
+// checkLAPITLSValid checks the TLS settings of the connection to the LAPI. The certificate files are only read when
+// the bouncer connects to the LAPI.
+func checkLAPITLSValid(v *validator, config *BouncerConfig) {
+	if (config.CertPath == "") != (config.KeyPath == "") {
+		v.errorf("cert_path", "cert_path and key_path must be specified together")
+	}
+	if config.CACertPath == "" && config.CertPath == "" && !config.InsecureSkipVerify {
+		return
+	}
+	if u, err := url.Parse(config.APIUrl); err == nil && u.Scheme == "http" {
+		v.errorf("api_url", "api_url %s must be an https URL to use ca_cert_path, cert_path or insecure_skip_verify", config.APIUrl)
+	}
+}
 
+// ValidateConfig parses the configuration and validates all its settings without contacting any API. All the errors
+// found are returned at once as ValidationErrors.
+func ValidateConfig(configBuff []byte) (*BouncerConfig, error) {
 	config := &BouncerConfig{}
+	v := &validator{}
 	if err := yaml.UnmarshalStrict(configBuff, &config); err != nil {
-		return &BouncerConfig{}, fmt.Errorf("failed to unmarshal yaml config file: %s", err)
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return &BouncerConfig{}, fmt.Errorf("failed to unmarshal yaml config file: %s", err)
+		}
+		// the other fields are still decoded, so that their errors are reported along with the type errors
+		v.addTypeErrors(typeErr)
 	}
 
 	config.RuleNamePrefix = strings.ToLower(config.RuleNamePrefix)
+	if config.LogMode == "file" && config.LogDir == "" {
+		config.LogDir = "/var/log/"
+	}
 
-	if config.RuleNamePrefix == "" {
-		return &BouncerConfig{}, fmt.Errorf("rule_name_prefix must be specified")
+	loadAPIKeyFile(v, config)
+	checkBouncerSettingsValid(v, config)
+	checkCloudProvidersRequired(v, &config.CloudProviders)
+	checkGCPConfigValid(v, &config.CloudProviders.GCP)
+	checkAWSConfigValid(v, &config.CloudProviders.AWS)
+	checkCloudArmorConfigValid(v, &config.CloudProviders.CloudArmor)
+	checkCredentialsValid(v, &config.CloudProviders)
+	checkBatchValid(v, "cloud_providers.gcp.batch", &config.CloudProviders.GCP.Batch)
+	checkBatchValid(v, "cloud_providers.aws.batch", &config.CloudProviders.AWS.Batch)
+	checkBatchValid(v, "cloud_providers.cloudarmor.batch", &config.CloudProviders.CloudArmor.Batch)
+	checkDecisionExpansionValid(v, &config.DecisionExpansion)
+	checkRoutesValid(v, config.Routes)
+	checkTiersValid(v, config.Tiers)
+	checkDurationPolicyValid(v, &config.Durations)
+
+	if err := v.err(); err != nil {
+		v.locate(configBuff)
+		return &BouncerConfig{}, err
 	}
+	return config, nil
+}
 
-	if err := checkRuleNamePrefixValid(config.RuleNamePrefix); err != nil {
+func GenerateConfig(configBuff []byte) (*BouncerConfig, error) {
+
+	config, err := ValidateConfig(configBuff)
+	if err != nil {
 		return &BouncerConfig{}, err
 	}
 
@@ -66,9 +577,6 @@ func GenerateConfig(configBuff []byte) (*BouncerConfig, error) {
 		log.Fatal(err.Error())
 	}
 	if config.LogMode == "file" {
-		if config.LogDir == "" {
-			config.LogDir = "/var/log/"
-		}
 		var LogOutput *lumberjack.Logger //io.Writer
 		LogOutput = &lumberjack.Logger{
 			Filename:   config.LogDir + "/cs-cloud-firewall-bouncer.log",
@@ -79,17 +587,32 @@ func GenerateConfig(configBuff []byte) (*BouncerConfig, error) {
 		}
 		log.SetOutput(LogOutput)
 		log.SetFormatter(&log.TextFormatter{TimestampFormat: "02-01-2006 15:04:05", FullTimestamp: true})
-	} else if config.LogMode != "stdout" {
-		return &BouncerConfig{}, fmt.Errorf("log mode '%s' unknown, expecting 'file' or 'stdout'", config.LogMode)
 	}
 	return config, nil
 }
 
-func NewConfig(configPath string) (*BouncerConfig, error) {
-	configBuff, err := ioutil.ReadFile(configPath)
+// LoadConfig reads the configuration file, merged with its .local overlay and the environment variable overrides, and
+// validates it without contacting any API. Unlike NewConfig, it does not configure logging.
+func LoadConfig(configPath string) (*BouncerConfig, error) {
+	configBuff, err := readConfig(configPath)
+	if err != nil {
+		return &BouncerConfig{}, err
+	}
+	return ValidateConfig(configBuff)
+}
+
+// CheckConfig validates the configuration file without contacting any API.
+func CheckConfig(configPath string) error {
+	_, err := LoadConfig(configPath)
+	return err
+}
 
+// NewConfig reads the configuration file, merged with its .local overlay and the environment variable overrides, and
+// configures logging.
+func NewConfig(configPath string) (*BouncerConfig, error) {
+	configBuff, err := readConfig(configPath)
 	if err != nil {
-		return &BouncerConfig{}, fmt.Errorf("failed to read %s : %s", configPath, err)
+		return &BouncerConfig{}, err
 	}
 	return GenerateConfig(configBuff)
 }
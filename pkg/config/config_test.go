@@ -6,6 +6,7 @@ import (
 
 	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 )
 
 func Test_checkRuleNamePrefixValid(t *testing.T) {
@@ -165,3 +166,507 @@ func TestGenerateConfig(t *testing.T) {
 		})
 	}
 }
+
+// newProvidersConfig returns a valid configuration of the providers, with their mandatory settings when missing.
+// Only the configured providers are written, as the empty ones would not be empty once parsed.
+func newProvidersConfig(providers models.CloudProviders) map[string]interface{} {
+	configured := map[string]interface{}{}
+	if !reflect.DeepEqual(models.GCPConfig{}, providers.GCP) || reflect.DeepEqual(models.CloudProviders{}, providers) {
+		if providers.GCP.Network == "" {
+			providers.GCP.Network = "default"
+		}
+		configured["gcp"] = providers.GCP
+	}
+	if !reflect.DeepEqual(models.AWSConfig{}, providers.AWS) {
+		if providers.AWS.Region == "" {
+			providers.AWS.Region = "us-east-1"
+		}
+		if providers.AWS.FirewallPolicy == "" {
+			providers.AWS.FirewallPolicy = "policy"
+		}
+		configured["aws"] = providers.AWS
+	}
+	if !reflect.DeepEqual(models.CloudArmorConfig{}, providers.CloudArmor) {
+		if providers.CloudArmor.Policy == "" {
+			providers.CloudArmor.Policy = "policy"
+		}
+		configured["cloudarmor"] = providers.CloudArmor
+	}
+	return map[string]interface{}{
+		"cloud_providers":  configured,
+		"rule_name_prefix": "crowdsec",
+		"update_frequency": "10s",
+		"log_mode":         "stdout",
+		"api_url":          "http://localhost:8080/",
+		"api_key":          "42c09b2ea8b2905b9333db61c6f4f94c",
+	}
+}
+
+func TestValidateConfigCloudProviders(t *testing.T) {
+	tests := []struct {
+		name      string
+		providers models.CloudProviders
+		wantErr   bool
+	}{
+		{
+			name:      "defaults",
+			providers: models.CloudProviders{},
+			wantErr:   false,
+		},
+		{
+			name: "gcp_protocols",
+			providers: models.CloudProviders{
+				GCP: models.GCPConfig{
+					Action: "deny",
+					Protocols: []models.GCPProtocolConfig{
+						{Protocol: "tcp", Ports: []string{"22", "8000-9000"}},
+						{Protocol: "icmp"},
+						{Protocol: "47"},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "gcp_targets_logging_direction",
+			providers: models.CloudProviders{
+				GCP: models.GCPConfig{TargetTags: []string{"web"}, EnableLogging: true, LogMetadata: "EXCLUDE_ALL_METADATA", Direction: "both"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "priority_ranges",
+			providers: models.CloudProviders{
+				GCP:        models.GCPConfig{Priority: 1000, PriorityRange: models.PriorityRange{Min: 1000, Max: 1100}},
+				CloudArmor: models.CloudArmorConfig{PriorityRange: models.PriorityRange{Min: 100, Max: 500}},
+				AWS:        models.AWSConfig{RuleGroupPriority: 20, PriorityRange: models.PriorityRange{Min: 10, Max: 20}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "priority_range_inverted",
+			providers: models.CloudProviders{
+				GCP: models.GCPConfig{PriorityRange: models.PriorityRange{Min: 1100, Max: 1000}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "priority_outside_range",
+			providers: models.CloudProviders{
+				CloudArmor: models.CloudArmorConfig{
+					PriorityRange: models.PriorityRange{Min: 100, Max: 500},
+					Captcha:       models.CloudArmorCaptchaConfig{Enabled: true, Priority: 600},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "gcp_tags_and_service_accounts",
+			providers: models.CloudProviders{
+				GCP: models.GCPConfig{TargetTags: []string{"web"}, TargetServiceAccounts: []string{"sa@project.iam.gserviceaccount.com"}},
+			},
+			wantErr: true,
+		},
+		{
+			name:      "gcp_log_metadata_without_logging",
+			providers: models.CloudProviders{GCP: models.GCPConfig{LogMetadata: "INCLUDE_ALL_METADATA"}},
+			wantErr:   true,
+		},
+		{
+			name:      "aws_egress",
+			providers: models.CloudProviders{AWS: models.AWSConfig{Direction: "egress"}},
+			wantErr:   false,
+		},
+		{
+			name:      "aws_invalid_direction",
+			providers: models.CloudProviders{AWS: models.AWSConfig{Direction: "outbound"}},
+			wantErr:   true,
+		},
+		{
+			name:      "gcp_invalid_direction",
+			providers: models.CloudProviders{GCP: models.GCPConfig{Direction: "outbound"}},
+			wantErr:   true,
+		},
+		{
+			name:      "gcp_invalid_action",
+			providers: models.CloudProviders{GCP: models.GCPConfig{Action: "allow"}},
+			wantErr:   true,
+		},
+		{
+			name: "gcp_ports_without_tcp_udp",
+			providers: models.CloudProviders{
+				GCP: models.GCPConfig{Protocols: []models.GCPProtocolConfig{{Protocol: "icmp", Ports: []string{"22"}}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "gcp_invalid_port_range",
+			providers: models.CloudProviders{
+				GCP: models.GCPConfig{Protocols: []models.GCPProtocolConfig{{Protocol: "tcp", Ports: []string{"9000-8000"}}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "aws_custom_action",
+			providers: models.CloudProviders{
+				AWS: models.AWSConfig{
+					Action:       "aws:forward_to_sfe",
+					CustomAction: models.AWSCustomActionConfig{Name: "CrowdSecMetrics", Dimensions: []string{"crowdsec-blocked"}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name:      "aws_invalid_action",
+			providers: models.CloudProviders{AWS: models.AWSConfig{Action: "aws:pass"}},
+			wantErr:   true,
+		},
+		{
+			name: "aws_custom_action_without_dimension",
+			providers: models.CloudProviders{
+				AWS: models.AWSConfig{CustomAction: models.AWSCustomActionConfig{Name: "CrowdSecMetrics"}},
+			},
+			wantErr: true,
+		},
+		{
+			name:      "cloudarmor_deny_404",
+			providers: models.CloudProviders{CloudArmor: models.CloudArmorConfig{Action: "deny(404)"}},
+			wantErr:   false,
+		},
+		{
+			name: "cloudarmor_redirect_recaptcha",
+			providers: models.CloudProviders{
+				CloudArmor: models.CloudArmorConfig{Action: "redirect", Redirect: models.CloudArmorRedirectConfig{Type: "GOOGLE_RECAPTCHA"}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "cloudarmor_redirect_302_without_target",
+			providers: models.CloudProviders{
+				CloudArmor: models.CloudArmorConfig{Action: "redirect", Redirect: models.CloudArmorRedirectConfig{Type: "EXTERNAL_302"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "cloudarmor_throttle",
+			providers: models.CloudProviders{
+				CloudArmor: models.CloudArmorConfig{Action: "throttle", RateLimit: models.CloudArmorRateLimitConfig{ThresholdCount: 100, IntervalSec: 60}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "cloudarmor_throttle_invalid_interval",
+			providers: models.CloudProviders{
+				CloudArmor: models.CloudArmorConfig{Action: "throttle", RateLimit: models.CloudArmorRateLimitConfig{ThresholdCount: 100, IntervalSec: 45}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "cloudarmor_captcha",
+			providers: models.CloudProviders{
+				CloudArmor: models.CloudArmorConfig{Captcha: models.CloudArmorCaptchaConfig{Enabled: true, Priority: 1000, MaxRules: 10}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "cloudarmor_captcha_recaptcha_action",
+			providers: models.CloudProviders{
+				CloudArmor: models.CloudArmorConfig{
+					Action:   "redirect",
+					Redirect: models.CloudArmorRedirectConfig{Type: "GOOGLE_RECAPTCHA"},
+					Captcha:  models.CloudArmorCaptchaConfig{Enabled: true},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "cloudarmor_regional",
+			providers: models.CloudProviders{
+				CloudArmor: models.CloudArmorConfig{Region: "us-central1", PolicyType: "CLOUD_ARMOR", Action: "throttle", RateLimit: models.CloudArmorRateLimitConfig{ThresholdCount: 100, IntervalSec: 60}},
+			},
+			wantErr: false,
+		},
+		{
+			name:      "cloudarmor_edge",
+			providers: models.CloudProviders{CloudArmor: models.CloudArmorConfig{PolicyType: "CLOUD_ARMOR_EDGE", Action: "deny(404)"}},
+			wantErr:   false,
+		},
+		{
+			name:      "cloudarmor_invalid_policy_type",
+			providers: models.CloudProviders{CloudArmor: models.CloudArmorConfig{PolicyType: "EDGE"}},
+			wantErr:   true,
+		},
+		{
+			name:      "cloudarmor_regional_edge",
+			providers: models.CloudProviders{CloudArmor: models.CloudArmorConfig{PolicyType: "CLOUD_ARMOR_EDGE", Region: "us-central1"}},
+			wantErr:   true,
+		},
+		{
+			name: "cloudarmor_edge_throttle",
+			providers: models.CloudProviders{
+				CloudArmor: models.CloudArmorConfig{PolicyType: "CLOUD_ARMOR_EDGE", Action: "throttle", RateLimit: models.CloudArmorRateLimitConfig{ThresholdCount: 100, IntervalSec: 60}},
+			},
+			wantErr: true,
+		},
+		{
+			name:      "cloudarmor_address_groups_negative_capacity",
+			providers: models.CloudProviders{CloudArmor: models.CloudArmorConfig{AddressGroups: models.CloudArmorAddressGroupsConfig{Enabled: true, Capacity: -1}}},
+			wantErr:   true,
+		},
+		{
+			name: "credentials",
+			providers: models.CloudProviders{
+				GCP:        models.GCPConfig{CredentialsFile: "/etc/gcp.json", ImpersonateServiceAccount: "bouncer@project.iam.gserviceaccount.com"},
+				CloudArmor: models.CloudArmorConfig{ImpersonateServiceAccount: "bouncer@project.iam.gserviceaccount.com"},
+				AWS:        models.AWSConfig{AccessKeyIDFile: "/run/id", SecretAccessKeyFile: "/run/secret", AssumeRoleARN: "arn:aws:iam::123456789012:role/bouncer", ExternalID: "crowdsec", RoleSessionName: "bouncer"},
+			},
+			wantErr: false,
+		},
+		{
+			name:      "gcp_impersonate_invalid",
+			providers: models.CloudProviders{GCP: models.GCPConfig{ImpersonateServiceAccount: "bouncer"}},
+			wantErr:   true,
+		},
+		{
+			name:      "aws_access_key_without_secret",
+			providers: models.CloudProviders{AWS: models.AWSConfig{AccessKeyIDFile: "/run/id"}},
+			wantErr:   true,
+		},
+		{
+			name:      "aws_profile_with_access_key",
+			providers: models.CloudProviders{AWS: models.AWSConfig{Profile: "prod", AccessKeyIDFile: "/run/id", SecretAccessKeyFile: "/run/secret"}},
+			wantErr:   true,
+		},
+		{
+			name:      "aws_external_id_without_role",
+			providers: models.CloudProviders{AWS: models.AWSConfig{ExternalID: "crowdsec"}},
+			wantErr:   true,
+		},
+		{
+			name:      "aws_assume_role_arn_invalid",
+			providers: models.CloudProviders{AWS: models.AWSConfig{AssumeRoleARN: "arn:aws:iam::123:user/bouncer"}},
+			wantErr:   true,
+		},
+		{
+			name: "cloudarmor_rate_limit_without_throttle",
+			providers: models.CloudProviders{
+				CloudArmor: models.CloudArmorConfig{Action: "deny(403)", RateLimit: models.CloudArmorRateLimitConfig{ThresholdCount: 100, IntervalSec: 60}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configBuff, err := yaml.Marshal(newProvidersConfig(tt.providers))
+			if err != nil {
+				t.Fatalf("yaml.Marshal() error = %v", err)
+			}
+			if _, err := ValidateConfig(configBuff); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	configBuff := []byte("cloud_providers:\n" +
+		"  gcp:\n" +
+		"    priority: 10\n" +
+		"    priority_range:\n" +
+		"      min: 100\n" +
+		"      max: 199\n" +
+		"    protocols:\n" +
+		"      - protocol: tcp\n" +
+		"        ports: [\"22\", \"70000\"]\n" +
+		"  aws:\n" +
+		"    region: us-east-1\n" +
+		"    firewall_policy: policy\n" +
+		"    unknown: true\n" +
+		"rule_name_prefix: crowdsec\n" +
+		"update_frequency: often\n" +
+		"log_mode: stdout\n" +
+		"api_url: localhost:8080\n" +
+		"api_key: 42c09b2ea8b2905b9333db61c6f4f94c")
+	want := []string{
+		"line 13: field unknown not found in type models.AWSConfig",
+		"line 15: update_frequency often must be a positive duration such as 10s",
+		"line 17: api_url localhost:8080 must be an http or https URL such as http://localhost:8080/",
+		"line 2: network must be specified in gcp config",
+		"line 9: gcp port 70000 is not a valid port or port range",
+		"line 3: gcp priority 10 is not within priority_range 100-199",
+	}
+
+	_, err := ValidateConfig(configBuff)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("ValidateConfig() error = %v, want ValidationErrors", err)
+	}
+	got := []string{}
+	for _, e := range errs {
+		got = append(got, e.Error())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ValidateConfig() = %q, want %q", got, want)
+	}
+}
+
+func TestValidateConfigMissingSettings(t *testing.T) {
+	_, err := ValidateConfig([]byte("log_mode: syslog\n"))
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("ValidateConfig() error = %v, want ValidationErrors", err)
+	}
+	// rule_name_prefix, update_frequency, api_url, api_key, log_mode and cloud_providers
+	if len(errs) != 6 {
+		t.Errorf("ValidateConfig() returned %d errors, want 6: %s", len(errs), err)
+	}
+	if errs[5].Line != 0 || errs[4].Line != 1 {
+		t.Errorf("ValidateConfig() errors located at lines %d and %d, want 1 and 0", errs[4].Line, errs[5].Line)
+	}
+}
+
+func Test_checkLAPITLSValid(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  BouncerConfig
+		wantErr bool
+	}{
+		{name: "api_key_over_http", config: BouncerConfig{APIUrl: "http://localhost:8080/"}},
+		{name: "client_certificate", config: BouncerConfig{APIUrl: "https://crowdsec:8080/", CACertPath: "ca.pem", CertPath: "bouncer.pem", KeyPath: "bouncer-key.pem"}},
+		{name: "cert_without_key", config: BouncerConfig{APIUrl: "https://crowdsec:8080/", CertPath: "bouncer.pem"}, wantErr: true},
+		{name: "tls_over_http", config: BouncerConfig{APIUrl: "http://localhost:8080/", InsecureSkipVerify: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &validator{}
+			checkLAPITLSValid(v, &tt.config)
+			if err := v.err(); (err != nil) != tt.wantErr {
+				t.Errorf("checkLAPITLSValid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_checkRoutesValid(t *testing.T) {
+	tests := []struct {
+		name    string
+		routes  []models.DecisionRoute
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			routes: []models.DecisionRoute{
+				{Scenarios: []string{"crowdsecurity/http-*"}, Providers: []string{"cloudarmor"}},
+				{Origins: []string{"lists"}, MinDuration: "1h", MaxDuration: "48h", CIDRs: []string{"0.0.0.0/0"}, Providers: []string{"aws", "gcp"}},
+				{Scopes: []string{"Country"}},
+			},
+		},
+		{name: "unknown_provider", routes: []models.DecisionRoute{{Providers: []string{"azure"}}}, wantErr: true},
+		{name: "invalid_duration", routes: []models.DecisionRoute{{MinDuration: "1d"}}, wantErr: true},
+		{name: "min_greater_than_max", routes: []models.DecisionRoute{{MinDuration: "2h", MaxDuration: "1h"}}, wantErr: true},
+		{name: "invalid_cidr", routes: []models.DecisionRoute{{CIDRs: []string{"10.0.0.1"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &validator{}
+			checkRoutesValid(v, tt.routes)
+			if err := v.err(); (err != nil) != tt.wantErr {
+				t.Errorf("checkRoutesValid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_checkTiersValid(t *testing.T) {
+	tests := []struct {
+		name    string
+		tiers   []models.DecisionTier
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			tiers: []models.DecisionTier{
+				{Name: "local", Origins: []string{"crowdsec", "cscli"}},
+				{Name: "lists", Origins: []string{"lists"}},
+				{Name: "capi"},
+			},
+		},
+		{name: "missing_name", tiers: []models.DecisionTier{{Origins: []string{"cscli"}}}, wantErr: true},
+		{name: "duplicate_name", tiers: []models.DecisionTier{{Name: "local", Origins: []string{"cscli"}}, {Name: "local"}}, wantErr: true},
+		{name: "catch_all_not_last", tiers: []models.DecisionTier{{Name: "all"}, {Name: "local", Origins: []string{"cscli"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &validator{}
+			checkTiersValid(v, tt.tiers)
+			if err := v.err(); (err != nil) != tt.wantErr {
+				t.Errorf("checkTiersValid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_checkDurationPolicyValid(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  models.DurationPolicy
+		wantErr bool
+	}{
+		{name: "empty", policy: models.DurationPolicy{}},
+		{name: "valid", policy: models.DurationPolicy{MinDuration: "2m", MaxDuration: "168h", HoldDown: "10m"}},
+		{name: "invalid_duration", policy: models.DurationPolicy{MaxDuration: "7d"}, wantErr: true},
+		{name: "negative_hold_down", policy: models.DurationPolicy{HoldDown: "-5m"}, wantErr: true},
+		{name: "min_greater_than_max", policy: models.DurationPolicy{MinDuration: "2h", MaxDuration: "1h"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &validator{}
+			checkDurationPolicyValid(v, &tt.policy)
+			if err := v.err(); (err != nil) != tt.wantErr {
+				t.Errorf("checkDurationPolicyValid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_checkBatchValid(t *testing.T) {
+	tests := []struct {
+		name    string
+		batch   models.BatchConfig
+		wantErr bool
+	}{
+		{name: "empty", batch: models.BatchConfig{}},
+		{name: "valid", batch: models.BatchConfig{FlushWindow: "30s", MaxBatchSize: 500, Immediate: models.DecisionFilter{Origins: []string{"cscli"}}}},
+		{name: "invalid_flush_window", batch: models.BatchConfig{FlushWindow: "30"}, wantErr: true},
+		{name: "negative_max_batch_size", batch: models.BatchConfig{MaxBatchSize: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &validator{}
+			checkBatchValid(v, "cloud_providers.gcp.batch", &tt.batch)
+			if err := v.err(); (err != nil) != tt.wantErr {
+				t.Errorf("checkBatchValid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_getFieldLine(t *testing.T) {
+	configBuff := []byte("cloud_providers:\n" +
+		"  gcp:\n" +
+		"    protocols:\n" +
+		"      - protocol: tcp\n" +
+		"        ports:\n" +
+		"          - \"22\"\n" +
+		"          - \"80\"\n")
+	v := &validator{}
+	v.errorf("cloud_providers.gcp.protocols.0.ports.1", "invalid port")
+	v.errorf("cloud_providers.gcp.network", "missing network")
+	v.errorf("api_key", "missing api key")
+	v.locate(configBuff)
+	for i, want := range []int{7, 2, 0} {
+		if v.errs[i].Line != want {
+			t.Errorf("error %s located at line %d, want %d", v.errs[i].Field, v.errs[i].Line, want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+const (
+	// envPrefix is the prefix of the environment variables overriding the configuration keys.
+	envPrefix = "CS_CFB_"
+	// localSuffix is the suffix of the file overlaying the configuration file.
+	localSuffix = ".local"
+)
+
+var (
+	envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	// envPlaceholder is the placeholder of a ${VAR} reference while the configuration is parsed. Unlike the reference,
+	// it is a valid plain scalar anywhere, such as in a [a, b] list.
+	envPlaceholder = regexp.MustCompile(`__env\.([A-Za-z_][A-Za-z0-9_]*)\.__`)
+)
+
+// markEnvReferences replaces the ${VAR} references of the configuration by placeholders, so that the configuration is
+// parsed before the references are expanded.
+func markEnvReferences(configBuff []byte) []byte {
+	return envReference.ReplaceAll(configBuff, []byte("__env.${1}.__"))
+}
+
+// expandEnv replaces the referenced variables of the scalars of the parsed configuration by the value of the
+// environment variables, and returns the number of expanded references. Undefined variables are replaced by an empty
+// string. The values are never parsed as YAML: an unquoted value made of a single reference gets the type of its value,
+// such as a boolean or a number, and any other value is a string.
+func expandEnv(node *yamlv3.Node) int {
+	expanded := 0
+	if node.Kind == yamlv3.ScalarNode {
+		whole := node.Style == 0 && envPlaceholder.FindString(node.Value) == node.Value
+		node.Value = envPlaceholder.ReplaceAllStringFunc(node.Value, func(placeholder string) string {
+			expanded++
+			return os.Getenv(envPlaceholder.FindStringSubmatch(placeholder)[1])
+		})
+		if whole && expanded > 0 {
+			// the tag is resolved from the value when the configuration is written, and the value is quoted if needed
+			node.Tag = ""
+		}
+	}
+	for _, child := range node.Content {
+		expanded += expandEnv(child)
+	}
+	return expanded
+}
+
+// parseDocument parses the configuration into a document whose content is a mapping, even if the configuration is empty.
+func parseDocument(configBuff []byte) (*yamlv3.Node, error) {
+	doc := &yamlv3.Node{}
+	if err := yamlv3.Unmarshal(configBuff, doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		doc.Kind = yamlv3.DocumentNode
+		doc.Content = []*yamlv3.Node{{Kind: yamlv3.MappingNode, Tag: "!!map"}}
+	}
+	return doc, nil
+}
+
+// getMappingValue returns the value of the key in the mapping, or nil if the key is missing.
+func getMappingValue(mapping *yamlv3.Node, key string) *yamlv3.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// mergeNodes merges the overlay into the node. Mappings are merged key by key, any other value of the overlay
+// replaces the value of the node, including sequences.
+func mergeNodes(node *yamlv3.Node, overlay *yamlv3.Node) {
+	if node.Kind == yamlv3.DocumentNode && overlay.Kind == yamlv3.DocumentNode {
+		mergeNodes(node.Content[0], overlay.Content[0])
+		return
+	}
+	if node.Kind != yamlv3.MappingNode || overlay.Kind != yamlv3.MappingNode {
+		*node = *overlay
+		return
+	}
+	for i := 0; i+1 < len(overlay.Content); i += 2 {
+		key, value := overlay.Content[i], overlay.Content[i+1]
+		if existing := getMappingValue(node, key.Value); existing != nil {
+			mergeNodes(existing, value)
+			continue
+		}
+		node.Content = append(node.Content, key, value)
+	}
+}
+
+// setNode sets the value of the key path in the mapping, creating the missing parent mappings.
+func setNode(mapping *yamlv3.Node, path []string, value *yamlv3.Node) {
+	for i, key := range path {
+		next := getMappingValue(mapping, key)
+		if i == len(path)-1 {
+			if next != nil {
+				*next = *value
+			} else {
+				mapping.Content = append(mapping.Content, &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: key}, value)
+			}
+			return
+		}
+		if next == nil || next.Kind != yamlv3.MappingNode {
+			child := &yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map"}
+			if next != nil {
+				*next = *child
+				child = next
+			} else {
+				mapping.Content = append(mapping.Content, &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: key}, child)
+			}
+			next = child
+		}
+		mapping = next
+	}
+}
+
+// configKey is a key path of the configuration and the kind of its value.
+type configKey struct {
+	path []string
+	kind reflect.Kind
+}
+
+// getConfigKeys returns the keys of the configuration type, from its yaml tags. Lists and values that are not
+// structs, such as the protocols of the gcp provider, are single keys.
+func getConfigKeys(t reflect.Type, prefix []string) []configKey {
+	keys := []configKey{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		path := append(append([]string{}, prefix...), name)
+		if field.Type.Kind() == reflect.Struct {
+			keys = append(keys, getConfigKeys(field.Type, path)...)
+			continue
+		}
+		keys = append(keys, configKey{path: path, kind: field.Type.Kind()})
+	}
+	return keys
+}
+
+// getEnvName returns the name of the environment variable overriding the key path, such as CS_CFB_API_URL for
+// api_url or CS_CFB_CLOUD_PROVIDERS_GCP_NETWORK for the network of the gcp provider.
+func getEnvName(path []string) string {
+	return envPrefix + strings.ToUpper(strings.Join(path, "_"))
+}
+
+// applyEnvOverrides sets the keys of the configuration overridden by environment variables and returns the number of
+// overridden keys. String values are set as they are, the other values are parsed as YAML, so that lists can be
+// written as [a, b].
+func applyEnvOverrides(doc *yamlv3.Node) (int, error) {
+	overridden := 0
+	for _, key := range getConfigKeys(reflect.TypeOf(BouncerConfig{}), nil) {
+		name := getEnvName(key.path)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		valueNode := &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: value}
+		if key.kind != reflect.String {
+			parsed := &yamlv3.Node{}
+			if err := yamlv3.Unmarshal([]byte(value), parsed); err != nil {
+				return overridden, fmt.Errorf("invalid value of %s: %s", name, err)
+			}
+			// values without any YAML content, such as blanks or comments, are kept as strings
+			if len(parsed.Content) > 0 {
+				valueNode = parsed.Content[0]
+			}
+		}
+		setNode(doc.Content[0], key.path, valueNode)
+		log.Debugf("%s overridden by %s", strings.Join(key.path, "."), name)
+		overridden++
+	}
+	return overridden, nil
+}
+
+// readConfig reads the configuration file, merged with its .local overlay file if it exists, and with the keys
+// overridden by environment variables. ${VAR} references are expanded in both files. The configuration is returned
+// unchanged when there is neither reference, overlay nor override, so that the errors are reported at their line in
+// the file.
+func readConfig(configPath string) ([]byte, error) {
+	configBuff, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s : %s", configPath, err)
+	}
+	doc, err := parseDocument(markEnvReferences(configBuff))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal yaml config file: %s", err)
+	}
+	changed := expandEnv(doc) > 0
+
+	localPath := configPath + localSuffix
+	localBuff, err := ioutil.ReadFile(localPath)
+	if err == nil {
+		local, err := parseDocument(markEnvReferences(localBuff))
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal yaml config file %s: %s", localPath, err)
+		}
+		expandEnv(local)
+		mergeNodes(doc, local)
+		log.Infof("merged configuration file %s", localPath)
+		changed = true
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s : %s", localPath, err)
+	}
+
+	overridden, err := applyEnvOverrides(doc)
+	if err != nil {
+		return nil, err
+	}
+	if overridden == 0 && !changed {
+		return configBuff, nil
+	}
+	return yamlv3.Marshal(doc)
+}
+
+// loadAPIKeyFile sets the API key from the content of the API key file, if any.
+func loadAPIKeyFile(v *validator, config *BouncerConfig) {
+	if config.APIKeyFile == "" {
+		return
+	}
+	if config.APIKey != "" {
+		v.errorf("api_key_file", "api_key and api_key_file cannot be specified together")
+		return
+	}
+	apiKey, err := ioutil.ReadFile(config.APIKeyFile)
+	if err != nil {
+		v.errorf("api_key_file", "unable to read api_key_file: %s", err)
+		return
+	}
+	config.APIKey = strings.TrimSpace(string(apiKey))
+	if config.APIKey == "" {
+		v.errorf("api_key_file", "api_key_file %s is empty", config.APIKeyFile)
+	}
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+const baseConfig = "cloud_providers:\n" +
+	"  gcp:\n" +
+	"    network: ${TEST_NETWORK}\n" +
+	"    protocols:\n" +
+	"      - protocol: tcp\n" +
+	"rule_name_prefix: crowdsec\n" +
+	"update_frequency: 10s\n" +
+	"log_mode: stdout\n" +
+	"api_url: http://crowdsec:8080/\n" +
+	"api_key: 42c09b2ea8b2905b9333db61c6f4f94c\n"
+
+func writeConfigFile(t *testing.T, path string, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestConfig(t *testing.T, configPath string) *BouncerConfig {
+	configBuff, err := readConfig(configPath)
+	if err != nil {
+		t.Fatalf("readConfig() error = %v", err)
+	}
+	config, err := ValidateConfig(configBuff)
+	if err != nil {
+		t.Fatalf("ValidateConfig() error = %v", err)
+	}
+	return config
+}
+
+func Test_expandEnv(t *testing.T) {
+	t.Setenv("TEST_NETWORK", "vpc")
+	t.Setenv("TEST_KEY", "a: b #c")
+	t.Setenv("TEST_TAG", "*web")
+	t.Setenv("TEST_DISABLED", "true")
+	doc, err := parseDocument(markEnvReferences([]byte("network: ${TEST_NETWORK}\n" +
+		"api_key: ${TEST_KEY}\n" +
+		"api_url: \"http://${TEST_NETWORK}:8080/$KEEP${TEST_UNDEFINED_VARIABLE}\"\n" +
+		"target_tags: [${TEST_TAG}, api]\n" +
+		"disabled: ${TEST_DISABLED}\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expanded := expandEnv(doc); expanded != 6 {
+		t.Errorf("expandEnv() = %d, want 6", expanded)
+	}
+	configBuff, err := yamlv3.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]interface{}{}
+	if err := yamlv3.Unmarshal(configBuff, got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"network":     "vpc",
+		"api_key":     "a: b #c",
+		"api_url":     "http://vpc:8080/$KEEP",
+		"target_tags": []interface{}{"*web", "api"},
+		"disabled":    true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expandEnv() = %v, want %v", got, want)
+	}
+}
+
+func Test_readConfig(t *testing.T) {
+	t.Setenv("TEST_NETWORK", "vpc")
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, configPath, baseConfig)
+
+	config := readTestConfig(t, configPath)
+	if config.CloudProviders.GCP.Network != "vpc" {
+		t.Errorf("network = %s, want vpc", config.CloudProviders.GCP.Network)
+	}
+
+	// the overlay is merged key by key and replaces lists
+	writeConfigFile(t, configPath+localSuffix, "cloud_providers:\n"+
+		"  gcp:\n"+
+		"    protocols:\n"+
+		"      - protocol: udp\n"+
+		"  aws:\n"+
+		"    region: us-east-1\n"+
+		"    firewall_policy: policy\n"+
+		"update_frequency: 20s\n")
+	config = readTestConfig(t, configPath)
+	if config.CloudProviders.GCP.Network != "vpc" || config.UpdateFrequency != "20s" || config.CloudProviders.AWS.Region != "us-east-1" {
+		t.Errorf("overlay not merged: %+v", config)
+	}
+	if !reflect.DeepEqual(config.CloudProviders.GCP.Protocols, []models.GCPProtocolConfig{{Protocol: "udp"}}) {
+		t.Errorf("protocols = %+v, want udp only", config.CloudProviders.GCP.Protocols)
+	}
+
+	// environment variables override both files
+	t.Setenv("CS_CFB_UPDATE_FREQUENCY", "30s")
+	t.Setenv("CS_CFB_CLOUD_PROVIDERS_GCP_TARGET_TAGS", "[web, api]")
+	t.Setenv("CS_CFB_CLOUD_PROVIDERS_CLOUDARMOR_CAPTCHA_ENABLED", "true")
+	t.Setenv("CS_CFB_CLOUD_PROVIDERS_CLOUDARMOR_POLICY", "policy")
+	config = readTestConfig(t, configPath)
+	if config.UpdateFrequency != "30s" {
+		t.Errorf("update_frequency = %s, want 30s", config.UpdateFrequency)
+	}
+	if !reflect.DeepEqual(config.CloudProviders.GCP.TargetTags, []string{"web", "api"}) {
+		t.Errorf("target_tags = %v, want [web api]", config.CloudProviders.GCP.TargetTags)
+	}
+	if !config.CloudProviders.CloudArmor.Captcha.Enabled || config.CloudProviders.CloudArmor.Policy != "policy" {
+		t.Errorf("cloudarmor not overridden: %+v", config.CloudProviders.CloudArmor)
+	}
+}
+
+func Test_applyEnvOverrides(t *testing.T) {
+	// values without YAML content are kept as strings instead of failing
+	t.Setenv("CS_CFB_API_URL", "  ")
+	t.Setenv("CS_CFB_LOG_DIR", "# comment")
+	t.Setenv("CS_CFB_RULE_NAME_PREFIX", "")
+	// string values are not parsed as YAML
+	t.Setenv("CS_CFB_API_KEY", "&key: #1")
+	t.Setenv("CS_CFB_CLOUD_PROVIDERS_GCP_NETWORK", "*vpc")
+	doc, err := parseDocument([]byte(baseConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyEnvOverrides(doc); err != nil {
+		t.Fatalf("applyEnvOverrides() error = %v", err)
+	}
+	configBuff, err := yamlv3.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &BouncerConfig{}
+	if err := yamlv3.Unmarshal(configBuff, config); err != nil {
+		t.Fatal(err)
+	}
+	if config.APIUrl != "  " || config.LogDir != "# comment" || config.RuleNamePrefix != "" {
+		t.Errorf("overrides not kept as strings: api_url = %q, log_dir = %q, rule_name_prefix = %q", config.APIUrl, config.LogDir, config.RuleNamePrefix)
+	}
+	if config.APIKey != "&key: #1" || config.CloudProviders.GCP.Network != "*vpc" {
+		t.Errorf("string overrides parsed: api_key = %q, network = %q", config.APIKey, config.CloudProviders.GCP.Network)
+	}
+}
+
+func Test_getEnvName(t *testing.T) {
+	keys := map[string]bool{}
+	for _, key := range getConfigKeys(reflect.TypeOf(BouncerConfig{}), nil) {
+		keys[getEnvName(key.path)] = true
+	}
+	for _, name := range []string{"CS_CFB_API_URL", "CS_CFB_CLOUD_PROVIDERS_GCP_NETWORK", "CS_CFB_CLOUD_PROVIDERS_AWS_PRIORITY_RANGE_MIN", "CS_CFB_DECISION_EXPANSION_DATABASES"} {
+		if !keys[name] {
+			t.Errorf("%s is not an override of the configuration keys", name)
+		}
+	}
+}
+
+func Test_loadAPIKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "api_key")
+	writeConfigFile(t, keyPath, "secret-key\n")
+
+	config := &BouncerConfig{APIKeyFile: keyPath}
+	v := &validator{}
+	loadAPIKeyFile(v, config)
+	if v.err() != nil || config.APIKey != "secret-key" {
+		t.Errorf("loadAPIKeyFile() api key = %q, error = %v", config.APIKey, v.err())
+	}
+
+	for _, config := range []*BouncerConfig{
+		{APIKeyFile: keyPath, APIKey: "key"},
+		{APIKeyFile: filepath.Join(dir, "missing")},
+	} {
+		v := &validator{}
+		loadAPIKeyFile(v, config)
+		if v.err() == nil {
+			t.Errorf("loadAPIKeyFile() of %+v did not fail", config)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// FieldError is an invalid setting of the configuration.
+type FieldError struct {
+	// Field is the path of the setting, such as cloud_providers.gcp.protocols.0.ports.
+	Field string
+	// Line is the line of the setting in the configuration, or of its closest parent when the setting is missing.
+	// It is 0 when unknown.
+	Line    int
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ValidationErrors contains all the errors found in the configuration.
+type ValidationErrors []*FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// validator collects the errors of the configuration so that they are all reported at once.
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) errorf(field string, format string, args ...interface{}) {
+	v.errs = append(v.errs, &FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+var typeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// addTypeErrors adds the errors of the YAML decoding, such as unknown fields or invalid values, which already have
+// their line.
+func (v *validator) addTypeErrors(err *yaml.TypeError) {
+	for _, message := range err.Errors {
+		fieldErr := &FieldError{Message: message}
+		if match := typeErrorLine.FindStringSubmatch(message); match != nil {
+			fieldErr.Line, _ = strconv.Atoi(match[1])
+			fieldErr.Message = match[2]
+		}
+		v.errs = append(v.errs, fieldErr)
+	}
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// locate sets the line of the errors found by the checks, from their field in the configuration.
+func (v *validator) locate(configBuff []byte) {
+	root := &yamlv3.Node{}
+	if err := yamlv3.Unmarshal(configBuff, root); err != nil || len(root.Content) == 0 {
+		return
+	}
+	for _, err := range v.errs {
+		if err.Field != "" && err.Line == 0 {
+			err.Line = getFieldLine(root.Content[0], err.Field)
+		}
+	}
+}
+
+// getFieldLine returns the line of the field, or of its closest parent found when the field is missing.
+func getFieldLine(node *yamlv3.Node, field string) int {
+	line := 0
+	for _, key := range strings.Split(field, ".") {
+		var next *yamlv3.Node
+		switch node.Kind {
+		case yamlv3.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yamlv3.SequenceNode:
+			if index, err := strconv.Atoi(key); err == nil && index >= 0 && index < len(node.Content) {
+				next = node.Content[index]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+	}
+	return line
+}
@@ -0,0 +1,201 @@
+package expansion
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	csmodels "github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxPrefixes = 100
+	rangeScope         = "Range"
+	// refreshInterval is the time between two checks of the databases for changes.
+	refreshInterval = time.Minute
+)
+
+// Index maps country codes and AS numbers to the networks they contain.
+type Index struct {
+	Countries map[string][]netip.Prefix
+	AS        map[string][]netip.Prefix
+}
+
+// Expander expands Country and AS scoped decisions into IP range decisions using MMDB databases.
+// The databases are reloaded when their modification time changes, which is checked at most once per refresh interval.
+type Expander struct {
+	databases   []string
+	maxPrefixes int
+	modTimes    map[string]time.Time
+	checkedAt   time.Time
+	index       *Index
+	mutex       sync.Mutex
+}
+
+// NewExpander creates a new expander and loads its databases.
+func NewExpander(config *models.ExpansionConfig) (*Expander, error) {
+	if len(config.Databases) == 0 {
+		return nil, fmt.Errorf("at least one database must be specified")
+	}
+	if config.MaxPrefixes == 0 {
+		config.MaxPrefixes = defaultMaxPrefixes
+	}
+	e := &Expander{
+		databases:   config.Databases,
+		maxPrefixes: config.MaxPrefixes,
+	}
+	modTimes, err := e.getModTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.load(modTimes); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Expander) getModTimes() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, database := range e.databases {
+		info, err := os.Stat(database)
+		if err != nil {
+			return nil, fmt.Errorf("unable to stat database %s: %s", database, err)
+		}
+		modTimes[database] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (e *Expander) load(modTimes map[string]time.Time) error {
+	index := &Index{
+		Countries: make(map[string][]netip.Prefix),
+		AS:        make(map[string][]netip.Prefix),
+	}
+	for _, database := range e.databases {
+		if err := loadDatabase(database, index); err != nil {
+			return err
+		}
+	}
+	e.index = index
+	e.modTimes = modTimes
+	e.checkedAt = time.Now()
+	log.Infof("loaded %d countries and %d AS from %d database(s)", len(index.Countries), len(index.AS), len(e.databases))
+	return nil
+}
+
+// refresh reloads the databases if any of them changed since the last check, which is done at most once per refresh
+// interval. The current index is kept if the reload fails.
+func (e *Expander) refresh() {
+	if time.Since(e.checkedAt) < refreshInterval {
+		return
+	}
+	e.checkedAt = time.Now()
+	modTimes, err := e.getModTimes()
+	if err != nil {
+		log.Errorf("unable to check databases for changes: %s", err)
+		return
+	}
+	changed := false
+	for database, modTime := range modTimes {
+		if !modTime.Equal(e.modTimes[database]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	log.Infof("databases changed, reloading")
+	if err := e.load(modTimes); err != nil {
+		log.Errorf("unable to reload databases, keeping the previous ones: %s", err)
+	}
+}
+
+// Expand returns the IP range decisions corresponding to a Country or AS scoped decision.
+// Decisions with another scope, unknown values or expanding into more than the maximum number of prefixes are dropped.
+func (e *Expander) Expand(decision *csmodels.Decision) []*csmodels.Decision {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.refresh()
+
+	scope := models.GetScope(decision.Scope)
+	source := models.GetSource(scope, *decision.Value)
+	var prefixes []netip.Prefix
+	switch scope {
+	case models.CountryScope:
+		prefixes = e.index.Countries[source]
+	case models.ASScope:
+		prefixes = e.index.AS[source]
+	default:
+		log.Warningf("ignoring decision %s: scope %s can't be expanded", *decision.Value, scope)
+		return nil
+	}
+	if len(prefixes) == 0 {
+		log.Warningf("ignoring decision %s: no network found for %s %s", *decision.Value, scope, source)
+		return nil
+	}
+	if len(prefixes) > e.maxPrefixes {
+		log.Warningf("ignoring decision %s: %s %s expands to %d prefixes, more than the maximum of %d", *decision.Value, scope, source, len(prefixes), e.maxPrefixes)
+		return nil
+	}
+	log.Debugf("expanding decision %s to %d prefixes", *decision.Value, len(prefixes))
+	decisions := []*csmodels.Decision{}
+	for _, prefix := range prefixes {
+		expanded := *decision
+		value := prefix.String()
+		scope := rangeScope
+		expanded.Value = &value
+		expanded.Scope = &scope
+		decisions = append(decisions, &expanded)
+	}
+	return decisions
+}
+
+// Aggregate returns the smallest list of prefixes covering exactly the same addresses,
+// removing the prefixes contained in others and merging adjacent prefixes.
+func Aggregate(prefixes []netip.Prefix) []netip.Prefix {
+	sorted := make([]netip.Prefix, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		sorted = append(sorted, prefix.Masked())
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if c := sorted[i].Addr().Compare(sorted[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return sorted[i].Bits() < sorted[j].Bits()
+	})
+	aggregated := []netip.Prefix{}
+	for _, prefix := range sorted {
+		if len(aggregated) > 0 && aggregated[len(aggregated)-1].Overlaps(prefix) {
+			continue
+		}
+		aggregated = append(aggregated, prefix)
+		for len(aggregated) > 1 {
+			last := aggregated[len(aggregated)-1]
+			previous := aggregated[len(aggregated)-2]
+			parent, ok := getParent(previous, last)
+			if !ok {
+				break
+			}
+			aggregated = append(aggregated[:len(aggregated)-2], parent)
+		}
+	}
+	return aggregated
+}
+
+// getParent returns the prefix made of the two prefixes if they are the two halves of the same prefix.
+func getParent(a netip.Prefix, b netip.Prefix) (netip.Prefix, bool) {
+	if a.Bits() != b.Bits() || a.Bits() == 0 || a.Addr().Is4() != b.Addr().Is4() || a == b {
+		return netip.Prefix{}, false
+	}
+	parentA := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked()
+	parentB := netip.PrefixFrom(b.Addr(), b.Bits()-1).Masked()
+	if parentA != parentB {
+		return netip.Prefix{}, false
+	}
+	return parentA, true
+}
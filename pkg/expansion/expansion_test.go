@@ -0,0 +1,105 @@
+package expansion
+
+import (
+	"net/netip"
+	"testing"
+
+	csmodels "github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func parsePrefixes(prefixes ...string) []netip.Prefix {
+	parsed := []netip.Prefix{}
+	for _, prefix := range prefixes {
+		parsed = append(parsed, netip.MustParsePrefix(prefix))
+	}
+	return parsed
+}
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []netip.Prefix
+		want     []netip.Prefix
+	}{
+		{"empty", parsePrefixes(), parsePrefixes()},
+		{"single", parsePrefixes("1.0.0.0/24"), parsePrefixes("1.0.0.0/24")},
+		{"not_masked", parsePrefixes("1.0.0.1/24"), parsePrefixes("1.0.0.0/24")},
+		{"duplicates", parsePrefixes("1.0.0.0/24", "1.0.0.0/24"), parsePrefixes("1.0.0.0/24")},
+		{"contained", parsePrefixes("1.0.1.0/24", "1.0.0.0/16", "1.0.2.3/32"), parsePrefixes("1.0.0.0/16")},
+		{"siblings", parsePrefixes("1.0.1.0/24", "1.0.0.0/24"), parsePrefixes("1.0.0.0/23")},
+		{"cascading_siblings", parsePrefixes("1.0.0.0/24", "1.0.1.0/24", "1.0.2.0/23"), parsePrefixes("1.0.0.0/22")},
+		{"not_siblings", parsePrefixes("1.0.1.0/24", "1.0.2.0/24"), parsePrefixes("1.0.1.0/24", "1.0.2.0/24")},
+		{"ipv6", parsePrefixes("2001:db8::/33", "2001:db8:8000::/33", "1.0.0.0/24"), parsePrefixes("1.0.0.0/24", "2001:db8::/32")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Aggregate(tt.prefixes))
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	e := &Expander{
+		maxPrefixes: 2,
+		index: &Index{
+			Countries: map[string][]netip.Prefix{
+				"FR": parsePrefixes("1.0.0.0/24", "2001:db8::/32"),
+				"CA": parsePrefixes("2.0.0.0/24", "3.0.0.0/24", "4.0.0.0/24"),
+			},
+			AS: map[string][]netip.Prefix{
+				"1234": parsePrefixes("5.0.0.0/16"),
+			},
+		},
+	}
+	ban := "ban"
+	country := "Country"
+	as := "AS"
+	ip := "Ip"
+	tests := []struct {
+		name  string
+		scope string
+		value string
+		want  []string
+	}{
+		{"country", country, "fr", []string{"1.0.0.0/24", "2001:db8::/32"}},
+		{"as", as, "AS1234", []string{"5.0.0.0/16"}},
+		{"too_many_prefixes", country, "CA", []string{}},
+		{"unknown_country", country, "US", []string{}},
+		{"unsupported_scope", ip, "1.2.3.4", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scope := tt.scope
+			value := tt.value
+			decisions := e.Expand(&csmodels.Decision{Scope: &scope, Value: &value, Type: &ban})
+			got := []string{}
+			for _, decision := range decisions {
+				assert.Equal(t, "Range", *decision.Scope)
+				assert.Equal(t, ban, *decision.Type)
+				got = append(got, *decision.Value)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGetCountryAndAS(t *testing.T) {
+	tests := []struct {
+		name        string
+		record      map[string]interface{}
+		wantCountry string
+		wantAS      string
+	}{
+		{"maxmind_country", map[string]interface{}{"country": map[string]interface{}{"iso_code": "FR"}}, "FR", ""},
+		{"maxmind_asn", map[string]interface{}{"autonomous_system_number": uint64(1234)}, "", "1234"},
+		{"ipinfo_country_asn", map[string]interface{}{"country": "fr", "asn": "AS1234"}, "FR", "1234"},
+		{"empty", map[string]interface{}{}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantCountry, getCountry(tt.record))
+			assert.Equal(t, tt.wantAS, getAS(tt.record))
+		})
+	}
+}
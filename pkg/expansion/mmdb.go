@@ -0,0 +1,83 @@
+package expansion
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// loadDatabase adds the networks of the MMDB database to the index. Both the MaxMind
+// (country.iso_code, autonomous_system_number) and the IPinfo (country, asn) formats are supported.
+func loadDatabase(path string, index *Index) error {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open database %s: %s", path, err)
+	}
+	defer reader.Close()
+
+	countries := make(map[string][]netip.Prefix)
+	as := make(map[string][]netip.Prefix)
+	networks := reader.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		var record map[string]interface{}
+		network, err := networks.Network(&record)
+		if err != nil {
+			return fmt.Errorf("unable to read database %s: %s", path, err)
+		}
+		prefix, ok := getPrefix(network)
+		if !ok {
+			continue
+		}
+		if country := getCountry(record); country != "" {
+			countries[country] = append(countries[country], prefix)
+		}
+		if number := getAS(record); number != "" {
+			as[number] = append(as[number], prefix)
+		}
+	}
+	if err := networks.Err(); err != nil {
+		return fmt.Errorf("unable to read database %s: %s", path, err)
+	}
+	for country, prefixes := range countries {
+		index.Countries[country] = Aggregate(append(index.Countries[country], prefixes...))
+	}
+	for number, prefixes := range as {
+		index.AS[number] = Aggregate(append(index.AS[number], prefixes...))
+	}
+	return nil
+}
+
+func getPrefix(network *net.IPNet) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(network.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	bits, _ := network.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), bits), true
+}
+
+func getCountry(record map[string]interface{}) string {
+	switch country := record["country"].(type) {
+	case string:
+		return strings.ToUpper(country)
+	case map[string]interface{}:
+		if code, ok := country["iso_code"].(string); ok {
+			return strings.ToUpper(code)
+		}
+	}
+	return ""
+}
+
+func getAS(record map[string]interface{}) string {
+	if number, ok := record["autonomous_system_number"].(uint64); ok {
+		return strconv.FormatUint(number, 10)
+	}
+	if asn, ok := record["asn"].(string); ok {
+		return strings.TrimPrefix(strings.ToUpper(asn), "AS")
+	}
+	return ""
+}
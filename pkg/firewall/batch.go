@@ -0,0 +1,102 @@
+package firewall
+
+import (
+	"time"
+
+	csmodels "github.com/crowdsecurity/crowdsec/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+func (f *Bouncer) getNow() time.Time {
+	if f.now == nil {
+		return time.Now()
+	}
+	return f.now()
+}
+
+// getBatchSize returns the number of batched decisions.
+func (f *Bouncer) getBatchSize() int {
+	if f.batch == nil {
+		return 0
+	}
+	return len(f.batch.New) + len(f.batch.Deleted)
+}
+
+// hasImmediateDecisions returns true if a new decision must be applied without waiting for the end of the flush window.
+func (f *Bouncer) hasImmediateDecisions(decisions *csmodels.DecisionsStreamResponse) bool {
+	for _, decision := range decisions.New {
+		if matchesFilter(decision, f.Immediate) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldFlush returns true if the batched and pending decisions must be applied now.
+func (f *Bouncer) shouldFlush(decisions *csmodels.DecisionsStreamResponse, now time.Time) bool {
+	switch {
+	case f.FlushWindow == 0:
+		return true
+	case !now.Before(f.batchStart.Add(f.FlushWindow)):
+		log.Debugf("flushing %d decision(s) to %s, the flush window is elapsed", f.getBatchSize(), f.Client.GetProviderName())
+		return true
+	case f.MaxBatchSize > 0 && f.getBatchSize() >= f.MaxBatchSize:
+		log.Debugf("flushing %d decision(s) to %s, the batch is full", f.getBatchSize(), f.Client.GetProviderName())
+		return true
+	case f.hasImmediateDecisions(decisions):
+		log.Debugf("flushing %d decision(s) to %s, some of them are applied immediately", f.getBatchSize(), f.Client.GetProviderName())
+		return true
+	}
+	return false
+}
+
+// Submit adds the decisions to the batch, and applies the batch once the flush window is elapsed, the batch is full or
+// an immediate decision is submitted. A decision cancels the batched decision of the same source, so that a source
+// added then deleted during the flush window is only deleted. Submit must be called regularly, even without decisions,
+// so that the batch is applied at the end of the flush window.
+func (f *Bouncer) Submit(decisions *csmodels.DecisionsStreamResponse) error {
+	now := f.getNow()
+	if len(decisions.New) > 0 || len(decisions.Deleted) > 0 {
+		if f.batch == nil && f.pending == nil {
+			f.batchStart = now
+		}
+		f.batch = mergeDecisions(f.batch, decisions)
+	}
+	if f.batch == nil && f.pending == nil {
+		return nil
+	}
+	if !f.shouldFlush(decisions, now) {
+		return nil
+	}
+	err := f.FlushBatch()
+	if err != nil {
+		// the pending decisions are applied again at the end of the next flush window
+		f.batchStart = now
+	}
+	return err
+}
+
+// FlushBatch applies the batched decisions, along with the pending decisions of a failed update.
+func (f *Bouncer) FlushBatch() error {
+	batch := f.batch
+	f.batch = nil
+	if batch == nil {
+		if f.pending == nil {
+			return nil
+		}
+		batch = &csmodels.DecisionsStreamResponse{}
+	}
+	return f.Update(batch)
+}
+
+// KeepBatch takes over the batched and pending decisions of the previous bouncer of the provider, so that they are not
+// lost when its configuration is reloaded. They are applied at the end of the flush window they started, with the
+// settings of this bouncer.
+func (f *Bouncer) KeepBatch(previous *Bouncer) {
+	if previous == nil {
+		return
+	}
+	f.batch = previous.batch
+	f.pending = previous.pending
+	f.batchStart = previous.batchStart
+}
@@ -0,0 +1,128 @@
+package firewall
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	csmodels "github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	testingUtils "github.com/fallard84/cs-cloud-firewall-bouncer/pkg/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBouncer_SubmitWithoutWindow(t *testing.T) {
+	client, _ := testingUtils.NewClientRuleSets()
+	f := &Bouncer{Client: client, RuleNamePrefix: "test-rule"}
+
+	// no update without decisions
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{}))
+	assert.Empty(t, client.Patched)
+
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{
+		newRoutedDecision("0.0.0.1", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h"),
+	}}))
+	assert.Equal(t, 1, len(client.Patched))
+}
+
+func TestBouncer_Submit(t *testing.T) {
+	client, _ := testingUtils.NewClientRuleSets()
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := &Bouncer{
+		Client:         client,
+		RuleNamePrefix: "test-rule",
+		FlushWindow:    time.Minute,
+		MaxBatchSize:   3,
+		Immediate:      models.DecisionFilter{Origins: []string{"cscli"}},
+		now:            func() time.Time { return now },
+	}
+	added := newRoutedDecision("0.0.0.1", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h")
+	cancelled := newRoutedDecision("0.0.0.2", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h")
+
+	// the decisions are batched until the end of the flush window
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{added, cancelled}}))
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{Deleted: csmodels.GetDecisionsResponse{cancelled}}))
+	assert.Empty(t, client.Patched)
+
+	// the source added then deleted during the window is not added
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{}))
+	assert.Equal(t, 1, len(client.Patched))
+	assert.Equal(t, map[string]bool{"1.0.0.0/32": true, "0.0.0.1/32": true}, client.Patched[0].SourceRanges)
+
+	// an immediate decision is applied along with the batched decisions
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{
+		newRoutedDecision("0.0.0.3", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h"),
+	}}))
+	assert.Equal(t, 1, len(client.Patched))
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{
+		newRoutedDecision("0.0.0.4", "Ip", "manual 'ban' from 'localhost'", "cscli", "4h"),
+	}}))
+	assert.Equal(t, 2, len(client.Patched))
+	assert.Equal(t, map[string]bool{"1.0.0.0/32": true, "0.0.0.3/32": true, "0.0.0.4/32": true}, client.Patched[1].SourceRanges)
+
+	// a full batch is applied without waiting for the end of the window
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{
+		newRoutedDecision("0.0.0.5", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h"),
+		newRoutedDecision("0.0.0.6", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h"),
+		newRoutedDecision("0.0.0.7", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h"),
+	}}))
+	assert.Equal(t, 3, len(client.Patched))
+}
+
+func TestBouncer_SubmitRetry(t *testing.T) {
+	ruleSetsClient, _ := testingUtils.NewClientRuleSets()
+	client := &fakeClientFailingPatch{ruleSetsClient, fmt.Errorf("quota exceeded")}
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := &Bouncer{Client: client, RuleNamePrefix: "test-rule", FlushWindow: time.Minute, now: func() time.Time { return now }}
+
+	decision := newRoutedDecision("0.0.0.1", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h")
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{decision}}))
+	now = now.Add(time.Minute)
+	assert.Error(t, f.Submit(&csmodels.DecisionsStreamResponse{}))
+	assert.True(t, f.HasPendingDecisions())
+
+	// the failed update is applied again at the end of the next window
+	client.err = nil
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{}))
+	assert.Empty(t, ruleSetsClient.Patched)
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{}))
+	assert.Equal(t, 1, len(ruleSetsClient.Patched))
+	assert.False(t, f.HasPendingDecisions())
+}
+
+func TestBouncer_ShutDownFlushesBatch(t *testing.T) {
+	client, _ := testingUtils.NewClientRuleSets()
+	f := &Bouncer{Client: client, RuleNamePrefix: "test-rule", FlushWindow: time.Minute}
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{
+		newRoutedDecision("0.0.0.1", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h"),
+	}}))
+	assert.Empty(t, client.Patched)
+	assert.NoError(t, f.ShutDown())
+	assert.Equal(t, 1, len(client.Patched))
+}
+
+func TestBouncer_KeepBatch(t *testing.T) {
+	previousClient, _ := testingUtils.NewClientRuleSets()
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	previous := &Bouncer{Client: previousClient, RuleNamePrefix: "test-rule", FlushWindow: time.Minute, now: func() time.Time { return now }}
+	assert.NoError(t, previous.Submit(&csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{
+		newRoutedDecision("0.0.0.1", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h"),
+	}}))
+
+	// the batch is applied by the new bouncer at the end of the flush window started by the previous one
+	client, _ := testingUtils.NewClientRuleSets()
+	f := &Bouncer{Client: client, RuleNamePrefix: "test-rule", FlushWindow: time.Minute, now: func() time.Time { return now }}
+	f.KeepBatch(previous)
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{}))
+	assert.Empty(t, client.Patched)
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, f.Submit(&csmodels.DecisionsStreamResponse{}))
+	assert.Equal(t, 1, len(client.Patched))
+	assert.Equal(t, map[string]bool{"1.0.0.0/32": true, "0.0.0.1/32": true}, client.Patched[0].SourceRanges)
+	assert.Empty(t, previousClient.Patched)
+}
@@ -0,0 +1,53 @@
+package firewall
+
+import (
+	"fmt"
+	"sort"
+
+	csmodels "github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+)
+
+// DecisionCache keeps the active decisions received from the LAPI stream, so that they can be applied to the bouncers
+// created while the stream is running without replaying the stream.
+type DecisionCache struct {
+	decisions map[string]*csmodels.Decision
+}
+
+func NewDecisionCache() *DecisionCache {
+	return &DecisionCache{decisions: make(map[string]*csmodels.Decision)}
+}
+
+// getDecisionKey returns the key of a decision, which is the same for the decisions of the same type on the same source.
+func getDecisionKey(decision *csmodels.Decision) string {
+	decisionType := models.Ban
+	if decision.Type != nil {
+		decisionType = *decision.Type
+	}
+	scope := models.GetScope(decision.Scope)
+	return fmt.Sprintf("%s/%s/%s", decisionType, scope, models.GetSource(scope, *decision.Value))
+}
+
+// Update adds the new decisions of the stream to the cache and removes the deleted ones.
+func (c *DecisionCache) Update(decisionStream *csmodels.DecisionsStreamResponse) {
+	for _, decision := range decisionStream.Deleted {
+		delete(c.decisions, getDecisionKey(decision))
+	}
+	for _, decision := range decisionStream.New {
+		c.decisions[getDecisionKey(decision)] = decision
+	}
+}
+
+// Decisions returns the active decisions as new decisions, sorted by key.
+func (c *DecisionCache) Decisions() *csmodels.DecisionsStreamResponse {
+	keys := []string{}
+	for key := range c.decisions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	stream := &csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{}}
+	for _, key := range keys {
+		stream.New = append(stream.New, c.decisions[key])
+	}
+	return stream
+}
@@ -0,0 +1,44 @@
+package firewall
+
+import (
+	"testing"
+
+	csmodels "github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecisionCache(t *testing.T) {
+	ban := models.Ban
+	captcha := models.Captcha
+	country := "Country"
+	source1 := "1.0.0.1"
+	source2 := "1.0.0.2/32"
+	source3 := "fr"
+	cache := NewDecisionCache()
+	cache.Update(&csmodels.DecisionsStreamResponse{
+		New: csmodels.GetDecisionsResponse{
+			&csmodels.Decision{Value: &source1, Type: &ban},
+			&csmodels.Decision{Value: &source1, Type: &captcha},
+			&csmodels.Decision{Value: &source2},
+			&csmodels.Decision{Value: &source3, Scope: &country, Type: &ban},
+		},
+	})
+	assert.Equal(t, 4, len(cache.Decisions().New))
+
+	// a deleted decision only removes the decision of its type, and the same source written differently is the same decision
+	cache.Update(&csmodels.DecisionsStreamResponse{
+		Deleted: csmodels.GetDecisionsResponse{
+			&csmodels.Decision{Value: &source1, Type: &captcha},
+			&csmodels.Decision{Value: &source2, Type: &ban},
+		},
+		New: csmodels.GetDecisionsResponse{
+			&csmodels.Decision{Value: &source3, Scope: &country, Type: &ban},
+		},
+	})
+	decisions := cache.Decisions().New
+	assert.Equal(t, 2, len(decisions))
+	assert.Equal(t, source1, *decisions[0].Value)
+	assert.Equal(t, ban, *decisions[0].Type)
+	assert.Equal(t, source3, *decisions[1].Value)
+}
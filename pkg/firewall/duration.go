@@ -0,0 +1,161 @@
+package firewall
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	csmodels "github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// decisionTimer is a decision removed by the bouncer at a given time.
+type decisionTimer struct {
+	decision *csmodels.Decision
+	at       time.Time
+}
+
+// DurationPolicy applies the duration bounds to the decisions of the stream. It ignores the decisions shorter than the
+// minimum duration, removes the decisions longer than the maximum duration once it is elapsed, and delays the removal
+// of the decisions by the hold-down time. Its timers are checked each time it is applied to the stream.
+type DurationPolicy struct {
+	minDuration time.Duration
+	maxDuration time.Duration
+	holdDown    time.Duration
+	// expiries contains the decisions longer than the maximum duration, removed by the bouncer when they expire.
+	expiries map[string]*decisionTimer
+	// held contains the deleted decisions whose removal is delayed by the hold-down time.
+	held map[string]*decisionTimer
+	now  func() time.Time
+}
+
+// parsePolicyDuration returns the duration of the policy setting, which is 0 when empty.
+func parsePolicyDuration(name string, duration string) (time.Duration, error) {
+	if duration == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %s: %s", name, duration, err)
+	}
+	return d, nil
+}
+
+// NewDurationPolicy returns the policy of the configuration, or an error if a duration is invalid.
+func NewDurationPolicy(config models.DurationPolicy) (*DurationPolicy, error) {
+	p := &DurationPolicy{
+		expiries: make(map[string]*decisionTimer),
+		held:     make(map[string]*decisionTimer),
+		now:      time.Now,
+	}
+	var err error
+	if p.minDuration, err = parsePolicyDuration("min_duration", config.MinDuration); err != nil {
+		return nil, err
+	}
+	if p.maxDuration, err = parsePolicyDuration("max_duration", config.MaxDuration); err != nil {
+		return nil, err
+	}
+	if p.holdDown, err = parsePolicyDuration("hold_down", config.HoldDown); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// KeepTimers takes over the pending expiries and removals of the previous policy, so that they are not lost when the
+// configuration is reloaded. They keep their time.
+func (p *DurationPolicy) KeepTimers(previous *DurationPolicy) {
+	if previous == nil {
+		return
+	}
+	p.expiries = previous.expiries
+	p.held = previous.held
+}
+
+// getDecisionDuration returns the remaining duration of the decision. It returns false if the decision has no valid
+// duration.
+func getDecisionDuration(decision *csmodels.Decision) (time.Duration, bool) {
+	if decision.Duration == nil {
+		return 0, false
+	}
+	duration, err := time.ParseDuration(*decision.Duration)
+	if err != nil {
+		return 0, false
+	}
+	return duration, true
+}
+
+// getExpiredDecisions returns the decisions of the timers elapsed at the time, sorted by key, and removes their timers.
+func getExpiredDecisions(timers map[string]*decisionTimer, now time.Time) []*csmodels.Decision {
+	keys := []string{}
+	for key, timer := range timers {
+		if !timer.at.After(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	expired := []*csmodels.Decision{}
+	for _, key := range keys {
+		expired = append(expired, timers[key].decision)
+		delete(timers, key)
+	}
+	return expired
+}
+
+// Apply returns the decisions of the stream to enforce. The deleted decisions include the decisions removed by the
+// bouncer whose time has come.
+func (p *DurationPolicy) Apply(decisions *csmodels.DecisionsStreamResponse) *csmodels.DecisionsStreamResponse {
+	now := p.now()
+	applied := &csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{}, Deleted: csmodels.GetDecisionsResponse{}}
+	for _, decision := range decisions.Deleted {
+		key := getDecisionKey(decision)
+		delete(p.expiries, key)
+		if p.holdDown > 0 {
+			log.Debugf("holding down the removal of %s until %s", *decision.Value, now.Add(p.holdDown).Format(time.RFC3339))
+			p.held[key] = &decisionTimer{decision: decision, at: now.Add(p.holdDown)}
+			continue
+		}
+		applied.Deleted = append(applied.Deleted, decision)
+	}
+	for _, decision := range decisions.New {
+		key := getDecisionKey(decision)
+		duration, ok := getDecisionDuration(decision)
+		if ok && duration < p.minDuration {
+			log.Debugf("ignoring decision %s: duration %s is shorter than %s", *decision.Value, duration, p.minDuration)
+			continue
+		}
+		if _, held := p.held[key]; held {
+			log.Debugf("decision %s banned again during its hold-down time", *decision.Value)
+			delete(p.held, key)
+		}
+		if ok && p.maxDuration > 0 && duration > p.maxDuration {
+			log.Debugf("decision %s of %s is limited to %s", *decision.Value, duration, p.maxDuration)
+			p.expiries[key] = &decisionTimer{decision: decision, at: now.Add(p.maxDuration)}
+		} else {
+			delete(p.expiries, key)
+		}
+		applied.New = append(applied.New, decision)
+	}
+	for _, decision := range getExpiredDecisions(p.expiries, now) {
+		log.Infof("removing decision %s, the maximum duration of %s is elapsed", *decision.Value, p.maxDuration)
+		applied.Deleted = append(applied.Deleted, decision)
+	}
+	applied.Deleted = append(applied.Deleted, getExpiredDecisions(p.held, now)...)
+	return applied
+}
+
+// ReleaseHeld returns the decisions whose removal is held down as deleted decisions, and removes their timers. It is
+// used when the bouncer stops, so that the sources are not left blocked because their removal was still held down.
+func (p *DurationPolicy) ReleaseHeld() *csmodels.DecisionsStreamResponse {
+	released := &csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{}, Deleted: csmodels.GetDecisionsResponse{}}
+	keys := []string{}
+	for key := range p.held {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		released.Deleted = append(released.Deleted, p.held[key].decision)
+		delete(p.held, key)
+	}
+	return released
+}
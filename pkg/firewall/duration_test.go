@@ -0,0 +1,85 @@
+package firewall
+
+import (
+	"testing"
+	"time"
+
+	csmodels "github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDurationPolicy(t *testing.T) {
+	_, err := NewDurationPolicy(models.DurationPolicy{MinDuration: "1m", MaxDuration: "168h", HoldDown: "5m"})
+	assert.NoError(t, err)
+	_, err = NewDurationPolicy(models.DurationPolicy{MaxDuration: "7d"})
+	assert.Error(t, err)
+}
+
+func TestDurationPolicy_Apply(t *testing.T) {
+	policy, err := NewDurationPolicy(models.DurationPolicy{MinDuration: "1m", MaxDuration: "24h", HoldDown: "5m"})
+	assert.NoError(t, err)
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	policy.now = func() time.Time { return now }
+
+	short := newRoutedDecision("1.0.0.1", "Ip", "crowdsecurity/http-probing", "crowdsec", "30s")
+	normal := newRoutedDecision("1.0.0.2", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h")
+	long := newRoutedDecision("1.0.0.3", "Ip", "crowdsecurity/port-scan", "CAPI", "168h")
+	noDuration := newRoutedDecision("1.0.0.4", "Ip", "crowdsecurity/ssh-bf", "cscli", "")
+	noDuration.Duration = nil
+
+	// short decisions are ignored
+	applied := policy.Apply(&csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{short, normal, long, noDuration}})
+	assert.Equal(t, csmodels.GetDecisionsResponse{normal, long, noDuration}, applied.New)
+	assert.Empty(t, applied.Deleted)
+
+	// deleted decisions are held down
+	now = now.Add(time.Hour)
+	applied = policy.Apply(&csmodels.DecisionsStreamResponse{Deleted: csmodels.GetDecisionsResponse{normal, noDuration}})
+	assert.Empty(t, applied.New)
+	assert.Empty(t, applied.Deleted)
+
+	// a decision banned again during its hold-down time is not removed
+	now = now.Add(time.Minute)
+	applied = policy.Apply(&csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{normal}})
+	assert.Equal(t, csmodels.GetDecisionsResponse{normal}, applied.New)
+	assert.Empty(t, applied.Deleted)
+
+	// the other one is removed once its hold-down time is elapsed
+	now = now.Add(5 * time.Minute)
+	applied = policy.Apply(&csmodels.DecisionsStreamResponse{})
+	assert.Equal(t, csmodels.GetDecisionsResponse{noDuration}, applied.Deleted)
+
+	// long decisions are removed by the bouncer after the maximum duration
+	now = now.Add(23 * time.Hour)
+	applied = policy.Apply(&csmodels.DecisionsStreamResponse{})
+	assert.Equal(t, csmodels.GetDecisionsResponse{long}, applied.Deleted)
+	applied = policy.Apply(&csmodels.DecisionsStreamResponse{})
+	assert.Empty(t, applied.Deleted)
+}
+
+func TestDurationPolicy_KeepTimers(t *testing.T) {
+	previous, _ := NewDurationPolicy(models.DurationPolicy{MaxDuration: "1h"})
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	previous.now = func() time.Time { return now }
+	long := newRoutedDecision("1.0.0.3", "Ip", "crowdsecurity/port-scan", "CAPI", "4h")
+	previous.Apply(&csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{long}})
+
+	policy, _ := NewDurationPolicy(models.DurationPolicy{MaxDuration: "2h"})
+	policy.now = func() time.Time { return now.Add(time.Hour) }
+	policy.KeepTimers(previous)
+	applied := policy.Apply(&csmodels.DecisionsStreamResponse{})
+	assert.Equal(t, csmodels.GetDecisionsResponse{long}, applied.Deleted)
+}
+
+func TestDurationPolicy_ReleaseHeld(t *testing.T) {
+	policy, _ := NewDurationPolicy(models.DurationPolicy{HoldDown: "10m"})
+	first := newRoutedDecision("1.0.0.1", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h")
+	second := newRoutedDecision("1.0.0.2", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h")
+	policy.Apply(&csmodels.DecisionsStreamResponse{Deleted: csmodels.GetDecisionsResponse{second, first}})
+
+	released := policy.ReleaseHeld()
+	assert.Empty(t, released.New)
+	assert.Equal(t, csmodels.GetDecisionsResponse{first, second}, released.Deleted)
+	assert.Empty(t, policy.ReleaseHeld().Deleted)
+}
@@ -2,26 +2,77 @@ package firewall
 
 import (
 	"fmt"
+	"path"
+	"sort"
 	"strings"
+	"time"
 
 	csmodels "github.com/crowdsecurity/crowdsec/pkg/models"
 	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
 	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/providers"
-	"github.com/sethvargo/go-diceware/diceware"
 	log "github.com/sirupsen/logrus"
 )
 
 type Bouncer struct {
 	Client         providers.CloudClient
 	RuleNamePrefix string
+	// Expander optionally expands the decisions whose scope is not supported by the client into IP range decisions.
+	Expander DecisionExpander
+	// EgressOnly matches the decisions that are only enforced by the egress rule sets.
+	EgressOnly models.DecisionFilter
+	// CleanupOnShutdown deletes all the rules owned by the bouncer when it is shut down.
+	CleanupOnShutdown bool
+	// Tiers are the decision tiers, from the most trusted to the least trusted. Rule sets are not split by tiers when
+	// empty.
+	Tiers []models.DecisionTier
+	// FlushWindow is the longest time the submitted decisions are batched before being applied. They are applied with
+	// each submission when 0.
+	FlushWindow time.Duration
+	// MaxBatchSize is the number of batched decisions applied without waiting for the end of the flush window.
+	// The batch size is not limited when 0.
+	MaxBatchSize int
+	// Immediate matches the decisions applied as soon as they are submitted, along with the batched decisions.
+	Immediate models.DecisionFilter
+	// batch contains the submitted decisions not applied yet.
+	batch *csmodels.DecisionsStreamResponse
+	// batchStart is the time since which the batched or pending decisions wait to be applied.
+	batchStart time.Time
+	now        func() time.Time
+	// pending contains the decisions of the last failed update. They are applied again with the next decisions.
+	pending *csmodels.DecisionsStreamResponse
+	// ruleNames contains the names of the existing rules, including the ones owned by other bouncers, and of the rules
+	// created during the update, so that new rule names never collide with them.
+	ruleNames map[string]bool
+	// priorities contains the priorities of the existing rules, including the ones not owned by the bouncer, and of
+	// the rules created during the update, so that new rules never collide with them.
+	priorities map[int64]bool
+	// reportedRules contains the foreign rules already reported inside the priority range of a rule set.
+	reportedRules map[string]bool
+	// ruleSetRules contains the rules of each rule set during the update, so that the tiers of a rule set share its
+	// capacity.
+	ruleSetRules map[models.RuleSet][]*models.FirewallRule
+	// evictedRules contains the rules emptied during the update to make room for a higher tier. They are deleted and
+	// never filled again during the update.
+	evictedRules map[*models.FirewallRule]bool
+	// evictedSources contains the sources evicted to make room for a higher tier, with their rule set. They are added
+	// again once their rule set has room for them, unless their decisions are deleted.
+	evictedSources map[string]models.RuleSet
+	// expansions contains the IP range decisions each expanded decision was expanded to, so that the same ranges are
+	// removed when the decision is deleted, even if the databases changed meanwhile.
+	expansions map[string][]*csmodels.Decision
+}
+
+// DecisionExpander expands Country and AS scoped decisions into IP range decisions.
+type DecisionExpander interface {
+	Expand(decision *csmodels.Decision) []*csmodels.Decision
 }
 
 func convertDecisionsToMap(decisions []*csmodels.Decision) map[string]bool {
 
 	m := make(map[string]bool)
 	for _, decision := range decisions {
-		cidr := models.GetCIDR(*decision.Value)
-		m[cidr] = true
+		source := models.GetSource(models.GetScope(decision.Scope), *decision.Value)
+		m[source] = true
 	}
 	return m
 }
@@ -36,23 +87,505 @@ func removeDuplicatesDecisions(deleted map[string]bool, new map[string]bool) {
 	}
 }
 
-// Update updates the cloud firewall with the decisions specified
+// getRuleSets returns the rule sets maintained by the cloud client, split by tiers.
+func (f *Bouncer) getRuleSets() []models.RuleSet {
+	return f.getTierRuleSets(f.getClientRuleSets())
+}
+
+// getClientRuleSets returns the rule sets maintained by the cloud client.
+// Clients that do not support rule sets have a single rule set enforcing bans.
+func (f *Bouncer) getClientRuleSets() []models.RuleSet {
+	if client, ok := f.Client.(providers.RuleSetsClient); ok {
+		return client.RuleSets()
+	}
+	return []models.RuleSet{{
+		Type:     models.Ban,
+		Priority: f.Client.Priority(),
+		MaxRules: f.Client.MaxRules(),
+	}}
+}
+
+// getRuleSetsOffsets returns the offset of the band of each rule set within a tier. A rule set whose priorities overlap
+// the ones of a previous rule set, such as the egress rule set of GCP which uses the same priorities as the ingress one,
+// is placed after the previous rule sets, so that each rule set of a tier gets its own MaxRules priorities.
+func getRuleSetsOffsets(ruleSets []models.RuleSet) []int64 {
+	offsets := make([]int64, len(ruleSets))
+	for i, ruleSet := range ruleSets {
+		end := int64(0)
+		overlaps := false
+		for j, previous := range ruleSets[:i] {
+			previousStart := previous.Priority + offsets[j]
+			previousEnd := previousStart + int64(previous.MaxRules)
+			if previousEnd > end {
+				end = previousEnd
+			}
+			if ruleSet.Priority < previousEnd && previousStart < ruleSet.Priority+int64(ruleSet.MaxRules) {
+				overlaps = true
+			}
+		}
+		if overlaps {
+			offsets[i] = end - ruleSet.Priority
+		}
+	}
+	return offsets
+}
+
+// getRuleSetsSpan returns the number of priorities from the lowest priority of the rule sets to the end of the highest
+// priority band, once the bands are moved by their offsets.
+func getRuleSetsSpan(ruleSets []models.RuleSet, offsets []int64) int64 {
+	if len(ruleSets) == 0 {
+		return 0
+	}
+	first := ruleSets[0].Priority
+	end := ruleSets[0].Priority + offsets[0] + int64(ruleSets[0].MaxRules)
+	for i, ruleSet := range ruleSets[1:] {
+		if ruleSet.Priority < first {
+			first = ruleSet.Priority
+		}
+		if ruleSet.Priority+offsets[i+1]+int64(ruleSet.MaxRules) > end {
+			end = ruleSet.Priority + offsets[i+1] + int64(ruleSet.MaxRules)
+		}
+	}
+	return end - first
+}
+
+// getTierRuleSets splits each rule set into a rule set per tier, in tier order. Each tier gets a copy of the priority
+// bands of all the rule sets, one after the other, so that the band of a tier never overlaps the bands of the other
+// rule sets. The tiers of a rule set share its capacity, raised to one rule per tier.
+func (f *Bouncer) getTierRuleSets(ruleSets []models.RuleSet) []models.RuleSet {
+	if len(f.Tiers) == 0 {
+		return ruleSets
+	}
+	offsets := getRuleSetsOffsets(ruleSets)
+	span := getRuleSetsSpan(ruleSets, offsets)
+	tierRuleSets := []models.RuleSet{}
+	for j, ruleSet := range ruleSets {
+		maxRules := ruleSet.MaxRules
+		if maxRules < len(f.Tiers) {
+			maxRules = len(f.Tiers)
+		}
+		for i, tier := range f.Tiers {
+			tierRuleSet := ruleSet
+			tierRuleSet.Tier = tier.Name
+			tierRuleSet.MaxRules = maxRules
+			tierRuleSet.Priority = ruleSet.Priority + offsets[j] + int64(i)*span
+			tierRuleSet.MaxPriority = tierRuleSet.Priority + int64(ruleSet.MaxRules) - 1
+			tierRuleSets = append(tierRuleSets, tierRuleSet)
+		}
+	}
+	return tierRuleSets
+}
+
+// CheckTiers checks that the priority bands of the tiers are within the highest priority of their rule set, so that
+// the rules of the lowest tiers can be created.
+func (f *Bouncer) CheckTiers() error {
+	if len(f.Tiers) == 0 {
+		return nil
+	}
+	ruleSets := f.getClientRuleSets()
+	tierRuleSets := f.getTierRuleSets(ruleSets)
+	for i, ruleSet := range ruleSets {
+		// the tier rule sets of the rule set follow each other in tier order
+		last := tierRuleSets[(i+1)*len(f.Tiers)-1]
+		if ruleSet.MaxPriority > 0 && last.MaxPriority > ruleSet.MaxPriority {
+			return fmt.Errorf("the %d tiers of the %s %s rules need priorities up to %d, above the priority_range max %d",
+				len(f.Tiers), models.GetDirection(ruleSet.Direction), ruleSet.Type, last.MaxPriority, ruleSet.MaxPriority)
+		}
+	}
+	return nil
+}
+
+// getDecisionTier returns the name of the first tier matching the decision origin. Decisions not matching any tier
+// belong to the last tier.
+func (f *Bouncer) getDecisionTier(decision *csmodels.Decision) string {
+	if len(f.Tiers) == 0 {
+		return ""
+	}
+	for _, tier := range f.Tiers {
+		if len(tier.Origins) == 0 || matchesAny(tier.Origins, decision.Origin) {
+			return tier.Name
+		}
+	}
+	return f.Tiers[len(f.Tiers)-1].Name
+}
+
+// getTierIndex returns the position of the tier, or -1 if the tier is unknown.
+func (f *Bouncer) getTierIndex(name string) int {
+	for i, tier := range f.Tiers {
+		if tier.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func getRuleType(rule *models.FirewallRule) string {
+	if rule.Type == "" {
+		return models.Ban
+	}
+	return rule.Type
+}
+
+// getDecisionRuleSet returns the rule set of the direction and tier enforcing the decision type for the decision scope.
+// Decision types without a dedicated rule set are enforced by the ban rule set of the scope. It returns false if no rule
+// set of the direction supports the decision scope.
+func getDecisionRuleSet(decision *csmodels.Decision, direction string, tier string, ruleSets []models.RuleSet) (models.RuleSet, bool) {
+	scope := models.GetScope(decision.Scope)
+	var banRuleSet *models.RuleSet
+	for i, ruleSet := range ruleSets {
+		if ruleSet.Scope != scope || models.GetDirection(ruleSet.Direction) != direction || ruleSet.Tier != tier {
+			continue
+		}
+		if decision.Type != nil && ruleSet.Type == *decision.Type {
+			return ruleSet, true
+		}
+		if ruleSet.Type == models.Ban && banRuleSet == nil {
+			banRuleSet = &ruleSets[i]
+		}
+	}
+	if banRuleSet == nil {
+		return models.RuleSet{}, false
+	}
+	return *banRuleSet, true
+}
+
+// hasDecisionRuleSet returns true if a rule set, in any direction, supports the decision scope. All the tiers have the
+// same rule sets, so only the tier of the first rule set is checked.
+func hasDecisionRuleSet(decision *csmodels.Decision, ruleSets []models.RuleSet) bool {
+	if len(ruleSets) == 0 {
+		return false
+	}
+	for _, direction := range []string{models.Ingress, models.Egress} {
+		if _, ok := getDecisionRuleSet(decision, direction, ruleSets[0].Tier, ruleSets); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, value *string) bool {
+	if value == nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, *value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesFilter returns true if the decision origin or scenario matches the filter.
+func matchesFilter(decision *csmodels.Decision, filter models.DecisionFilter) bool {
+	return matchesAny(filter.Origins, decision.Origin) || matchesAny(filter.Scenarios, decision.Scenario)
+}
+
+// filterDecisions returns the decisions enforced by the rule set. Egress only decisions are not enforced by ingress rule sets.
+// With anyTier, the decisions of all the tiers are returned, so that deleted decisions are removed from every tier.
+func (f *Bouncer) filterDecisions(decisions []*csmodels.Decision, ruleSet models.RuleSet, ruleSets []models.RuleSet, anyTier bool) []*csmodels.Decision {
+	direction := models.GetDirection(ruleSet.Direction)
+	filtered := []*csmodels.Decision{}
+	for _, decision := range decisions {
+		if direction == models.Ingress && matchesFilter(decision, f.EgressOnly) {
+			continue
+		}
+		tier := f.getDecisionTier(decision)
+		if anyTier {
+			tier = ruleSet.Tier
+		}
+		if decisionRuleSet, ok := getDecisionRuleSet(decision, direction, tier, ruleSets); ok && decisionRuleSet == ruleSet {
+			filtered = append(filtered, decision)
+		}
+	}
+	return filtered
+}
+
+// expandDecisions replaces the decisions whose scope is not supported by any rule set with the
+// decisions returned by the expander.
+func (f *Bouncer) expandDecisions(decisions []*csmodels.Decision, ruleSets []models.RuleSet) []*csmodels.Decision {
+	if f.Expander == nil {
+		return decisions
+	}
+	if f.expansions == nil {
+		f.expansions = make(map[string][]*csmodels.Decision)
+	}
+	expanded := []*csmodels.Decision{}
+	for _, decision := range decisions {
+		if hasDecisionRuleSet(decision, ruleSets) {
+			expanded = append(expanded, decision)
+			continue
+		}
+		decisionExpansion := f.Expander.Expand(decision)
+		f.expansions[getDecisionKey(decision)] = decisionExpansion
+		expanded = append(expanded, decisionExpansion...)
+	}
+	return expanded
+}
+
+// expandDeletedDecisions returns the IP range decisions to delete for the deleted decisions. The decisions expanded
+// before are deleted from the ranges they were expanded to, and the others are expanded with the current databases.
+func (f *Bouncer) expandDeletedDecisions(decisions []*csmodels.Decision, ruleSets []models.RuleSet) []*csmodels.Decision {
+	if f.Expander == nil {
+		return decisions
+	}
+	expanded := []*csmodels.Decision{}
+	for _, decision := range decisions {
+		decisionExpansion, ok := f.expansions[getDecisionKey(decision)]
+		if hasDecisionRuleSet(decision, ruleSets) || !ok {
+			expanded = append(expanded, f.expandDecisions([]*csmodels.Decision{decision}, ruleSets)...)
+			continue
+		}
+		for _, rangeDecision := range decisionExpansion {
+			deleted := *decision
+			deleted.Value = rangeDecision.Value
+			deleted.Scope = rangeDecision.Scope
+			expanded = append(expanded, &deleted)
+		}
+	}
+	return expanded
+}
+
+// forgetExpansions forgets the ranges of the deleted decisions once they are removed, unless they are received again.
+func (f *Bouncer) forgetExpansions(decisionStream *csmodels.DecisionsStreamResponse) {
+	received := make(map[string]bool)
+	for _, decision := range decisionStream.New {
+		received[getDecisionKey(decision)] = true
+	}
+	for _, decision := range decisionStream.Deleted {
+		if !received[getDecisionKey(decision)] {
+			delete(f.expansions, getDecisionKey(decision))
+		}
+	}
+}
+
+// logUnsupportedDecisions logs the decisions that will be ignored because no rule set enforces them.
+func (f *Bouncer) logUnsupportedDecisions(decisions []*csmodels.Decision, ruleSets []models.RuleSet) {
+	for _, decision := range decisions {
+		if !hasDecisionRuleSet(decision, ruleSets) {
+			log.Warningf("ignoring decision %s: scope %s is not supported", *decision.Value, models.GetScope(decision.Scope))
+			continue
+		}
+		enforced := false
+		for _, ruleSet := range ruleSets {
+			if len(f.filterDecisions([]*csmodels.Decision{decision}, ruleSet, ruleSets, false)) > 0 {
+				enforced = true
+				break
+			}
+		}
+		if !enforced {
+			log.Warningf("ignoring decision %s: egress only decisions are not blocked by %s", *decision.Value, f.Client.GetProviderName())
+		}
+	}
+}
+
+// filterRules returns the rules of the rule set. The rules of a tier are the ones inside its priority band.
+func filterRules(rules []*models.FirewallRule, ruleSet models.RuleSet) []*models.FirewallRule {
+	var filtered []*models.FirewallRule
+	for _, rule := range rules {
+		if getRuleType(rule) != ruleSet.Type || rule.Scope != ruleSet.Scope || models.GetDirection(rule.Direction) != models.GetDirection(ruleSet.Direction) {
+			continue
+		}
+		if ruleSet.Tier != "" && (rule.Priority < ruleSet.Priority || rule.Priority > getMaxPriority(ruleSet)) {
+			continue
+		}
+		filtered = append(filtered, rule)
+	}
+	return filtered
+}
+
+// isOwned returns true if the rule is owned by the bouncer.
+func (f *Bouncer) isOwned(rule *models.FirewallRule) bool {
+	return rule.Owner == "" || rule.Owner == f.RuleNamePrefix
+}
+
+// removeReservedNames returns the rules without the ones that only reserve their name.
+func removeReservedNames(rules []*models.FirewallRule) []*models.FirewallRule {
+	kept := []*models.FirewallRule{}
+	for _, rule := range rules {
+		if rule.Owner != models.ReservedNameOwner {
+			kept = append(kept, rule)
+		}
+	}
+	return kept
+}
+
+// getOwnedRules returns the rules owned by the bouncer, ignoring the rules of other bouncers with an overlapping prefix.
+func (f *Bouncer) getOwnedRules(rules []*models.FirewallRule) []*models.FirewallRule {
+	owned := []*models.FirewallRule{}
+	for _, rule := range rules {
+		if !f.isOwned(rule) {
+			log.Debugf("ignoring rule %s owned by %s", rule.Name, rule.Owner)
+			continue
+		}
+		owned = append(owned, rule)
+	}
+	return owned
+}
+
+// getMaxPriority returns the highest priority of the rule set, which is the end of its range of MaxRules
+// priorities if the rule set is not bounded.
+func getMaxPriority(ruleSet models.RuleSet) int64 {
+	if ruleSet.MaxPriority > 0 {
+		return ruleSet.MaxPriority
+	}
+	return ruleSet.Priority + int64(ruleSet.MaxRules) - 1
+}
+
+// reportForeignRules warns, once per rule, about the rules not owned by the bouncer whose priority is inside the
+// priority range of a rule set. Their priorities are skipped when creating new rules.
+func (f *Bouncer) reportForeignRules(rules []*models.FirewallRule, ruleSets []models.RuleSet) {
+	if f.reportedRules == nil {
+		f.reportedRules = make(map[string]bool)
+	}
+	for _, rule := range rules {
+		if f.isOwned(rule) || f.reportedRules[rule.Name] {
+			continue
+		}
+		for _, ruleSet := range ruleSets {
+			if rule.Priority >= ruleSet.Priority && rule.Priority <= getMaxPriority(ruleSet) {
+				log.Warningf("rule %s, not owned by the bouncer, uses priority %d inside the priority range %d-%d of the %s rules",
+					rule.Name, rule.Priority, ruleSet.Priority, getMaxPriority(ruleSet), ruleSet.Type)
+				f.reportedRules[rule.Name] = true
+				break
+			}
+		}
+	}
+}
+
+func (f *Bouncer) getMaxSourcesPerRule(ruleSet models.RuleSet) int {
+	if ruleSet.MaxSourcesPerRule > 0 {
+		return ruleSet.MaxSourcesPerRule
+	}
+	return f.Client.MaxSourcesPerRule()
+}
+
+// HasPendingDecisions returns true if decisions of a failed update must be applied again.
+func (f *Bouncer) HasPendingDecisions() bool {
+	return f.pending != nil
+}
+
+// getDecisionKeys returns the keys of the decisions.
+func getDecisionKeys(decisions []*csmodels.Decision) map[string]bool {
+	keys := make(map[string]bool)
+	for _, decision := range decisions {
+		keys[getDecisionKey(decision)] = true
+	}
+	return keys
+}
+
+// mergeDecisions appends the next decisions to the pending decisions. Pending decisions overridden by a next decision
+// of the same type and source are dropped, so that the most recent decision wins.
+func mergeDecisions(pending *csmodels.DecisionsStreamResponse, next *csmodels.DecisionsStreamResponse) *csmodels.DecisionsStreamResponse {
+	if pending == nil {
+		return next
+	}
+	nextNew := getDecisionKeys(next.New)
+	nextDeleted := getDecisionKeys(next.Deleted)
+	merged := &csmodels.DecisionsStreamResponse{}
+	for _, decision := range pending.New {
+		if !nextDeleted[getDecisionKey(decision)] {
+			merged.New = append(merged.New, decision)
+		}
+	}
+	for _, decision := range pending.Deleted {
+		if !nextNew[getDecisionKey(decision)] {
+			merged.Deleted = append(merged.Deleted, decision)
+		}
+	}
+	merged.New = append(merged.New, next.New...)
+	merged.Deleted = append(merged.Deleted, next.Deleted...)
+	return merged
+}
+
+// getDroppedDirectionRules returns the rules of the directions that are no longer blocked by any rule set, emptied so
+// that they are deleted. Their sources would otherwise never be removed.
+func getDroppedDirectionRules(rules []*models.FirewallRule, ruleSets []models.RuleSet) []*models.FirewallRule {
+	directions := make(map[string]bool)
+	for _, ruleSet := range ruleSets {
+		directions[models.GetDirection(ruleSet.Direction)] = true
+	}
+	dropped := []*models.FirewallRule{}
+	for _, rule := range rules {
+		direction := models.GetDirection(rule.Direction)
+		if directions[direction] {
+			continue
+		}
+		log.Infof("deleting rule %s, the %s direction is no longer blocked", rule.Name, direction)
+		rule.SourceRanges = make(map[string]bool)
+		rule.State = models.Modified
+		dropped = append(dropped, rule)
+	}
+	return dropped
+}
+
+// copySourceRanges returns the source ranges of each rule, used to roll back the rules whose update failed.
+func copySourceRanges(rules []*models.FirewallRule) map[*models.FirewallRule]map[string]bool {
+	sourceRanges := make(map[*models.FirewallRule]map[string]bool)
+	for _, rule := range rules {
+		sources := make(map[string]bool)
+		for source := range rule.SourceRanges {
+			sources[source] = true
+		}
+		sourceRanges[rule] = sources
+	}
+	return sourceRanges
+}
+
+// Update updates the cloud firewall with the decisions specified. If the update fails, the decisions are kept and
+// applied again with the next update.
 func (f *Bouncer) Update(decisionStream *csmodels.DecisionsStreamResponse) error {
+	decisionStream = mergeDecisions(f.pending, decisionStream)
+	f.pending = nil
 	rules, err := f.Client.GetRules(f.RuleNamePrefix)
 	if err != nil {
+		f.pending = decisionStream
 		return err
 	}
+	f.ruleNames = make(map[string]bool)
+	f.priorities = make(map[int64]bool)
+	for _, rule := range rules {
+		f.ruleNames[rule.Name] = true
+		if rule.Owner != models.ReservedNameOwner {
+			f.priorities[rule.Priority] = true
+		}
+	}
+	rules = removeReservedNames(rules)
+	ruleSets := f.getRuleSets()
+	f.reportForeignRules(rules, ruleSets)
+	rules = f.getOwnedRules(rules)
+	sourceRanges := copySourceRanges(rules)
 
-	deleted := convertDecisionsToMap(decisionStream.Deleted)
-	new := convertDecisionsToMap(decisionStream.New)
-	removeDuplicatesDecisions(deleted, new)
-	deleteSourceRanges(rules, deleted)
+	// the deleted decisions are expanded first, to the ranges of their previous expansion
+	deletedDecisions := f.expandDeletedDecisions(decisionStream.Deleted, ruleSets)
+	newDecisions := f.expandDecisions(decisionStream.New, ruleSets)
+	f.logUnsupportedDecisions(newDecisions, ruleSets)
+	f.ruleSetRules = make(map[models.RuleSet][]*models.FirewallRule)
+	f.evictedRules = make(map[*models.FirewallRule]bool)
+	for _, ruleSet := range ruleSets {
+		f.ruleSetRules[ruleSet] = filterRules(rules, ruleSet)
+	}
+	for _, ruleSet := range ruleSets {
+		ruleSetRules := f.ruleSetRules[ruleSet]
+		deleted := convertDecisionsToMap(f.filterDecisions(deletedDecisions, ruleSet, ruleSets, true))
+		new := convertDecisionsToMap(f.filterDecisions(newDecisions, ruleSet, ruleSets, false))
+		removeDuplicatesDecisions(deleted, new)
+		deleteSourceRanges(ruleSetRules, deleted)
+		f.forgetEvictedSources(ruleSet, deleted)
+		f.forgetEvictedSources(ruleSet, new)
 
-	rules = f.addSourceRanges(rules, new)
-	err = f.updateProviderFirewallRules(rules)
+		ruleSetRules = f.addSourceRanges(ruleSetRules, new, ruleSet)
+		f.ruleSetRules[ruleSet] = f.addEvictedSourceRanges(ruleSetRules, ruleSet)
+	}
+	updatedRules := getDroppedDirectionRules(rules, ruleSets)
+	for _, ruleSet := range ruleSets {
+		updatedRules = append(updatedRules, f.ruleSetRules[ruleSet]...)
+	}
+	err = f.updateProviderFirewallRules(updatedRules, sourceRanges)
 	if err != nil {
+		f.pending = decisionStream
 		return err
 	}
+	f.forgetExpansions(decisionStream)
 	return nil
 }
 
@@ -66,11 +599,11 @@ func deleteSourceRanges(rules []*models.FirewallRule, sources map[string]bool) {
 	}
 }
 
-func (f *Bouncer) addSourceRanges(rules []*models.FirewallRule, sources map[string]bool) []*models.FirewallRule {
-	log.Debugf("adding source ranges")
+func (f *Bouncer) addSourceRanges(rules []*models.FirewallRule, sources map[string]bool, ruleSet models.RuleSet) []*models.FirewallRule {
+	log.Debugf("adding source ranges to %s %s %s rules", models.GetDirection(ruleSet.Direction), ruleSet.Type, ruleSet.Scope)
 	for source := range sources {
 		log.Debugf("processiong decision %s", source)
-		rules = f.addSourceRangeToRules(rules, source)
+		rules = f.addSourceRangeToRules(rules, source, ruleSet)
 	}
 	return rules
 }
@@ -94,13 +627,13 @@ func sourceExists(rules []*models.FirewallRule, source string) bool {
 	return false
 }
 
-func (f *Bouncer) addSourceRangeToRules(rules []*models.FirewallRule, source string) []*models.FirewallRule {
+func (f *Bouncer) addSourceRangeToRules(rules []*models.FirewallRule, source string, ruleSet models.RuleSet) []*models.FirewallRule {
 	if sourceExists(rules, source) {
 		log.Debugf("%s already exist", source)
 		return rules
 	}
 	log.Debugf("adding %s to rules", source)
-	rule, rules, err := f.getRuleToUpdate(rules)
+	rule, rules, err := f.getRuleToUpdate(rules, ruleSet)
 	if err != nil {
 		log.Warning(err)
 		return rules
@@ -110,20 +643,29 @@ func (f *Bouncer) addSourceRangeToRules(rules []*models.FirewallRule, source str
 	return rules
 }
 
-func (f *Bouncer) getRuleToUpdate(rules []*models.FirewallRule) (*models.FirewallRule, []*models.FirewallRule, error) {
-	max := f.Client.MaxSourcesPerRule()
+func (f *Bouncer) getRuleToUpdate(rules []*models.FirewallRule, ruleSet models.RuleSet) (*models.FirewallRule, []*models.FirewallRule, error) {
+	max := f.getMaxSourcesPerRule(ruleSet)
 	currentRuleMax := 0
 	ruleToUpdate := &models.FirewallRule{
 		Name: "blank",
 	}
 	if len(rules) == 0 {
 		log.Debugf("no existing rule, we need to create a new one")
-		ruleToUpdate = f.genNewRule(rules)
+		if err := f.reserveTierRule(ruleSet); err != nil {
+			return nil, rules, err
+		}
+		ruleToUpdate, err := f.genNewRule(rules, ruleSet)
+		if err != nil {
+			return nil, rules, err
+		}
 		rules = append(rules, ruleToUpdate)
 		return ruleToUpdate, rules, nil
 	}
 	// Find the rule that has the most source to fill up
 	for _, rule := range rules {
+		if f.evictedRules[rule] {
+			continue
+		}
 		count := len(rule.SourceRanges)
 		if count >= currentRuleMax && count < max {
 			currentRuleMax = count
@@ -135,70 +677,239 @@ func (f *Bouncer) getRuleToUpdate(rules []*models.FirewallRule) (*models.Firewal
 	}
 	if ruleToUpdate.Name == "blank" {
 		log.Infof("rules are full, we need to create a new one")
-		if len(rules) >= f.Client.MaxRules() {
-			return nil, rules, fmt.Errorf("can't create a new rule, at maximum capacity")
+		if len(rules) >= ruleSet.MaxRules {
+			return nil, rules, fmt.Errorf("can't create a new %s rule, at maximum capacity", ruleSet.Type)
+		}
+		if err := f.reserveTierRule(ruleSet); err != nil {
+			return nil, rules, err
+		}
+		var err error
+		ruleToUpdate, err = f.genNewRule(rules, ruleSet)
+		if err != nil {
+			return nil, rules, err
 		}
-		ruleToUpdate = f.genNewRule(rules)
 		rules = append(rules, ruleToUpdate)
+	} else if len(ruleToUpdate.SourceRanges) == 0 {
+		// An empty rule is deleted unless it is filled again, which uses the capacity shared by the tiers.
+		if err := f.reserveTierRule(ruleSet); err != nil {
+			return nil, rules, err
+		}
 	}
 	return ruleToUpdate, rules, nil
 }
 
-func (f *Bouncer) getNextPriority(rules []*models.FirewallRule) int64 {
-	if len(rules) == 0 {
-		return f.Client.Priority()
+// isSameRuleSet returns true if both rule sets are tiers of the same rule set.
+func isSameRuleSet(ruleSet models.RuleSet, other models.RuleSet) bool {
+	return ruleSet.Type == other.Type && ruleSet.Scope == other.Scope && models.GetDirection(ruleSet.Direction) == models.GetDirection(other.Direction)
+}
+
+// countTierRules returns the number of rules of all the tiers of the rule set that still contain sources.
+func (f *Bouncer) countTierRules(ruleSet models.RuleSet) int {
+	count := 0
+	for other, rules := range f.ruleSetRules {
+		if !isSameRuleSet(ruleSet, other) {
+			continue
+		}
+		for _, rule := range rules {
+			if !f.evictedRules[rule] && len(rule.SourceRanges) > 0 {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// getEvictableRule returns the rule with the most sources of the lowest tier below the tier of the rule set, with its
+// rule set, or nil if the lower tiers have no rule.
+func (f *Bouncer) getEvictableRule(ruleSet models.RuleSet) (*models.FirewallRule, models.RuleSet) {
+	for i := len(f.Tiers) - 1; i > f.getTierIndex(ruleSet.Tier); i-- {
+		var evictable *models.FirewallRule
+		var evictableRuleSet models.RuleSet
+		for other, rules := range f.ruleSetRules {
+			if other.Tier != f.Tiers[i].Name || !isSameRuleSet(ruleSet, other) {
+				continue
+			}
+			for _, rule := range rules {
+				if f.evictedRules[rule] || rule.State == models.New || len(rule.SourceRanges) == 0 {
+					continue
+				}
+				if evictable == nil || len(rule.SourceRanges) > len(evictable.SourceRanges) {
+					evictable = rule
+					evictableRuleSet = other
+				}
+			}
+		}
+		if evictable != nil {
+			return evictable, evictableRuleSet
+		}
+	}
+	return nil, models.RuleSet{}
+}
+
+// reserveTierRule makes room for a rule of a tier when the rules of all the tiers of the rule set are at maximum
+// capacity, by evicting the sources of a rule of a lower tier. The evicted sources are added again once their tier has
+// room for them.
+func (f *Bouncer) reserveTierRule(ruleSet models.RuleSet) error {
+	if ruleSet.Tier == "" || f.countTierRules(ruleSet) < ruleSet.MaxRules {
+		return nil
+	}
+	rule, evictedRuleSet := f.getEvictableRule(ruleSet)
+	if rule == nil {
+		return fmt.Errorf("can't create a new %s rule for the %s tier, at maximum capacity", ruleSet.Type, ruleSet.Tier)
+	}
+	log.Warningf("evicting %d source(s) of rule %s to make room for the %s tier", len(rule.SourceRanges), rule.Name, ruleSet.Tier)
+	if f.evictedSources == nil {
+		f.evictedSources = make(map[string]models.RuleSet)
+	}
+	for source := range rule.SourceRanges {
+		f.evictedSources[source] = evictedRuleSet
+	}
+	rule.SourceRanges = make(map[string]bool)
+	rule.State = models.Modified
+	if f.evictedRules == nil {
+		f.evictedRules = make(map[*models.FirewallRule]bool)
+	}
+	f.evictedRules[rule] = true
+	return nil
+}
+
+// forgetEvictedSources stops adding again the evicted sources of the tiers of the rule set, since their decisions are
+// deleted or received again.
+func (f *Bouncer) forgetEvictedSources(ruleSet models.RuleSet, sources map[string]bool) {
+	for source := range sources {
+		if evictedRuleSet, ok := f.evictedSources[source]; ok && isSameRuleSet(ruleSet, evictedRuleSet) {
+			delete(f.evictedSources, source)
+		}
+	}
+}
+
+// addEvictedSourceRanges adds the evicted sources of the rule set again while it has room for them, such as when the
+// decisions of a higher tier are deleted.
+func (f *Bouncer) addEvictedSourceRanges(rules []*models.FirewallRule, ruleSet models.RuleSet) []*models.FirewallRule {
+	sources := []string{}
+	for source, evictedRuleSet := range f.evictedSources {
+		if evictedRuleSet == ruleSet {
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+	for i, source := range sources {
+		if sourceExists(rules, source) {
+			delete(f.evictedSources, source)
+			continue
+		}
+		rule, updatedRules, err := f.getRuleToUpdate(rules, ruleSet)
+		if err != nil {
+			log.Debugf("%d evicted source(s) of the %s tier wait for room: %s", len(sources)-i, ruleSet.Tier, err)
+			return updatedRules
+		}
+		rules = updatedRules
+		rule.SourceRanges[source] = true
+		delete(f.evictedSources, source)
+		log.Debugf("added evicted %s to %s", source, rule.Name)
+	}
+	return rules
+}
+
+// getNextPriority returns the lowest priority of the rule set that is not used by another rule, so that the priorities
+// of deleted rules are reused. Priorities above the MaxPriority of the rule set are never returned.
+func (f *Bouncer) getNextPriority(rules []*models.FirewallRule, ruleSet models.RuleSet) (int64, error) {
+	used := make(map[int64]bool)
+	for priority := range f.priorities {
+		used[priority] = true
 	}
-	highestPriority := f.Client.Priority()
 	for _, rule := range rules {
-		if rule.Priority > highestPriority {
-			highestPriority = rule.Priority
+		used[rule.Priority] = true
+	}
+	for priority := ruleSet.Priority; ruleSet.MaxPriority == 0 || priority <= ruleSet.MaxPriority; priority++ {
+		if !used[priority] {
+			return priority, nil
 		}
 	}
-	return highestPriority + 1
+	return 0, fmt.Errorf("can't create a new %s rule, no priority available up to %d", ruleSet.Type, ruleSet.MaxPriority)
 }
 
-// genNewRuleName generates a new rule name by appending 2 random words to the rule name prefix.
+// genNewRuleName generates a new rule name from the rule name prefix, the provider name and the lowest index
+// not used by an existing rule.
 func (f *Bouncer) genNewRuleName() string {
-	randomWords := diceware.MustGenerate(2)
-	r := fmt.Sprintf("%s-%s", f.RuleNamePrefix, strings.ToLower(strings.Join(randomWords, "-")))
-	return r
+	if f.ruleNames == nil {
+		f.ruleNames = make(map[string]bool)
+	}
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("%s-%s-%d", f.RuleNamePrefix, f.Client.GetProviderName(), i)
+		if !f.ruleNames[name] {
+			f.ruleNames[name] = true
+			return name
+		}
+	}
 }
 
-func (f *Bouncer) genNewRule(rules []*models.FirewallRule) *models.FirewallRule {
-
+func (f *Bouncer) genNewRule(rules []*models.FirewallRule, ruleSet models.RuleSet) (*models.FirewallRule, error) {
+	priority, err := f.getNextPriority(rules, ruleSet)
+	if err != nil {
+		return nil, err
+	}
+	if f.priorities == nil {
+		f.priorities = make(map[int64]bool)
+	}
+	f.priorities[priority] = true
 	return &models.FirewallRule{
 		Name:         f.genNewRuleName(),
 		SourceRanges: make(map[string]bool),
 		State:        models.New,
-		Priority:     f.getNextPriority(rules),
-	}
+		Priority:     priority,
+		Type:         ruleSet.Type,
+		Scope:        ruleSet.Scope,
+		Direction:    ruleSet.Direction,
+		Owner:        f.RuleNamePrefix,
+	}, nil
 }
 
-func (f *Bouncer) updateProviderFirewallRules(rules []*models.FirewallRule) error {
+// updateProviderFirewallRules applies the rule changes to the cloud firewall. A rule whose operation failed is rolled
+// back to its previous source ranges and the other rules are still updated.
+func (f *Bouncer) updateProviderFirewallRules(rules []*models.FirewallRule, sourceRanges map[*models.FirewallRule]map[string]bool) error {
 	if len(rules) == 0 {
 		return nil
 	}
 	log.Debugf("updating firewall rules")
+	var errs []string
 	for _, rule := range rules {
 		log.Debugf("processing rule %#v", *rule)
+		if !f.isOwned(rule) && rule.State != "" {
+			errs = append(errs, fmt.Sprintf("refusing to update rule %s owned by %s", rule.Name, rule.Owner))
+			continue
+		}
+		var err error
 		switch rule.State {
 		case models.New:
-			err := f.Client.CreateRule(rule)
-			if err != nil {
-				return err
-			}
+			err = f.Client.CreateRule(rule)
 		case models.Modified:
-			err := f.updateRule(rule)
-			if err != nil {
-				return err
-			}
+			err = f.updateRule(rule)
 		default:
 			log.Debugf("state did not change, results in noop")
 		}
+		if err != nil {
+			log.Errorf("unable to update rule %s, rolling back: %s", rule.Name, err)
+			rollbackRule(rule, sourceRanges)
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to update %d rule(s): %s", len(errs), strings.Join(errs, "; "))
 	}
 	return nil
 }
 
+// rollbackRule restores the source ranges of the rule before the update. A new rule has no source ranges.
+func rollbackRule(rule *models.FirewallRule, sourceRanges map[*models.FirewallRule]map[string]bool) {
+	sources, ok := sourceRanges[rule]
+	if !ok {
+		sources = make(map[string]bool)
+	}
+	rule.SourceRanges = sources
+	rule.State = ""
+}
+
 func (f *Bouncer) updateRule(rule *models.FirewallRule) error {
 	log.Debugf("updating firewall rule %s", rule.Name)
 	if len(rule.SourceRanges) == 0 {
@@ -209,7 +920,68 @@ func (f *Bouncer) updateRule(rule *models.FirewallRule) error {
 	return err
 }
 
+// GetManagedRules returns the rules owned by the bouncer.
+func (f *Bouncer) GetManagedRules() ([]*models.FirewallRule, error) {
+	rules, err := f.Client.GetRules(f.RuleNamePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get rules: %s", err)
+	}
+	return f.getOwnedRules(rules), nil
+}
+
+// Flush deletes all the rules owned by the bouncer and returns the number of deleted rules. Rules that cannot be
+// deleted do not prevent the other rules from being deleted.
+func (f *Bouncer) Flush() (int, error) {
+	rules, err := f.GetManagedRules()
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	errs := []string{}
+	for _, rule := range rules {
+		if err := f.Client.DeleteRule(rule); err != nil {
+			log.Errorf("unable to delete rule %s: %s", rule.Name, err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		deleted++
+	}
+	f.pending = nil
+	if len(errs) > 0 {
+		return deleted, fmt.Errorf("unable to delete %d rule(s): %s", len(errs), strings.Join(errs, "; "))
+	}
+	return deleted, nil
+}
+
+// Preflight runs the pre-flight checks of the client, if it supports them, and logs the result of each check. It returns
+// an error listing the failed checks.
+func (f *Bouncer) Preflight() error {
+	client, ok := f.Client.(providers.PreflightClient)
+	if !ok {
+		log.Debugf("%s does not support pre-flight checks", f.Client.GetProviderName())
+		return nil
+	}
+	failed := []string{}
+	for _, check := range client.Preflight() {
+		if check.Err != nil {
+			log.Errorf("%s pre-flight check of %s failed: %s", f.Client.GetProviderName(), check.Name, check.Err)
+			failed = append(failed, fmt.Sprintf("%s: %s", check.Name, check.Err))
+			continue
+		}
+		log.Infof("%s pre-flight check of %s passed", f.Client.GetProviderName(), check.Name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d pre-flight check(s) failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
 func (f *Bouncer) ShutDown() error {
 	log.Infof("shutting down %s firewall bouncer", f.Client.GetProviderName())
-	return nil
+	if !f.CleanupOnShutdown {
+		return f.FlushBatch()
+	}
+	deleted, err := f.Flush()
+	log.Infof("deleted %d %s rule(s)", deleted, f.Client.GetProviderName())
+	return err
 }
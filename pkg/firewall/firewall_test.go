@@ -2,6 +2,7 @@ package firewall
 
 import (
 	"fmt"
+	"sort"
 	"testing"
 
 	csmodels "github.com/crowdsecurity/crowdsec/pkg/models"
@@ -59,9 +60,9 @@ func TestBouncer_getRuleToUpdate(t *testing.T) {
 		},
 	}
 	var fakeClient, _ = testingUtils.NewEmptyClient()
-	var f = &Bouncer{fakeClient, "test-rule"}
+	var f = &Bouncer{Client: fakeClient, RuleNamePrefix: "test-rule"}
 	t.Run("empty", func(t *testing.T) {
-		rule, rules, _ := f.getRuleToUpdate(tests["empty"].rules)
+		rule, rules, _ := f.getRuleToUpdate(tests["empty"].rules, f.getRuleSets()[0])
 		assert.Contains(t, rule.Name, f.RuleNamePrefix)
 		assert.Regexp(t, "^(?:[a-z](?:[-a-z0-9]{0,61}[a-z0-9])?)$", rule.Name)
 		fmt.Printf("rule name: %s", rule.Name)
@@ -70,20 +71,20 @@ func TestBouncer_getRuleToUpdate(t *testing.T) {
 		assert.Equal(t, models.New, rule.State)
 	})
 	t.Run("existing", func(t *testing.T) {
-		rule, rules, _ := f.getRuleToUpdate(tests["existing"].rules)
+		rule, rules, _ := f.getRuleToUpdate(tests["existing"].rules, f.getRuleSets()[0])
 		assert.Equal(t, "test-rule-dummy", rule.Name)
 		assert.Equal(t, 1, len(rules))
 		assert.Equal(t, models.Modified, rule.State)
 	})
 	t.Run("full_create_new", func(t *testing.T) {
-		rule, rules, _ := f.getRuleToUpdate(tests["full_create_new"].rules)
+		rule, rules, _ := f.getRuleToUpdate(tests["full_create_new"].rules, f.getRuleSets()[0])
 		assert.NotEqual(t, "test-rule-dummy", rule.Name)
 		assert.Equal(t, 2, len(rules))
 		assert.Contains(t, rule.Name, f.RuleNamePrefix)
 		assert.Equal(t, models.New, rule.State)
 	})
 	t.Run("full_fail", func(t *testing.T) {
-		rule, rules, err := f.getRuleToUpdate(tests["full_fail"].rules)
+		rule, rules, err := f.getRuleToUpdate(tests["full_fail"].rules, f.getRuleSets()[0])
 		if (err != nil) != true {
 			t.Errorf("getRuleToUpdate should throw error when rules at max capacity")
 		}
@@ -95,9 +96,9 @@ func TestBouncer_getRuleToUpdate(t *testing.T) {
 
 func TestAddSourceRangeToEmptyRules(t *testing.T) {
 	var fakeClient, _ = testingUtils.NewEmptyClient()
-	var f = &Bouncer{fakeClient, "test-rule"}
+	var f = &Bouncer{Client: fakeClient, RuleNamePrefix: "test-rule"}
 	var rules []*models.FirewallRule
-	rules = f.addSourceRangeToRules(rules, "0.0.0.1/32")
+	rules = f.addSourceRangeToRules(rules, "0.0.0.1/32", f.getRuleSets()[0])
 	assert.Equal(t, len(rules[0].SourceRanges), 1)
 }
 
@@ -153,7 +154,7 @@ func TestBouncer_Update(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			var f = &Bouncer{tt.fields.Client, tt.fields.RuleNamePrefix}
+			var f = &Bouncer{Client: tt.fields.Client, RuleNamePrefix: tt.fields.RuleNamePrefix}
 			if err := f.Update(tt.args.decisionStream); (err != nil) != tt.wantErr {
 				t.Errorf("Bouncer.Update() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -231,15 +232,18 @@ func TestBouncer_getNextPriority(t *testing.T) {
 		RuleNamePrefix string
 	}
 	type args struct {
-		rules []*models.FirewallRule
+		rules       []*models.FirewallRule
+		priorities  map[int64]bool
+		maxPriority int64
 	}
 
 	var fakeClient, _ = testingUtils.NewEmptyClient()
 	tests := []struct {
-		name   string
-		fields fields
-		args   args
-		want   int64
+		name    string
+		fields  fields
+		args    args
+		want    int64
+		wantErr bool
 	}{
 		{
 			name: "default-priority",
@@ -292,16 +296,692 @@ func TestBouncer_getNextPriority(t *testing.T) {
 			},
 			want: int64(2),
 		},
+		{
+			name: "freed-priority",
+			fields: fields{
+				Client:         fakeClient,
+				RuleNamePrefix: "test-rule",
+			},
+			args: args{
+				rules: []*models.FirewallRule{
+					{Name: "test-rule1", Priority: 0},
+					{Name: "test-rule3", Priority: 2},
+				},
+			},
+			want: int64(1),
+		},
+		{
+			name: "foreign-priority",
+			fields: fields{
+				Client:         fakeClient,
+				RuleNamePrefix: "test-rule",
+			},
+			args: args{
+				rules:      []*models.FirewallRule{{Name: "test-rule1", Priority: 0}},
+				priorities: map[int64]bool{0: true, 1: true},
+			},
+			want: int64(2),
+		},
+		{
+			name: "max-priority-reached",
+			fields: fields{
+				Client:         fakeClient,
+				RuleNamePrefix: "test-rule",
+			},
+			args: args{
+				rules: []*models.FirewallRule{
+					{Name: "test-rule1", Priority: 0},
+					{Name: "test-rule2", Priority: 1},
+				},
+				maxPriority: 1,
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			f := &Bouncer{
 				Client:         tt.fields.Client,
 				RuleNamePrefix: tt.fields.RuleNamePrefix,
+				priorities:     tt.args.priorities,
 			}
-			if got := f.getNextPriority(tt.args.rules); got != tt.want {
+			ruleSet := f.getRuleSets()[0]
+			ruleSet.MaxPriority = tt.args.maxPriority
+			got, err := f.getNextPriority(tt.args.rules, ruleSet)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Bouncer.getNextPriority() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
 				t.Errorf("Bouncer.getNextPriority() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestBouncer_UpdateRuleSets(t *testing.T) {
+	client, _ := testingUtils.NewClientRuleSets()
+	f := &Bouncer{Client: client, RuleNamePrefix: "test-rule"}
+
+	ban := models.Ban
+	captcha := models.Captcha
+	source1 := "0.0.0.1"
+	source2 := "0.0.0.2"
+	source3 := "0.0.0.3"
+	decisionsStream := &csmodels.DecisionsStreamResponse{
+		New: csmodels.GetDecisionsResponse{
+			&csmodels.Decision{Value: &source1, Type: &ban},
+			&csmodels.Decision{Value: &source2, Type: &captcha},
+			&csmodels.Decision{Value: &source3},
+		},
+	}
+	err := f.Update(decisionsStream)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, len(client.Patched))
+	assert.Equal(t, "rule-ban", client.Patched[0].Name)
+	assert.Equal(t, 3, len(client.Patched[0].SourceRanges))
+	assert.True(t, client.Patched[0].SourceRanges["0.0.0.1/32"])
+	assert.True(t, client.Patched[0].SourceRanges["0.0.0.3/32"])
+
+	assert.Equal(t, 1, len(client.Created))
+	assert.Equal(t, models.Captcha, client.Created[0].Type)
+	assert.Equal(t, int64(100), client.Created[0].Priority)
+	assert.Equal(t, map[string]bool{"0.0.0.2/32": true}, client.Created[0].SourceRanges)
+}
+
+func Test_getDecisionRuleSet(t *testing.T) {
+	ruleSets := []models.RuleSet{
+		{Type: models.Ban, Priority: 0, MaxRules: 10},
+		{Type: models.Captcha, Priority: 10, MaxRules: 10},
+		{Type: models.Ban, Scope: models.CountryScope, Priority: 20, MaxRules: 10},
+	}
+	ban := models.Ban
+	captcha := models.Captcha
+	custom := "custom"
+	ip := "Ip"
+	country := "Country"
+	as := "AS"
+	tests := []struct {
+		name     string
+		decision *csmodels.Decision
+		want     models.RuleSet
+		wantOk   bool
+	}{
+		{"ip_ban", &csmodels.Decision{Type: &ban, Scope: &ip}, ruleSets[0], true},
+		{"ip_captcha", &csmodels.Decision{Type: &captcha, Scope: &ip}, ruleSets[1], true},
+		{"ip_custom_type", &csmodels.Decision{Type: &custom, Scope: &ip}, ruleSets[0], true},
+		{"no_scope", &csmodels.Decision{Type: &ban}, ruleSets[0], true},
+		{"country_ban", &csmodels.Decision{Type: &ban, Scope: &country}, ruleSets[2], true},
+		{"country_captcha", &csmodels.Decision{Type: &captcha, Scope: &country}, ruleSets[2], true},
+		{"as_unsupported", &csmodels.Decision{Type: &ban, Scope: &as}, models.RuleSet{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := getDecisionRuleSet(tt.decision, models.Ingress, "", ruleSets)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// fakeExpander expands the Country decisions to its ranges, 1.0.0.0/24 and 2.0.0.0/16 by default.
+type fakeExpander struct {
+	ranges []string
+}
+
+func (e *fakeExpander) Expand(decision *csmodels.Decision) []*csmodels.Decision {
+	if models.GetScope(decision.Scope) != models.CountryScope {
+		return nil
+	}
+	ranges := e.ranges
+	if ranges == nil {
+		ranges = []string{"1.0.0.0/24", "2.0.0.0/16"}
+	}
+	rangeScope := "Range"
+	decisions := []*csmodels.Decision{}
+	for i := range ranges {
+		decisions = append(decisions, &csmodels.Decision{Value: &ranges[i], Scope: &rangeScope, Type: decision.Type})
+	}
+	return decisions
+}
+
+func TestBouncer_UpdateExpansion(t *testing.T) {
+	client, _ := testingUtils.NewClientRuleSets()
+	f := &Bouncer{Client: client, RuleNamePrefix: "test-rule", Expander: &fakeExpander{}}
+
+	ban := models.Ban
+	country := "Country"
+	as := "AS"
+	countryValue := "fr"
+	asValue := "1234"
+	decisionsStream := &csmodels.DecisionsStreamResponse{
+		New: csmodels.GetDecisionsResponse{
+			&csmodels.Decision{Value: &countryValue, Scope: &country, Type: &ban},
+			&csmodels.Decision{Value: &asValue, Scope: &as, Type: &ban},
+		},
+	}
+	err := f.Update(decisionsStream)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, len(client.Patched))
+	assert.Equal(t, map[string]bool{"1.0.0.0/32": true, "1.0.0.0/24": true, "2.0.0.0/16": true}, client.Patched[0].SourceRanges)
+	assert.Equal(t, 0, len(client.Created))
+}
+
+func TestBouncer_UpdateExpansionChanged(t *testing.T) {
+	client := newFakeClientTiers()
+	expander := &fakeExpander{}
+	f := &Bouncer{Client: client, RuleNamePrefix: "test-rule", Expander: expander}
+
+	ban := models.Ban
+	country := "Country"
+	countryValue := "fr"
+	decision := &csmodels.Decision{Value: &countryValue, Scope: &country, Type: &ban}
+	assert.NoError(t, f.Update(&csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{decision}}))
+	assert.Equal(t, map[string]bool{"1.0.0.0/32": true, "1.0.0.0/24": true, "2.0.0.0/16": true}, client.rules["rule-local"].SourceRanges)
+
+	// the ranges added are removed even though the databases changed since
+	expander.ranges = []string{"3.0.0.0/16"}
+	assert.NoError(t, f.Update(&csmodels.DecisionsStreamResponse{Deleted: csmodels.GetDecisionsResponse{decision}}))
+	assert.Equal(t, map[string]bool{"1.0.0.0/32": true}, client.rules["rule-local"].SourceRanges)
+	assert.Empty(t, f.expansions)
+}
+
+type fakeClientDirections struct {
+	*testingUtils.FakeClientRuleSets
+}
+
+func (c *fakeClientDirections) RuleSets() []models.RuleSet {
+	return []models.RuleSet{
+		{Type: models.Ban, Priority: 0, MaxRules: 2},
+		{Type: models.Ban, Priority: 0, MaxRules: 2, Direction: models.Egress},
+	}
+}
+
+func TestBouncer_UpdateDirections(t *testing.T) {
+	ruleSetsClient, _ := testingUtils.NewClientRuleSets()
+	client := &fakeClientDirections{ruleSetsClient}
+	f := &Bouncer{
+		Client:         client,
+		RuleNamePrefix: "test-rule",
+		EgressOnly:     models.DecisionFilter{Origins: []string{"lists"}, Scenarios: []string{"*/c2-*"}},
+	}
+
+	ban := models.Ban
+	crowdsec := "crowdsec"
+	lists := "lists"
+	scenario := "crowdsecurity/ssh-bf"
+	c2Scenario := "firehol/c2-servers"
+	source1 := "0.0.0.1"
+	source2 := "0.0.0.2"
+	source3 := "0.0.0.3"
+	decisionsStream := &csmodels.DecisionsStreamResponse{
+		New: csmodels.GetDecisionsResponse{
+			&csmodels.Decision{Value: &source1, Type: &ban, Origin: &crowdsec, Scenario: &scenario},
+			&csmodels.Decision{Value: &source2, Type: &ban, Origin: &lists, Scenario: &scenario},
+			&csmodels.Decision{Value: &source3, Type: &ban, Origin: &crowdsec, Scenario: &c2Scenario},
+		},
+	}
+	err := f.Update(decisionsStream)
+	assert.NoError(t, err)
+
+	// the existing ingress rule gets the decisions that are not egress only
+	assert.Equal(t, 1, len(client.Patched))
+	assert.Equal(t, map[string]bool{"1.0.0.0/32": true, "0.0.0.1/32": true}, client.Patched[0].SourceRanges)
+
+	// a new egress rule gets all the decisions
+	assert.Equal(t, 1, len(client.Created))
+	assert.Equal(t, models.Egress, client.Created[0].Direction)
+	assert.Equal(t, map[string]bool{"0.0.0.1/32": true, "0.0.0.2/32": true, "0.0.0.3/32": true}, client.Created[0].SourceRanges)
+}
+
+type fakeClientDroppedDirection struct {
+	*testingUtils.FakeClientRuleSets
+}
+
+func (c *fakeClientDroppedDirection) GetRules(ruleNamePrefix string) ([]*models.FirewallRule, error) {
+	rules, _ := c.FakeClientRuleSets.GetRules(ruleNamePrefix)
+	return append(rules, &models.FirewallRule{
+		Name:         "rule-egress",
+		SourceRanges: map[string]bool{"2.0.0.0/32": true},
+		Priority:     1,
+		Type:         models.Ban,
+		Direction:    models.Egress,
+	}), nil
+}
+
+func TestBouncer_UpdateDroppedDirection(t *testing.T) {
+	ruleSetsClient, _ := testingUtils.NewClientRuleSets()
+	f := &Bouncer{Client: &fakeClientDroppedDirection{ruleSetsClient}, RuleNamePrefix: "test-rule"}
+
+	err := f.Update(&csmodels.DecisionsStreamResponse{})
+	assert.NoError(t, err)
+
+	// the egress rule is no longer matched by any rule set and is deleted
+	assert.Equal(t, 1, len(ruleSetsClient.Deleted))
+	assert.Equal(t, "rule-egress", ruleSetsClient.Deleted[0].Name)
+	assert.Empty(t, ruleSetsClient.Patched)
+}
+
+type fakeClientReservedName struct {
+	*testingUtils.FakeClientRuleSets
+}
+
+func (c *fakeClientReservedName) GetRules(ruleNamePrefix string) ([]*models.FirewallRule, error) {
+	rules, _ := c.FakeClientRuleSets.GetRules(ruleNamePrefix)
+	return append(rules, &models.FirewallRule{Name: "test-rule-fake-client-rule-sets-0", Owner: models.ReservedNameOwner}), nil
+}
+
+func TestBouncer_UpdateReservedName(t *testing.T) {
+	ruleSetsClient, _ := testingUtils.NewClientRuleSets()
+	f := &Bouncer{Client: &fakeClientReservedName{ruleSetsClient}, RuleNamePrefix: "test-rule"}
+
+	err := f.Update(&csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{
+		newRoutedDecision("0.0.0.1", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h"),
+		newRoutedDecision("0.0.0.2", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h"),
+		newRoutedDecision("0.0.0.3", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h"),
+	}})
+	assert.NoError(t, err)
+
+	// the reserved name is not assigned to the new rule, and the reserved entry is neither patched nor deleted
+	assert.Equal(t, 1, len(ruleSetsClient.Created))
+	assert.Equal(t, "test-rule-fake-client-rule-sets-1", ruleSetsClient.Created[0].Name)
+	assert.Equal(t, 1, len(ruleSetsClient.Patched))
+	assert.Equal(t, "rule-ban", ruleSetsClient.Patched[0].Name)
+	assert.Empty(t, ruleSetsClient.Deleted)
+}
+
+type fakeClientFailingPatch struct {
+	*testingUtils.FakeClientRuleSets
+	err error
+}
+
+func (c *fakeClientFailingPatch) PatchRule(rule *models.FirewallRule) error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.FakeClientRuleSets.PatchRule(rule)
+}
+
+func TestBouncer_UpdateRetry(t *testing.T) {
+	ruleSetsClient, _ := testingUtils.NewClientRuleSets()
+	client := &fakeClientFailingPatch{ruleSetsClient, fmt.Errorf("QUOTA_EXCEEDED")}
+	f := &Bouncer{Client: client, RuleNamePrefix: "test-rule"}
+
+	ban := models.Ban
+	captcha := models.Captcha
+	source1 := "0.0.0.1"
+	source2 := "0.0.0.2"
+	err := f.Update(&csmodels.DecisionsStreamResponse{
+		New: csmodels.GetDecisionsResponse{
+			&csmodels.Decision{Value: &source1, Type: &ban},
+			&csmodels.Decision{Value: &source2, Type: &captcha},
+		},
+	})
+	assert.ErrorContains(t, err, "QUOTA_EXCEEDED")
+	// the captcha rule is still created
+	assert.Equal(t, 1, len(client.Created))
+	assert.True(t, f.HasPendingDecisions())
+
+	client.err = nil
+	err = f.Update(&csmodels.DecisionsStreamResponse{})
+	assert.NoError(t, err)
+	assert.False(t, f.HasPendingDecisions())
+	assert.Equal(t, 1, len(client.Patched))
+	assert.Equal(t, map[string]bool{"1.0.0.0/32": true, "0.0.0.1/32": true}, client.Patched[0].SourceRanges)
+}
+
+func Test_updateProviderFirewallRulesRollback(t *testing.T) {
+	ruleSetsClient, _ := testingUtils.NewClientRuleSets()
+	client := &fakeClientFailingPatch{ruleSetsClient, fmt.Errorf("invalid source range")}
+	f := &Bouncer{Client: client, RuleNamePrefix: "test-rule"}
+
+	rule := &models.FirewallRule{Name: "rule-ban", SourceRanges: map[string]bool{"1.0.0.0/32": true}}
+	sourceRanges := copySourceRanges([]*models.FirewallRule{rule})
+	rule.SourceRanges["0.0.0.1/32"] = true
+	rule.State = models.Modified
+
+	err := f.updateProviderFirewallRules([]*models.FirewallRule{rule}, sourceRanges)
+	assert.ErrorContains(t, err, "invalid source range")
+	assert.Equal(t, map[string]bool{"1.0.0.0/32": true}, rule.SourceRanges)
+	assert.Empty(t, rule.State)
+}
+
+func Test_mergeDecisions(t *testing.T) {
+	source1 := "0.0.0.1"
+	source2 := "0.0.0.2"
+	source3 := "0.0.0.3"
+	pending := &csmodels.DecisionsStreamResponse{
+		New:     csmodels.GetDecisionsResponse{&csmodels.Decision{Value: &source1}, &csmodels.Decision{Value: &source2}},
+		Deleted: csmodels.GetDecisionsResponse{&csmodels.Decision{Value: &source3}},
+	}
+	next := &csmodels.DecisionsStreamResponse{
+		New:     csmodels.GetDecisionsResponse{&csmodels.Decision{Value: &source3}},
+		Deleted: csmodels.GetDecisionsResponse{&csmodels.Decision{Value: &source1}},
+	}
+	merged := mergeDecisions(pending, next)
+	assert.Equal(t, map[string]bool{"0.0.0.2/32": true, "0.0.0.3/32": true}, convertDecisionsToMap(merged.New))
+	assert.Equal(t, map[string]bool{"0.0.0.1/32": true}, convertDecisionsToMap(merged.Deleted))
+	assert.Equal(t, next, mergeDecisions(nil, next))
+}
+
+func Test_mergeDecisionsTypes(t *testing.T) {
+	ban := models.Ban
+	captcha := models.Captcha
+	source := "0.0.0.1"
+	pending := &csmodels.DecisionsStreamResponse{
+		New:     csmodels.GetDecisionsResponse{&csmodels.Decision{Value: &source, Type: &ban}},
+		Deleted: csmodels.GetDecisionsResponse{&csmodels.Decision{Value: &source, Type: &captcha}},
+	}
+
+	// a decision of another type for the same source cancels nothing
+	merged := mergeDecisions(pending, &csmodels.DecisionsStreamResponse{
+		New:     csmodels.GetDecisionsResponse{&csmodels.Decision{Value: &source, Type: &ban}},
+		Deleted: csmodels.GetDecisionsResponse{&csmodels.Decision{Value: &source, Type: &captcha}},
+	})
+	assert.Equal(t, 2, len(merged.New))
+	assert.Equal(t, 2, len(merged.Deleted))
+
+	merged = mergeDecisions(pending, &csmodels.DecisionsStreamResponse{
+		New:     csmodels.GetDecisionsResponse{&csmodels.Decision{Value: &source, Type: &captcha}},
+		Deleted: csmodels.GetDecisionsResponse{&csmodels.Decision{Value: &source, Type: &ban}},
+	})
+	// a decision of the same type cancels the pending one
+	assert.Equal(t, 1, len(merged.New))
+	assert.Equal(t, captcha, *merged.New[0].Type)
+	assert.Equal(t, 1, len(merged.Deleted))
+	assert.Equal(t, ban, *merged.Deleted[0].Type)
+}
+
+type fakeClientOwnership struct {
+	*testingUtils.FakeClientRuleSets
+}
+
+func (c *fakeClientOwnership) RuleSets() []models.RuleSet {
+	return []models.RuleSet{{Type: models.Ban, Priority: 0, MaxRules: 3}}
+}
+
+func (c *fakeClientOwnership) MaxSourcesPerRule() int {
+	return 1
+}
+
+func (c *fakeClientOwnership) GetRules(ruleNamePrefix string) ([]*models.FirewallRule, error) {
+	return []*models.FirewallRule{
+		{
+			Name:         "test-rule-fake-client-rule-sets-0",
+			SourceRanges: map[string]bool{"1.0.0.0/32": true},
+			Owner:        "test-rule",
+		},
+		{
+			Name:         "test-rule-fake-client-rule-sets-1",
+			SourceRanges: map[string]bool{"1.0.0.1/32": true},
+			Priority:     1,
+			Owner:        "test-rule-fake",
+		},
+	}, nil
+}
+
+func TestBouncer_UpdateOwnership(t *testing.T) {
+	ruleSetsClient, _ := testingUtils.NewClientRuleSets()
+	client := &fakeClientOwnership{ruleSetsClient}
+	f := &Bouncer{Client: client, RuleNamePrefix: "test-rule"}
+
+	source1 := "1.0.0.1"
+	source2 := "0.0.0.2"
+	err := f.Update(&csmodels.DecisionsStreamResponse{
+		New: csmodels.GetDecisionsResponse{&csmodels.Decision{Value: &source1}, &csmodels.Decision{Value: &source2}},
+	})
+	assert.NoError(t, err)
+
+	// the rule of the other bouncer is neither patched nor counted, and new rule names skip its name
+	assert.Equal(t, 0, len(client.Patched))
+	assert.Equal(t, 2, len(client.Created))
+	assert.Equal(t, "test-rule-fake-client-rule-sets-2", client.Created[0].Name)
+	assert.Equal(t, "test-rule-fake-client-rule-sets-3", client.Created[1].Name)
+	assert.Equal(t, "test-rule", client.Created[0].Owner)
+}
+
+func TestBouncer_genNewRuleName(t *testing.T) {
+	client, _ := testingUtils.NewEmptyClient()
+	f := &Bouncer{Client: client, RuleNamePrefix: "crowdsec"}
+	assert.Equal(t, "crowdsec-fake-client-empty-0", f.genNewRuleName())
+	assert.Equal(t, "crowdsec-fake-client-empty-1", f.genNewRuleName())
+
+	f.ruleNames = map[string]bool{"crowdsec-fake-client-empty-0": true, "crowdsec-fake-client-empty-2": true}
+	assert.Equal(t, "crowdsec-fake-client-empty-1", f.genNewRuleName())
+	assert.Equal(t, "crowdsec-fake-client-empty-3", f.genNewRuleName())
+}
+
+func TestBouncer_Flush(t *testing.T) {
+	ruleSetsClient, _ := testingUtils.NewClientRuleSets()
+	client := &fakeClientOwnership{ruleSetsClient}
+	f := &Bouncer{Client: client, RuleNamePrefix: "test-rule"}
+
+	rules, err := f.GetManagedRules()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(rules))
+	assert.Equal(t, 0, len(client.Deleted))
+
+	deleted, err := f.Flush()
+	assert.NoError(t, err)
+	// the rule of the other bouncer is not deleted
+	assert.Equal(t, 1, deleted)
+	assert.Equal(t, 1, len(client.Deleted))
+	assert.Equal(t, "test-rule-fake-client-rule-sets-0", client.Deleted[0].Name)
+}
+
+func TestBouncer_ShutDown(t *testing.T) {
+	client, _ := testingUtils.NewClientRuleSets()
+	f := &Bouncer{Client: client, RuleNamePrefix: "test-rule"}
+	assert.NoError(t, f.ShutDown())
+	assert.Equal(t, 0, len(client.Deleted))
+
+	f.CleanupOnShutdown = true
+	assert.NoError(t, f.ShutDown())
+	assert.Equal(t, 1, len(client.Deleted))
+}
+
+type fakeClientPreflight struct {
+	*testingUtils.FakeClientRuleSets
+	checks []models.PreflightCheck
+}
+
+func (c *fakeClientPreflight) Preflight() []models.PreflightCheck {
+	return c.checks
+}
+
+func TestBouncer_Preflight(t *testing.T) {
+	ruleSetsClient, _ := testingUtils.NewClientRuleSets()
+	f := &Bouncer{Client: ruleSetsClient, RuleNamePrefix: "test-rule"}
+	// clients without pre-flight checks always pass
+	assert.NoError(t, f.Preflight())
+
+	f.Client = &fakeClientPreflight{ruleSetsClient, []models.PreflightCheck{{Name: "network"}, {Name: "permissions"}}}
+	assert.NoError(t, f.Preflight())
+
+	f.Client = &fakeClientPreflight{ruleSetsClient, []models.PreflightCheck{
+		{Name: "network", Err: fmt.Errorf("not found")},
+		{Name: "permissions"},
+	}}
+	assert.EqualError(t, f.Preflight(), "1 pre-flight check(s) failed: network: not found")
+}
+
+func TestBouncer_getTierRuleSets(t *testing.T) {
+	f := &Bouncer{Tiers: []models.DecisionTier{
+		{Name: "local", Origins: []string{"crowdsec", "cscli"}},
+		{Name: "lists", Origins: []string{"lists"}},
+		{Name: "capi"},
+	}}
+	ruleSets := f.getTierRuleSets([]models.RuleSet{
+		{Type: models.Ban, Priority: 100, MaxRules: 2, MaxPriority: 199},
+		{Type: models.Captcha, Priority: 102, MaxRules: 4, MaxPriority: 199},
+	})
+	// each tier gets a copy of the bands of both rule sets
+	assert.Equal(t, []models.RuleSet{
+		{Type: models.Ban, Priority: 100, MaxRules: 3, MaxPriority: 101, Tier: "local"},
+		{Type: models.Ban, Priority: 106, MaxRules: 3, MaxPriority: 107, Tier: "lists"},
+		{Type: models.Ban, Priority: 112, MaxRules: 3, MaxPriority: 113, Tier: "capi"},
+		{Type: models.Captcha, Priority: 102, MaxRules: 4, MaxPriority: 105, Tier: "local"},
+		{Type: models.Captcha, Priority: 108, MaxRules: 4, MaxPriority: 111, Tier: "lists"},
+		{Type: models.Captcha, Priority: 114, MaxRules: 4, MaxPriority: 117, Tier: "capi"},
+	}, ruleSets)
+
+	// the egress band follows the ingress band of each tier instead of sharing its priorities
+	f.Tiers = f.Tiers[1:]
+	ruleSets = f.getTierRuleSets([]models.RuleSet{
+		{Type: models.Ban, Priority: 100, MaxRules: 2, Direction: models.Ingress},
+		{Type: models.Ban, Priority: 100, MaxRules: 2, Direction: models.Egress},
+	})
+	assert.Equal(t, []models.RuleSet{
+		{Type: models.Ban, Priority: 100, MaxRules: 2, MaxPriority: 101, Direction: models.Ingress, Tier: "lists"},
+		{Type: models.Ban, Priority: 104, MaxRules: 2, MaxPriority: 105, Direction: models.Ingress, Tier: "capi"},
+		{Type: models.Ban, Priority: 102, MaxRules: 2, MaxPriority: 103, Direction: models.Egress, Tier: "lists"},
+		{Type: models.Ban, Priority: 106, MaxRules: 2, MaxPriority: 107, Direction: models.Egress, Tier: "capi"},
+	}, ruleSets)
+}
+
+type fakeClientTierRuleSets struct {
+	*testingUtils.FakeClientRuleSets
+	ruleSets []models.RuleSet
+}
+
+func (c *fakeClientTierRuleSets) RuleSets() []models.RuleSet {
+	return c.ruleSets
+}
+
+func TestBouncer_CheckTiers(t *testing.T) {
+	ruleSetsClient, _ := testingUtils.NewClientRuleSets()
+	client := &fakeClientTierRuleSets{ruleSetsClient, []models.RuleSet{
+		{Type: models.Ban, Priority: 100, MaxRules: 2, MaxPriority: 115},
+		{Type: models.Captcha, Priority: 102, MaxRules: 4, MaxPriority: 115},
+	}}
+	f := &Bouncer{Client: client}
+	assert.NoError(t, f.CheckTiers())
+
+	f.Tiers = []models.DecisionTier{{Name: "local", Origins: []string{"crowdsec"}}, {Name: "capi"}}
+	assert.NoError(t, f.CheckTiers())
+
+	f.Tiers = append([]models.DecisionTier{{Name: "cscli", Origins: []string{"cscli"}}}, f.Tiers...)
+	assert.EqualError(t, f.CheckTiers(), "the 3 tiers of the ingress captcha rules need priorities up to 117, above the priority_range max 115")
+}
+
+func TestBouncer_getDecisionTier(t *testing.T) {
+	f := &Bouncer{Tiers: []models.DecisionTier{
+		{Name: "local", Origins: []string{"crowdsec", "cscli"}},
+		{Name: "lists", Origins: []string{"lists"}},
+	}}
+	crowdsec := "crowdsec"
+	lists := "lists"
+	capi := "CAPI"
+	assert.Equal(t, "local", f.getDecisionTier(&csmodels.Decision{Origin: &crowdsec}))
+	assert.Equal(t, "lists", f.getDecisionTier(&csmodels.Decision{Origin: &lists}))
+	// decisions matching no tier belong to the last tier
+	assert.Equal(t, "lists", f.getDecisionTier(&csmodels.Decision{Origin: &capi}))
+	assert.Equal(t, "lists", f.getDecisionTier(&csmodels.Decision{}))
+	assert.Equal(t, "", (&Bouncer{}).getDecisionTier(&csmodels.Decision{Origin: &crowdsec}))
+}
+
+// fakeClientTiers is a fake client with a single ban rule set, whose rules are changed by the updates.
+type fakeClientTiers struct {
+	*testingUtils.FakeClientRuleSets
+	rules map[string]*models.FirewallRule
+}
+
+func newFakeClientTiers() *fakeClientTiers {
+	ruleSetsClient, _ := testingUtils.NewClientRuleSets()
+	return &fakeClientTiers{ruleSetsClient, map[string]*models.FirewallRule{
+		"rule-local": {Name: "rule-local", SourceRanges: map[string]bool{"1.0.0.0/32": true}, Priority: 0, Type: models.Ban},
+		"rule-capi": {
+			Name:         "rule-capi",
+			SourceRanges: map[string]bool{"2.0.0.1/32": true, "2.0.0.2/32": true, "2.0.0.3/32": true},
+			Priority:     2,
+			Type:         models.Ban,
+		},
+	}}
+}
+
+func (c *fakeClientTiers) RuleSets() []models.RuleSet {
+	return []models.RuleSet{{Type: models.Ban, Priority: 0, MaxRules: 2}}
+}
+
+func (c *fakeClientTiers) GetRules(ruleNamePrefix string) ([]*models.FirewallRule, error) {
+	rules := []*models.FirewallRule{}
+	for _, rule := range c.rules {
+		sourceRanges := make(map[string]bool)
+		for source := range rule.SourceRanges {
+			sourceRanges[source] = true
+		}
+		rules = append(rules, &models.FirewallRule{Name: rule.Name, SourceRanges: sourceRanges, Priority: rule.Priority, Type: rule.Type})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Priority < rules[j].Priority
+	})
+	return rules, nil
+}
+
+func (c *fakeClientTiers) CreateRule(rule *models.FirewallRule) error {
+	c.rules[rule.Name] = rule
+	return c.FakeClientRuleSets.CreateRule(rule)
+}
+
+func (c *fakeClientTiers) PatchRule(rule *models.FirewallRule) error {
+	c.rules[rule.Name] = rule
+	return c.FakeClientRuleSets.PatchRule(rule)
+}
+
+func (c *fakeClientTiers) DeleteRule(rule *models.FirewallRule) error {
+	delete(c.rules, rule.Name)
+	return c.FakeClientRuleSets.DeleteRule(rule)
+}
+
+func TestBouncer_UpdateTiers(t *testing.T) {
+	client := newFakeClientTiers()
+	f := &Bouncer{
+		Client:         client,
+		RuleNamePrefix: "test-rule",
+		Tiers:          []models.DecisionTier{{Name: "local", Origins: []string{"crowdsec"}}, {Name: "capi"}},
+	}
+
+	ban := models.Ban
+	crowdsec := "crowdsec"
+	capi := "CAPI"
+	source1 := "0.0.0.1"
+	source2 := "0.0.0.2"
+	source3 := "0.0.0.3"
+	source4 := "0.0.0.4"
+	decisionsStream := &csmodels.DecisionsStreamResponse{
+		New: csmodels.GetDecisionsResponse{
+			&csmodels.Decision{Value: &source1, Type: &ban, Origin: &crowdsec},
+			&csmodels.Decision{Value: &source2, Type: &ban, Origin: &crowdsec},
+			&csmodels.Decision{Value: &source3, Type: &ban, Origin: &crowdsec},
+			&csmodels.Decision{Value: &source4, Type: &ban, Origin: &capi},
+		},
+	}
+	err := f.Update(decisionsStream)
+	assert.NoError(t, err)
+
+	// the local rule is filled and the capi rule is evicted to make room for a second local rule
+	assert.Equal(t, 1, len(client.Patched))
+	assert.Equal(t, "rule-local", client.Patched[0].Name)
+	assert.Equal(t, 3, len(client.Patched[0].SourceRanges))
+	assert.Equal(t, 1, len(client.Deleted))
+	assert.Equal(t, "rule-capi", client.Deleted[0].Name)
+	assert.Equal(t, 1, len(client.Created))
+	assert.Equal(t, int64(1), client.Created[0].Priority)
+	assert.Equal(t, 1, len(client.Created[0].SourceRanges))
+
+	// the capi decision is dropped, the capacity being used by the local tier
+	for _, rule := range append(client.Patched, client.Created...) {
+		assert.False(t, rule.SourceRanges["0.0.0.4/32"])
+	}
+
+	// the evicted sources are added again once the local decisions of the second rule are deleted
+	client.Created, client.Patched, client.Deleted = nil, nil, nil
+	err = f.Update(&csmodels.DecisionsStreamResponse{Deleted: decisionsStream.New[:3]})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(client.Created))
+	assert.Equal(t, int64(2), client.Created[0].Priority)
+	assert.Equal(t, map[string]bool{"2.0.0.1/32": true, "2.0.0.2/32": true, "2.0.0.3/32": true}, client.Created[0].SourceRanges)
+	assert.Empty(t, f.evictedSources)
+}
@@ -0,0 +1,149 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	csmodels "github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// route is a decision route whose durations and ranges are parsed.
+type route struct {
+	models.DecisionRoute
+	minDuration time.Duration
+	maxDuration time.Duration
+	networks    []*net.IPNet
+}
+
+// Router selects the providers of each decision with the first matching route. Decisions matching no route are sent
+// to all the providers.
+type Router struct {
+	routes []*route
+}
+
+// NewRouter returns the router of the routes, or an error if a duration or a range of a route is invalid.
+func NewRouter(routes []models.DecisionRoute) (*Router, error) {
+	router := &Router{}
+	for i, decisionRoute := range routes {
+		r := &route{DecisionRoute: decisionRoute}
+		var err error
+		if decisionRoute.MinDuration != "" {
+			if r.minDuration, err = time.ParseDuration(decisionRoute.MinDuration); err != nil {
+				return nil, fmt.Errorf("route %d: invalid min_duration %s: %s", i, decisionRoute.MinDuration, err)
+			}
+		}
+		if decisionRoute.MaxDuration != "" {
+			if r.maxDuration, err = time.ParseDuration(decisionRoute.MaxDuration); err != nil {
+				return nil, fmt.Errorf("route %d: invalid max_duration %s: %s", i, decisionRoute.MaxDuration, err)
+			}
+		}
+		for _, cidr := range decisionRoute.CIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: invalid cidr %s: %s", i, cidr, err)
+			}
+			r.networks = append(r.networks, network)
+		}
+		router.routes = append(router.routes, r)
+	}
+	return router, nil
+}
+
+// matchesScope returns true if the scope of the decision is one of the scopes. Decisions without scope are IP decisions.
+func matchesScope(scopes []string, decision *csmodels.Decision) bool {
+	scope := "ip"
+	if decision.Scope != nil && *decision.Scope != "" {
+		scope = *decision.Scope
+	}
+	for _, s := range scopes {
+		if strings.EqualFold(s, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesNetworks returns true if the IP or range of the decision is contained in one of the networks.
+func matchesNetworks(networks []*net.IPNet, decision *csmodels.Decision) bool {
+	if models.GetScope(decision.Scope) != models.IPScope || decision.Value == nil {
+		return false
+	}
+	_, decisionNetwork, err := net.ParseCIDR(models.GetSource(models.IPScope, *decision.Value))
+	if err != nil {
+		return false
+	}
+	decisionOnes, _ := decisionNetwork.Mask.Size()
+	for _, network := range networks {
+		ones, _ := network.Mask.Size()
+		if network.Contains(decisionNetwork.IP) && decisionOnes >= ones {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesDuration returns true if the remaining duration of the decision is within the bounds of the route.
+func (r *route) matchesDuration(decision *csmodels.Decision) bool {
+	if r.minDuration == 0 && r.maxDuration == 0 {
+		return true
+	}
+	if decision.Duration == nil {
+		return false
+	}
+	duration, err := time.ParseDuration(*decision.Duration)
+	if err != nil {
+		return false
+	}
+	return duration >= r.minDuration && (r.maxDuration == 0 || duration <= r.maxDuration)
+}
+
+// matches returns true if the decision matches all the matchers of the route.
+func (r *route) matches(decision *csmodels.Decision) bool {
+	decisionType := models.Ban
+	if decision.Type != nil {
+		decisionType = *decision.Type
+	}
+	return (len(r.Scenarios) == 0 || matchesAny(r.Scenarios, decision.Scenario)) &&
+		(len(r.Origins) == 0 || matchesAny(r.Origins, decision.Origin)) &&
+		(len(r.Scopes) == 0 || matchesScope(r.Scopes, decision)) &&
+		(len(r.Types) == 0 || matchesAny(r.Types, &decisionType)) &&
+		(len(r.networks) == 0 || matchesNetworks(r.networks, decision)) &&
+		r.matchesDuration(decision)
+}
+
+// isRouted returns true if the decision is sent to the provider.
+func (r *Router) isRouted(decision *csmodels.Decision, provider string) bool {
+	for _, route := range r.routes {
+		if !route.matches(decision) {
+			continue
+		}
+		for _, p := range route.Providers {
+			if p == provider {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Route returns the decisions of the stream sent to the provider. Deleted decisions are sent to all the providers, so
+// that a decision is removed even if the routes changed since it was added.
+func (r *Router) Route(decisions *csmodels.DecisionsStreamResponse, provider string) *csmodels.DecisionsStreamResponse {
+	if r == nil || len(r.routes) == 0 {
+		return decisions
+	}
+	routed := &csmodels.DecisionsStreamResponse{Deleted: decisions.Deleted, New: csmodels.GetDecisionsResponse{}}
+	for _, decision := range decisions.New {
+		if r.isRouted(decision, provider) {
+			routed.New = append(routed.New, decision)
+		} else {
+			log.Debugf("decision %s is not routed to %s", *decision.Value, provider)
+		}
+	}
+	return routed
+}
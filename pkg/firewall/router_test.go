@@ -0,0 +1,69 @@
+package firewall
+
+import (
+	"testing"
+
+	csmodels "github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRoutedDecision(value string, scope string, scenario string, origin string, duration string) *csmodels.Decision {
+	decisionType := models.Ban
+	return &csmodels.Decision{Value: &value, Scope: &scope, Scenario: &scenario, Origin: &origin, Duration: &duration, Type: &decisionType}
+}
+
+func TestRouter_Route(t *testing.T) {
+	router, err := NewRouter([]models.DecisionRoute{
+		{Scenarios: []string{"crowdsecurity/http-*"}, Providers: []string{"cloudarmor"}},
+		{Scenarios: []string{"crowdsecurity/ssh-*"}, MinDuration: "1h", Providers: []string{"gcp"}},
+		{CIDRs: []string{"10.0.0.0/8"}, Providers: []string{}},
+		{Origins: []string{"lists", "CAPI"}, Scopes: []string{"ip"}, Providers: []string{"aws"}},
+	})
+	assert.NoError(t, err)
+
+	httpDecision := newRoutedDecision("1.0.0.1", "Ip", "crowdsecurity/http-probing", "crowdsec", "4h")
+	sshDecision := newRoutedDecision("1.0.0.2", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h")
+	shortSSHDecision := newRoutedDecision("1.0.0.3", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "30m")
+	privateDecision := newRoutedDecision("10.1.0.0/16", "Range", "crowdsecurity/port-scan", "crowdsec", "4h")
+	capiDecision := newRoutedDecision("1.0.0.4", "Ip", "crowdsecurity/port-scan", "CAPI", "4h")
+	capiRangeDecision := newRoutedDecision("1.0.1.0/24", "Range", "crowdsecurity/port-scan", "CAPI", "4h")
+	stream := &csmodels.DecisionsStreamResponse{
+		New:     csmodels.GetDecisionsResponse{httpDecision, sshDecision, shortSSHDecision, privateDecision, capiDecision, capiRangeDecision},
+		Deleted: csmodels.GetDecisionsResponse{newRoutedDecision("1.0.0.5", "Ip", "crowdsecurity/http-probing", "crowdsec", "-1s")},
+	}
+
+	tests := []struct {
+		provider string
+		want     []*csmodels.Decision
+	}{
+		{provider: "cloudarmor", want: []*csmodels.Decision{httpDecision, shortSSHDecision, capiRangeDecision}},
+		{provider: "gcp", want: []*csmodels.Decision{sshDecision, shortSSHDecision, capiRangeDecision}},
+		{provider: "aws", want: []*csmodels.Decision{shortSSHDecision, capiDecision, capiRangeDecision}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			routed := router.Route(stream, tt.provider)
+			assert.Equal(t, tt.want, []*csmodels.Decision(routed.New))
+			assert.Equal(t, stream.Deleted, routed.Deleted)
+		})
+	}
+}
+
+func TestRouter_RouteWithoutRoutes(t *testing.T) {
+	router, err := NewRouter(nil)
+	assert.NoError(t, err)
+	stream := &csmodels.DecisionsStreamResponse{New: csmodels.GetDecisionsResponse{newRoutedDecision("1.0.0.1", "Ip", "crowdsecurity/ssh-bf", "crowdsec", "4h")}}
+	assert.Equal(t, stream, router.Route(stream, "gcp"))
+}
+
+func TestNewRouterInvalidRoutes(t *testing.T) {
+	for _, route := range []models.DecisionRoute{
+		{MinDuration: "1 hour"},
+		{MaxDuration: "1d"},
+		{CIDRs: []string{"10.0.0.0"}},
+	} {
+		_, err := NewRouter([]models.DecisionRoute{route})
+		assert.Error(t, err, "route %+v", route)
+	}
+}
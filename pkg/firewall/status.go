@@ -0,0 +1,126 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+)
+
+// RuleStatus describes a rule owned by the bouncer.
+type RuleStatus struct {
+	Provider   string   `json:"provider"`
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Scope      string   `json:"scope,omitempty"`
+	Direction  string   `json:"direction"`
+	Tier       string   `json:"tier,omitempty"`
+	Priority   int64    `json:"priority"`
+	Sources    int      `json:"sources"`
+	MaxSources int      `json:"max_sources"`
+	SourceList []string `json:"source_list,omitempty"`
+}
+
+// ProviderStatus describes the rules owned by the bouncer at a provider and their utilisation.
+type ProviderStatus struct {
+	Provider   string       `json:"provider"`
+	Rules      []RuleStatus `json:"rules"`
+	MaxRules   int          `json:"max_rules"`
+	Sources    int          `json:"sources"`
+	MaxSources int          `json:"max_sources"`
+}
+
+// getRuleRuleSet returns the rule set the rule belongs to. It returns false if the rule does not belong to any rule
+// set, for instance when the configuration changed since the rule was created.
+func getRuleRuleSet(rule *models.FirewallRule, ruleSets []models.RuleSet) (models.RuleSet, bool) {
+	for _, ruleSet := range ruleSets {
+		if len(filterRules([]*models.FirewallRule{rule}, ruleSet)) > 0 {
+			return ruleSet, true
+		}
+	}
+	return models.RuleSet{}, false
+}
+
+// getRuleStatus returns the status of the rule. The source list is only included with withSources.
+func (f *Bouncer) getRuleStatus(rule *models.FirewallRule, ruleSets []models.RuleSet, withSources bool) RuleStatus {
+	maxSources := f.Client.MaxSourcesPerRule()
+	tier := ""
+	if ruleSet, ok := getRuleRuleSet(rule, ruleSets); ok {
+		maxSources = f.getMaxSourcesPerRule(ruleSet)
+		tier = ruleSet.Tier
+	}
+	status := RuleStatus{
+		Provider:   f.Client.GetProviderName(),
+		Name:       rule.Name,
+		Type:       getRuleType(rule),
+		Scope:      rule.Scope,
+		Direction:  models.GetDirection(rule.Direction),
+		Tier:       tier,
+		Priority:   rule.Priority,
+		Sources:    len(rule.SourceRanges),
+		MaxSources: maxSources,
+	}
+	if withSources {
+		status.SourceList = models.ConvertSourceRangesMapToSlice(rule.SourceRanges)
+		sort.Strings(status.SourceList)
+	}
+	return status
+}
+
+// Status returns the rules owned by the bouncer, sorted by priority, along with the number of sources they contain
+// compared to the capacity of the rule sets. The source lists are only included with withSources.
+func (f *Bouncer) Status(withSources bool) (*ProviderStatus, error) {
+	rules, err := f.GetManagedRules()
+	if err != nil {
+		return nil, err
+	}
+	ruleSets := f.getRuleSets()
+	status := &ProviderStatus{Provider: f.Client.GetProviderName(), Rules: []RuleStatus{}}
+	for _, ruleSet := range ruleSets {
+		// the tiers of a rule set share its capacity, which is only counted once
+		if ruleSet.Tier != "" && ruleSet.Tier != f.Tiers[0].Name {
+			continue
+		}
+		status.MaxRules += ruleSet.MaxRules
+		status.MaxSources += ruleSet.MaxRules * f.getMaxSourcesPerRule(ruleSet)
+	}
+	for _, rule := range rules {
+		ruleStatus := f.getRuleStatus(rule, ruleSets, withSources)
+		status.Rules = append(status.Rules, ruleStatus)
+		status.Sources += ruleStatus.Sources
+	}
+	sort.Slice(status.Rules, func(i, j int) bool {
+		return status.Rules[i].Priority < status.Rules[j].Priority
+	})
+	return status, nil
+}
+
+// Lookup returns the rules owned by the bouncer containing the IP address, sorted by priority.
+func (f *Bouncer) Lookup(address string) ([]RuleStatus, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("%s is not a valid IP address", address)
+	}
+	rules, err := f.GetManagedRules()
+	if err != nil {
+		return nil, err
+	}
+	ruleSets := f.getRuleSets()
+	found := []RuleStatus{}
+	for _, rule := range rules {
+		if rule.Scope != models.IPScope {
+			continue
+		}
+		for source := range rule.SourceRanges {
+			if _, cidr, err := net.ParseCIDR(models.GetCIDR(source)); err == nil && cidr.Contains(ip) {
+				found = append(found, f.getRuleStatus(rule, ruleSets, false))
+				break
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Priority < found[j].Priority
+	})
+	return found, nil
+}
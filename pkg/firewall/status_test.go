@@ -0,0 +1,95 @@
+package firewall
+
+import (
+	"testing"
+
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	testingUtils "github.com/fallard84/cs-cloud-firewall-bouncer/pkg/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClientStatus struct {
+	*testingUtils.FakeClientRuleSets
+}
+
+func (c *fakeClientStatus) GetRules(ruleNamePrefix string) ([]*models.FirewallRule, error) {
+	return []*models.FirewallRule{
+		{
+			Name:         "test-rule-fake-client-rule-sets-1",
+			SourceRanges: map[string]bool{"1.0.0.2/32": true},
+			Priority:     100,
+			Type:         models.Captcha,
+		},
+		{
+			Name:         "test-rule-fake-client-rule-sets-0",
+			SourceRanges: map[string]bool{"1.0.0.1/32": true, "10.0.0.0/8": true},
+			Priority:     0,
+		},
+		{
+			Name:         "test-rule-other-0",
+			SourceRanges: map[string]bool{"10.0.0.1/32": true},
+			Priority:     1,
+			Owner:        models.ForeignOwner,
+		},
+	}, nil
+}
+
+func TestBouncer_Status(t *testing.T) {
+	ruleSetsClient, _ := testingUtils.NewClientRuleSets()
+	f := &Bouncer{Client: &fakeClientStatus{ruleSetsClient}, RuleNamePrefix: "test-rule"}
+
+	status, err := f.Status(false)
+	assert.NoError(t, err)
+	assert.Equal(t, "fake-client-rule-sets", status.Provider)
+	assert.Equal(t, 4, status.MaxRules)
+	assert.Equal(t, 12, status.MaxSources)
+	assert.Equal(t, 3, status.Sources)
+	assert.Equal(t, 2, len(status.Rules))
+	assert.Equal(t, RuleStatus{
+		Provider:   "fake-client-rule-sets",
+		Name:       "test-rule-fake-client-rule-sets-0",
+		Type:       models.Ban,
+		Direction:  models.Ingress,
+		Priority:   0,
+		Sources:    2,
+		MaxSources: 3,
+	}, status.Rules[0])
+	assert.Equal(t, models.Captcha, status.Rules[1].Type)
+
+	status, err = f.Status(true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1.0.0.1/32", "10.0.0.0/8"}, status.Rules[0].SourceList)
+}
+
+func TestBouncer_Lookup(t *testing.T) {
+	ruleSetsClient, _ := testingUtils.NewClientRuleSets()
+	f := &Bouncer{Client: &fakeClientStatus{ruleSetsClient}, RuleNamePrefix: "test-rule"}
+
+	tests := []struct {
+		name    string
+		address string
+		want    []string
+		wantErr bool
+	}{
+		{name: "single-address", address: "1.0.0.2", want: []string{"test-rule-fake-client-rule-sets-1"}},
+		{name: "in-range", address: "10.1.2.3", want: []string{"test-rule-fake-client-rule-sets-0"}},
+		{name: "foreign-rule-ignored", address: "10.0.0.1", want: []string{"test-rule-fake-client-rule-sets-0"}},
+		{name: "not-found", address: "2.0.0.1", want: []string{}},
+		{name: "invalid-address", address: "not-an-ip", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := f.Lookup(tt.address)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			names := []string{}
+			for _, rule := range rules {
+				names = append(names, rule.Name)
+			}
+			assert.Equal(t, tt.want, names)
+		})
+	}
+}
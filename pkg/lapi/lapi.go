@@ -0,0 +1,86 @@
+// Package lapi connects the bouncer to the CrowdSec Local API.
+package lapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
+	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/config"
+)
+
+// getTLSConfig returns the TLS configuration of the connection to the LAPI: the CA certificate verifying the LAPI
+// certificate, in addition to the system CAs, and the client certificate, if any.
+func getTLSConfig(config *config.BouncerConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CACertPath != "" {
+		caCert, err := ioutil.ReadFile(config.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca_cert_path: %s", err)
+		}
+		caCertPool, err := x509.SystemCertPool()
+		if err != nil || caCertPool == nil {
+			caCertPool = x509.NewCertPool()
+		}
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificate found in ca_cert_path %s", config.CACertPath)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	if config.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertPath, config.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// NewHTTPClient returns the HTTP client of the LAPI. Requests are authenticated with the API key, and with the client
+// certificate if any, so that certificate authentication can be used without API key.
+func NewHTTPClient(config *config.BouncerConfig) (*http.Client, error) {
+	tlsConfig, err := getTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if config.APIKey == "" {
+		return &http.Client{Transport: transport}, nil
+	}
+	apiKeyTransport := &apiclient.APIKeyTransport{APIKey: config.APIKey, Transport: transport}
+	return apiKeyTransport.Client(), nil
+}
+
+// NewStreamBouncer returns the bouncer streaming the decisions of the LAPI. The API client of the stream bouncer only
+// supports API keys, so it is replaced by a client using the TLS settings of the configuration.
+func NewStreamBouncer(config *config.BouncerConfig, userAgent string) (*csbouncer.StreamBouncer, error) {
+	bouncer := &csbouncer.StreamBouncer{
+		APIKey:         config.APIKey,
+		APIUrl:         config.APIUrl,
+		TickerInterval: config.UpdateFrequency,
+		UserAgent:      userAgent,
+	}
+	if err := bouncer.Init(); err != nil {
+		return nil, err
+	}
+	apiURL, err := url.Parse(config.APIUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid api_url %s: %s", config.APIUrl, err)
+	}
+	httpClient, err := NewHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	bouncer.APIClient, err = apiclient.NewDefaultClient(apiURL, "v1", userAgent, httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("api client init: %s", err)
+	}
+	return bouncer, nil
+}
@@ -0,0 +1,115 @@
+package lapi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeClientCert writes a self-signed client certificate and its key, and returns the parsed certificate.
+func writeClientCert(t *testing.T, certPath string, keyPath string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bouncer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+func TestNewStreamBouncer(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "bouncer.pem")
+	keyPath := filepath.Join(dir, "bouncer-key.pem")
+	caPath := filepath.Join(dir, "ca.pem")
+	clientCert := writeClientCert(t, certPath, keyPath)
+
+	var gotAPIKey string
+	var gotClientCerts int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAPIKey = r.Header.Get("X-Api-Key")
+		gotClientCerts = len(r.TLS.PeerCertificates)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"new": [], "deleted": []}`))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	assert.NoError(t, ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+
+	tests := []struct {
+		name      string
+		config    config.BouncerConfig
+		wantKey   string
+		wantCerts int
+		wantErr   bool
+	}{
+		{name: "client-certificate", config: config.BouncerConfig{CACertPath: caPath, CertPath: certPath, KeyPath: keyPath}, wantCerts: 1},
+		{name: "api-key", config: config.BouncerConfig{CACertPath: caPath, APIKey: "key"}, wantKey: "key"},
+		{name: "insecure-skip-verify", config: config.BouncerConfig{InsecureSkipVerify: true, APIKey: "key"}, wantKey: "key"},
+		{name: "unknown-authority", config: config.BouncerConfig{APIKey: "key"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotAPIKey, gotClientCerts = "", 0
+			tt.config.APIUrl = server.URL + "/"
+			tt.config.UpdateFrequency = "10s"
+			bouncer, err := NewStreamBouncer(&tt.config, "test")
+			assert.NoError(t, err)
+			_, _, err = bouncer.APIClient.Decisions.GetStream(context.Background(), true)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantKey, gotAPIKey)
+			assert.Equal(t, tt.wantCerts, gotClientCerts)
+		})
+	}
+}
+
+func TestNewHTTPClientInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	invalidPath := filepath.Join(dir, "invalid.pem")
+	assert.NoError(t, ioutil.WriteFile(invalidPath, []byte("not a certificate"), 0600))
+
+	for _, c := range []config.BouncerConfig{
+		{CACertPath: filepath.Join(dir, "missing.pem")},
+		{CACertPath: invalidPath},
+		{CertPath: invalidPath, KeyPath: invalidPath},
+	} {
+		_, err := NewHTTPClient(&c)
+		assert.Error(t, err, "config %+v", c)
+	}
+}
@@ -0,0 +1,10 @@
+package models
+
+// ExpansionConfig represents the expansion of Country and AS scoped decisions into IP ranges
+// for the cloud providers that only support IP addresses and ranges.
+type ExpansionConfig struct {
+	// Databases are the MaxMind or IPinfo MMDB files mapping networks to countries and/or AS numbers.
+	Databases []string `yaml:"databases"`
+	// MaxPrefixes is the maximum number of IP ranges a single decision can be expanded into.
+	MaxPrefixes int `yaml:"max_prefixes"`
+}
@@ -3,6 +3,8 @@ package models
 import (
 	"fmt"
 	"net"
+	"regexp"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -16,6 +18,52 @@ const (
 	Modified ruleState = "modified"
 )
 
+const (
+	// Ban is the decision type blocking the source
+	Ban = "ban"
+	// Captcha is the decision type challenging the source with a captcha
+	Captcha = "captcha"
+)
+
+const (
+	// IPScope is the scope of rules matching source IP addresses and ranges
+	IPScope = ""
+	// CountryScope is the scope of rules matching source countries
+	CountryScope = "Country"
+	// ASScope is the scope of rules matching source autonomous systems
+	ASScope = "AS"
+)
+
+const (
+	// Ingress is the direction of rules blocking the traffic coming from the sources
+	Ingress = "ingress"
+	// Egress is the direction of rules blocking the traffic going to the sources
+	Egress = "egress"
+	// Both is the provider direction setting blocking the sources in both directions
+	Both = "both"
+)
+
+// ForeignOwner is the owner of the rules that were not created by a bouncer. They are never updated and their
+// priorities are never assigned to new rules.
+const ForeignOwner = "*"
+
+// ReservedNameOwner is the owner of the rules that are outside of the scope of the bouncer, such as the rules of another
+// network, but whose names must not be assigned to new rules because rule names are unique across that scope.
+// They are otherwise ignored.
+const ReservedNameOwner = "#"
+
+// legacyRuleNameWord matches a random word of the legacy rule names. The diceware word lists contain a single
+// hyphenated word, yo-yo.
+const legacyRuleNameWord = `(?:[a-z]+|yo-yo)`
+
+// IsLegacyRuleName returns true if the name has the format of the rules created by the bouncer before ownership
+// markers: the rule name prefix followed by two random words, such as crowdsec-bingo-jumbo or crowdsec-yo-yo-jumbo.
+// The legacy rules of a bouncer whose prefix starts with the same prefix, such as crowdsec-prod-bingo-jumbo, have more
+// words and do not match.
+func IsLegacyRuleName(prefix string, name string) bool {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(prefix) + `-` + legacyRuleNameWord + `-` + legacyRuleNameWord + `$`).MatchString(name)
+}
+
 // FirewallRule represents a cloud agnostic firewall rule
 type FirewallRule struct {
 	// Name identifies the firewall rule name
@@ -26,6 +74,133 @@ type FirewallRule struct {
 	// An empty State will result in noop when updating the rule at the cloud provider.
 	State    ruleState
 	Priority int64
+	// Type is the decision type enforced by the rule. An empty Type is considered a ban.
+	Type string
+	// Scope is the scope of the sources matched by the rule.
+	// SourceRanges contains country codes for the CountryScope and AS numbers for the ASScope.
+	Scope string
+	// Direction is the direction of the traffic blocked by the rule. An empty Direction is considered ingress.
+	// SourceRanges contains the destinations of the egress rules.
+	Direction string
+	// Owner is the rule name prefix of the bouncer owning the rule, as recorded in the ownership marker of the rule.
+	// Rules owned by another bouncer are never updated. An empty Owner is considered owned.
+	Owner string
+}
+
+// RuleSet represents a group of firewall rules enforcing the same decision type within their own priority range.
+type RuleSet struct {
+	// Type is the decision type enforced by the rules of the set.
+	Type string
+	// Priority is the lowest priority that will be assigned to the rules of the set.
+	Priority int64
+	// MaxRules is the maximum number of rules that will be created in the set.
+	MaxRules int
+	// Scope is the scope of the sources matched by the rules of the set.
+	Scope string
+	// MaxSourcesPerRule is the maximum number of sources a rule of the set can contain.
+	// Defaults to the MaxSourcesPerRule of the cloud client.
+	MaxSourcesPerRule int
+	// Direction is the direction of the traffic blocked by the rules of the set. An empty Direction is considered ingress.
+	Direction string
+	// MaxPriority is the highest priority that can be assigned to the rules of the set. Priorities are not bounded when 0.
+	MaxPriority int64
+	// Tier is the name of the decision tier enforced by the rules of the set, which have their own priority band.
+	// Rule sets are not split by tiers when empty.
+	Tier string
+}
+
+// PriorityRange represents the range of priorities the rules of a provider can be assigned. The range is not set when Max is 0.
+type PriorityRange struct {
+	Min int64 `yaml:"min"`
+	Max int64 `yaml:"max"`
+}
+
+// Contains returns true if the range is not set or if the priority is within the range.
+func (r PriorityRange) Contains(priority int64) bool {
+	return r.Max == 0 || (priority >= r.Min && priority <= r.Max)
+}
+
+// DecisionFilter matches decisions on their origin or scenario. Values can contain shell patterns such as lists:*.
+type DecisionFilter struct {
+	Origins   []string `yaml:"origins"`
+	Scenarios []string `yaml:"scenarios"`
+}
+
+// BatchConfig represents the batching of the decisions sent to a provider. The decisions are accumulated during the
+// flush window, or until there are MaxBatchSize of them, and applied in a single update. Decisions are applied at each
+// update when FlushWindow is empty.
+type BatchConfig struct {
+	// FlushWindow is the longest time a decision waits before being applied, such as 30s.
+	FlushWindow  string `yaml:"flush_window"`
+	MaxBatchSize int    `yaml:"max_batch_size"`
+	// Immediate matches the decisions applied immediately, along with the decisions waiting in the batch.
+	Immediate DecisionFilter `yaml:"immediate"`
+}
+
+// DurationPolicy bounds the duration of the enforced decisions. Durations are such as 24h, and are not bounded when empty.
+type DurationPolicy struct {
+	// MinDuration is the shortest decision enforced. Shorter decisions are ignored.
+	MinDuration string `yaml:"min_duration"`
+	// MaxDuration is the longest time a decision is enforced. Longer decisions are removed by the bouncer once expired.
+	// The time is kept in memory, so it starts again when the bouncer is restarted.
+	MaxDuration string `yaml:"max_duration"`
+	// HoldDown delays the removal of the decisions, so that a source banned again shortly after is not removed then
+	// added back. The removals held down are applied when the bouncer stops.
+	HoldDown string `yaml:"hold_down"`
+}
+
+// DecisionTier groups the decisions of some origins, such as local decisions, whose rules are evaluated before the rules
+// of the next tiers and are kept when the capacity is exhausted by the next tiers.
+type DecisionTier struct {
+	Name string `yaml:"name"`
+	// Origins are the origins of the decisions of the tier, which can contain shell patterns. The tier contains all the
+	// remaining decisions when empty.
+	Origins []string `yaml:"origins"`
+}
+
+// DecisionRoute sends the decisions matching all its set matchers to a list of providers. Values of the lists can
+// contain shell patterns such as crowdsecurity/http-*, and a decision matches a list if it matches any of its values.
+type DecisionRoute struct {
+	Scenarios []string `yaml:"scenarios"`
+	Origins   []string `yaml:"origins"`
+	// Scopes are the decision scopes, such as Ip, Range, Country or AS, compared case-insensitively.
+	Scopes []string `yaml:"scopes"`
+	Types  []string `yaml:"types"`
+	// MinDuration and MaxDuration bound the remaining duration of the decisions, such as 24h.
+	MinDuration string `yaml:"min_duration"`
+	MaxDuration string `yaml:"max_duration"`
+	// CIDRs match the IP and range decisions contained in one of the ranges.
+	CIDRs []string `yaml:"cidrs"`
+	// Providers are the names of the providers receiving the matching decisions. None receives them when empty.
+	Providers []string `yaml:"providers"`
+}
+
+// PreflightCheck is the result of a check, run before processing decisions, of a resource or permission needed by a
+// cloud client. The check passed if Err is nil.
+type PreflightCheck struct {
+	// Name describes what is checked, such as the resource or the permissions.
+	Name string
+	Err  error
+}
+
+// GetDirection returns the direction of a rule or rule set, defaulting to ingress.
+func GetDirection(direction string) string {
+	if direction == "" {
+		return Ingress
+	}
+	return direction
+}
+
+// GetDirections returns the directions of the rules of a provider for its direction setting.
+func GetDirections(direction string) []string {
+	switch direction {
+	case Both:
+		return []string{Ingress, Egress}
+	case Egress:
+		return []string{Egress}
+	default:
+		return []string{Ingress}
+	}
 }
 
 // ConvertSourceRangesMapToSlice Convert SourceRanges map to slice
@@ -46,6 +221,35 @@ func ConvertSourceRangesSliceToMap(sourceRanges []string) map[string]bool {
 	return m
 }
 
+// GetScope returns the scope of the rules matching a decision scope.
+// IP and range decisions share the IPScope. Unsupported scopes are returned unchanged.
+func GetScope(scope *string) string {
+	if scope == nil {
+		return IPScope
+	}
+	switch strings.ToLower(*scope) {
+	case "", "ip", "range":
+		return IPScope
+	case "country":
+		return CountryScope
+	case "as":
+		return ASScope
+	}
+	return *scope
+}
+
+// GetSource returns the source matched by a rule of the scope for a decision value:
+// a CIDR for the IPScope, an upper case country code for the CountryScope and an AS number for the ASScope.
+func GetSource(scope string, value string) string {
+	switch scope {
+	case CountryScope:
+		return strings.ToUpper(value)
+	case ASScope:
+		return strings.TrimPrefix(strings.ToUpper(value), "AS")
+	}
+	return GetCIDR(value)
+}
+
 func GetCIDR(source string) string {
 	_, cidr, err := net.ParseCIDR(source)
 	if err != nil {
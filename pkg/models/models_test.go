@@ -6,6 +6,29 @@ import (
 	"testing"
 )
 
+func TestIsLegacyRuleName(t *testing.T) {
+	tests := []struct {
+		prefix string
+		name   string
+		want   bool
+	}{
+		{"cs", "cs-bingo-jumbo", true},
+		{"cs", "cs-prod-bingo-jumbo", false},
+		{"cs-prod", "cs-prod-bingo-jumbo", true},
+		{"cs", "cs-gcp-0", false},
+		{"cs", "csprod-bingo-jumbo", false},
+		{"cs", "cs-yo-yo-jumbo", true},
+		{"cs", "cs-bingo-yo-yo", true},
+		{"cs", "cs-prod-yo-yo-jumbo", false},
+		{"cs-prod", "cs-prod-yo-yo-yo-yo", true},
+	}
+	for _, tt := range tests {
+		if got := IsLegacyRuleName(tt.prefix, tt.name); got != tt.want {
+			t.Errorf("IsLegacyRuleName(%s, %s) = %v, want %v", tt.prefix, tt.name, got, tt.want)
+		}
+	}
+}
+
 func TestConvertSourceRangesMapToSlice(t *testing.T) {
 	type args struct {
 		sourceRanges map[string]bool
@@ -82,3 +105,28 @@ func TestGetCIDR(t *testing.T) {
 		})
 	}
 }
+
+func TestGetSource(t *testing.T) {
+	country := "country"
+	as := "AS"
+	rangeScope := "Range"
+	tests := []struct {
+		name  string
+		scope *string
+		value string
+		want  string
+	}{
+		{"no_scope", nil, "1.2.3.4", "1.2.3.4/32"},
+		{"range", &rangeScope, "1.2.3.0/24", "1.2.3.0/24"},
+		{"country", &country, "cn", "CN"},
+		{"as", &as, "4134", "4134"},
+		{"as_prefixed", &as, "AS4134", "4134"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetSource(GetScope(tt.scope), tt.value); got != tt.want {
+				t.Errorf("GetSource() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -12,26 +12,155 @@ type GCPConfig struct {
 	Network   string `yaml:"network"`
 	Priority  int64  `yaml:"priority"`
 	MaxRules  int    `yaml:"max_rules"`
+	// PriorityRange bounds the priorities of the firewall rules. Priority defaults to the start of the range.
+	PriorityRange PriorityRange `yaml:"priority_range"`
+	// Action is the action of the firewall rules. Only deny is supported.
+	Action string `yaml:"action"`
+	// Protocols restricts the denied traffic to the specified protocols and ports. All protocols are denied when empty.
+	Protocols []GCPProtocolConfig `yaml:"protocols"`
+	// TargetTags restricts the firewall rules to the instances with one of the network tags. All instances are targeted when empty.
+	TargetTags []string `yaml:"target_tags"`
+	// TargetServiceAccounts restricts the firewall rules to the instances running as one of the service accounts.
+	// It cannot be used together with TargetTags.
+	TargetServiceAccounts []string `yaml:"target_service_accounts"`
+	// EnableLogging enables firewall rules logging.
+	EnableLogging bool `yaml:"enable_logging"`
+	// LogMetadata is either INCLUDE_ALL_METADATA or EXCLUDE_ALL_METADATA. Only used when logging is enabled.
+	LogMetadata string `yaml:"log_metadata"`
+	// Direction is the direction of the blocked traffic: ingress, egress (blocking the decisions as destinations) or both.
+	Direction string `yaml:"direction"`
+	// EgressOnly matches the decisions that are only blocked as destinations.
+	EgressOnly DecisionFilter `yaml:"egress_only"`
+	// Batch configures the batching of the decisions before they are applied.
+	Batch BatchConfig `yaml:"batch"`
+	// CredentialsFile is a service account key or external account credentials file. Application Default Credentials
+	// are used when empty.
+	CredentialsFile string `yaml:"credentials_file"`
+	// ImpersonateServiceAccount is the email of a service account impersonated with the credentials.
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account"`
 	// Endpoint is used for making calls to a mock server instead of the real Google services endpoints.
 	Endpoint string `yaml:"endpoint"`
 }
 
+// GCPProtocolConfig represents a protocol, and optionally its ports, denied by the GCP firewall rules.
+type GCPProtocolConfig struct {
+	Protocol string   `yaml:"protocol"`
+	Ports    []string `yaml:"ports"`
+}
+
 type CloudArmorConfig struct {
 	Disabled  bool   `yaml:"disabled"`
 	ProjectID string `yaml:"project_id"`
 	Policy    string `yaml:"policy"`
-	Priority  int64  `yaml:"priority"`
-	MaxRules  int    `yaml:"max_rules"`
+	// Region is the region of a regional security policy. Global security policies are used when empty.
+	Region string `yaml:"region"`
+	// PolicyType is the type of the security policy: CLOUD_ARMOR (backend security policy) or CLOUD_ARMOR_EDGE (edge security policy).
+	PolicyType string `yaml:"policy_type"`
+	Priority   int64  `yaml:"priority"`
+	MaxRules   int    `yaml:"max_rules"`
+	// PriorityRange bounds the priorities of all the policy rules. Priority defaults to the start of the range.
+	PriorityRange PriorityRange `yaml:"priority_range"`
+	// Action is the action of the policy rules: deny(403), deny(404), deny(502), redirect or throttle.
+	Action string `yaml:"action"`
+	// Redirect configures the redirect action.
+	Redirect CloudArmorRedirectConfig `yaml:"redirect"`
+	// RateLimit configures the throttle action.
+	RateLimit CloudArmorRateLimitConfig `yaml:"rate_limit"`
+	// Captcha configures the rules challenging the sources of captcha decisions with reCAPTCHA.
+	Captcha CloudArmorCaptchaConfig `yaml:"captcha"`
+	// Expressions configures the expression rules enforcing country and AS scoped decisions.
+	Expressions CloudArmorExpressionsConfig `yaml:"expressions"`
+	// AddressGroups stores the IP decisions in network security address groups referenced by the policy rules.
+	AddressGroups CloudArmorAddressGroupsConfig `yaml:"address_groups"`
+	// Preview creates the policy rules in preview mode: matches are logged but the action is not enforced.
+	Preview bool `yaml:"preview"`
+	// Batch configures the batching of the decisions before they are applied.
+	Batch BatchConfig `yaml:"batch"`
+	// CredentialsFile is a service account key or external account credentials file. Application Default Credentials
+	// are used when empty.
+	CredentialsFile string `yaml:"credentials_file"`
+	// ImpersonateServiceAccount is the email of a service account impersonated with the credentials.
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account"`
 	// Endpoint is used for making calls to a mock server instead of the real Google services endpoints.
 	Endpoint string `yaml:"endpoint"`
 }
 
+// CloudArmorRedirectConfig represents the options of the cloud armor redirect action.
+type CloudArmorRedirectConfig struct {
+	// Type is either GOOGLE_RECAPTCHA or EXTERNAL_302.
+	Type string `yaml:"type"`
+	// Target is the URL to redirect to. Only used with EXTERNAL_302.
+	Target string `yaml:"target"`
+}
+
+// CloudArmorRateLimitConfig represents the options of the cloud armor throttle action.
+type CloudArmorRateLimitConfig struct {
+	ThresholdCount int64  `yaml:"threshold_count"`
+	IntervalSec    int64  `yaml:"interval_sec"`
+	ExceedAction   string `yaml:"exceed_action"`
+	EnforceOnKey   string `yaml:"enforce_on_key"`
+}
+
+// CloudArmorCaptchaConfig represents the rule set enforcing captcha decisions with a GOOGLE_RECAPTCHA redirect.
+type CloudArmorCaptchaConfig struct {
+	Enabled  bool  `yaml:"enabled"`
+	Priority int64 `yaml:"priority"`
+	MaxRules int   `yaml:"max_rules"`
+}
+
+// CloudArmorExpressionsConfig represents the rule sets enforcing country and AS scoped decisions with expressions.
+// MaxRules is the maximum number of rules for each scope and decision type.
+type CloudArmorExpressionsConfig struct {
+	Enabled  bool  `yaml:"enabled"`
+	Priority int64 `yaml:"priority"`
+	MaxRules int   `yaml:"max_rules"`
+}
+
+// CloudArmorAddressGroupsConfig represents the network security address groups storing the IP decisions.
+// Each policy rule references an IPv4 and an IPv6 address group of the specified capacity.
+type CloudArmorAddressGroupsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Capacity is the maximum number of IP ranges of each address group. It is only used when the address group is created.
+	Capacity int64 `yaml:"capacity"`
+}
+
 type AWSConfig struct {
 	Disabled          bool   `yaml:"disabled"`
 	Region            string `yaml:"region"`
 	FirewallPolicy    string `yaml:"firewall_policy"`
 	Capacity          int    `yaml:"capacity"`
 	RuleGroupPriority int64  `yaml:"priority"`
+	// PriorityRange bounds the priorities of the rule groups in the firewall policy. Priority defaults to the start of the range.
+	PriorityRange PriorityRange `yaml:"priority_range"`
+	// Action is the standard stateless action of the rule: aws:drop or aws:forward_to_sfe.
+	Action string `yaml:"action"`
+	// CustomAction is an optional custom action publishing CloudWatch metrics, applied in addition to Action.
+	CustomAction AWSCustomActionConfig `yaml:"custom_action"`
+	// Direction is the direction of the blocked traffic: ingress, egress (blocking the decisions as destinations) or both.
+	// Each direction has its own rule group.
+	Direction string `yaml:"direction"`
+	// EgressOnly matches the decisions that are only blocked as destinations.
+	EgressOnly DecisionFilter `yaml:"egress_only"`
+	// Batch configures the batching of the decisions before they are applied.
+	Batch BatchConfig `yaml:"batch"`
+	// Profile is the profile of the shared configuration and credentials files. The default credential chain is used
+	// when empty.
+	Profile string `yaml:"profile"`
+	// AccessKeyIDFile and SecretAccessKeyFile are files containing static credentials, such as mounted secrets.
+	AccessKeyIDFile     string `yaml:"access_key_id_file"`
+	SecretAccessKeyFile string `yaml:"secret_access_key_file"`
+	// AssumeRoleARN is a role assumed with the credentials, such as a role of another account.
+	AssumeRoleARN string `yaml:"assume_role_arn"`
+	// ExternalID is the external ID required by the trust policy of the assumed role.
+	ExternalID string `yaml:"external_id"`
+	// RoleSessionName is the name of the assumed role session.
+	RoleSessionName string `yaml:"role_session_name"`
 	// Endpoint is used for making calls to a mock server instead of the real AWS services endpoints.
 	Endpoint string `yaml:"endpoint"`
 }
+
+// AWSCustomActionConfig represents a stateless custom action publishing CloudWatch metric dimensions.
+type AWSCustomActionConfig struct {
+	Name       string   `yaml:"name"`
+	Dimensions []string `yaml:"dimensions"`
+}
@@ -2,10 +2,13 @@ package aws
 
 import (
 	"fmt"
+	"io/ioutil"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/networkfirewall"
 	"github.com/aws/aws-sdk-go/service/networkfirewall/networkfirewalliface"
@@ -19,12 +22,25 @@ type Client struct {
 	capacity          int
 	firewallPolicy    string
 	ruleGroupPriority int64
+	priorityRange     models.PriorityRange
+	action            string
+	customAction      models.AWSCustomActionConfig
+	direction         string
 }
 
 const (
-	providerName          = "aws"
-	defaultCapacity       = 1000
-	defaultPriority int64 = 1
+	providerName           = "aws"
+	defaultCapacity        = 1000
+	defaultPriority  int64 = 1
+	defaultAction          = "aws:drop"
+	defaultDirection       = models.Ingress
+	description            = "Blocklist generated by CrowdSec Cloud Firewall Bouncer"
+	// ownerTagKey is the key of the tag recording the owner of the rule groups.
+	ownerTagKey = "crowdsec-bouncer-owner"
+	// preflightRuleGroupName is the name of the rule group whose creation is simulated by the pre-flight checks.
+	preflightRuleGroupName = "crowdsec-bouncer-preflight"
+	// defaultRoleSessionName is the name of the assumed role sessions, recorded in CloudTrail.
+	defaultRoleSessionName = "cs-cloud-firewall-bouncer"
 )
 
 func (c *Client) MaxSourcesPerRule() int {
@@ -38,6 +54,22 @@ func (c *Client) Priority() int64 {
 	return c.ruleGroupPriority
 }
 
+// RuleSets returns a rule set of a single rule group for each blocked direction. The egress rule group
+// is referenced in the firewall policy right after the ingress rule group.
+func (c *Client) RuleSets() []models.RuleSet {
+	ruleSets := []models.RuleSet{}
+	for i, direction := range models.GetDirections(c.direction) {
+		ruleSets = append(ruleSets, models.RuleSet{
+			Type:        models.Ban,
+			Priority:    c.ruleGroupPriority + int64(i),
+			MaxRules:    1,
+			Direction:   direction,
+			MaxPriority: c.priorityRange.Max,
+		})
+	}
+	return ruleSets
+}
+
 func (c *Client) GetProviderName() string {
 	return providerName
 }
@@ -53,23 +85,92 @@ func assignDefault(config *models.AWSConfig) {
 		log.Debugf("Setting default rule group capacity (%d)", defaultCapacity)
 		config.Capacity = defaultCapacity
 	}
+	if config.RuleGroupPriority == 0 {
+		config.RuleGroupPriority = config.PriorityRange.Min
+	}
 	if config.RuleGroupPriority == 0 {
 		log.Debugf("Setting default lowest rule group priority (%d)", defaultPriority)
 		config.RuleGroupPriority = defaultPriority
 	}
+	if config.Action == "" {
+		log.Debugf("Setting default rule action (%s)", defaultAction)
+		config.Action = defaultAction
+	}
+	if config.Direction == "" {
+		log.Debugf("Setting default direction (%s)", defaultDirection)
+		config.Direction = defaultDirection
+	}
+}
+
+// readKeyFile returns the content of a file containing a key, without the surrounding spaces.
+func readKeyFile(path string) (string, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	trimmed := strings.TrimSpace(string(key))
+	if trimmed == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return trimmed, nil
+}
+
+// getStaticCredentials returns the credentials of the access key read from the key files.
+func getStaticCredentials(config *models.AWSConfig) (*credentials.Credentials, error) {
+	if config.AccessKeyIDFile == "" || config.SecretAccessKeyFile == "" {
+		return nil, fmt.Errorf("access_key_id_file and secret_access_key_file must be specified together")
+	}
+	accessKeyID, err := readKeyFile(config.AccessKeyIDFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read access_key_id_file: %s", err)
+	}
+	secretAccessKey, err := readKeyFile(config.SecretAccessKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret_access_key_file: %s", err)
+	}
+	return credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""), nil
+}
+
+// getAssumeRoleCredentials returns the credentials of the role assumed with the credentials of the session. They are
+// refreshed before they expire.
+func getAssumeRoleCredentials(sess *session.Session, config *models.AWSConfig) *credentials.Credentials {
+	return stscreds.NewCredentials(sess, config.AssumeRoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = config.RoleSessionName
+		if p.RoleSessionName == "" {
+			p.RoleSessionName = defaultRoleSessionName
+		}
+		if config.ExternalID != "" {
+			p.ExternalID = aws.String(config.ExternalID)
+		}
+	})
 }
 
 // NewClient creates a new AWS client
 func NewClient(config *models.AWSConfig) (*Client, error) {
 	log.Infof("creating client for %s", providerName)
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
+	opts := session.Options{
 		SharedConfigState: session.SharedConfigEnable,
+		Profile:           config.Profile,
 		Config: aws.Config{
 			Region:   aws.String(config.Region),
 			Endpoint: aws.String(config.Endpoint),
 		},
-	}))
-	_, err := sess.Config.Credentials.Get()
+	}
+	if config.AccessKeyIDFile != "" || config.SecretAccessKeyFile != "" {
+		staticCredentials, err := getStaticCredentials(config)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading credentials: %s", err)
+		}
+		opts.Config.Credentials = staticCredentials
+	}
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, fmt.Errorf("error while creating session: %s", err)
+	}
+	if config.AssumeRoleARN != "" {
+		sess = sess.Copy(&aws.Config{Credentials: getAssumeRoleCredentials(sess, config)})
+	}
+	_, err = sess.Config.Credentials.Get()
 	if err != nil {
 		return nil, fmt.Errorf("error while loading credentials: %s", err)
 	}
@@ -81,6 +182,10 @@ func NewClient(config *models.AWSConfig) (*Client, error) {
 		capacity:          config.Capacity,
 		firewallPolicy:    config.FirewallPolicy,
 		ruleGroupPriority: config.RuleGroupPriority,
+		priorityRange:     config.PriorityRange,
+		action:            config.Action,
+		customAction:      config.CustomAction,
+		direction:         config.Direction,
 	}, nil
 }
 
@@ -94,9 +199,54 @@ func (c *Client) getFirewallPolicy() (*networkfirewall.DescribeFirewallPolicyOut
 	return res, nil
 }
 
-func (c *Client) addRuleToFirewallPolicy(ruleARN string, fp *networkfirewall.DescribeFirewallPolicyOutput) {
+// Preflight checks that the firewall policy exists and simulates the creation of a rule group, the update of the
+// firewall policy and the listing of the rule groups. Simulated requests are validated by AWS, including permissions,
+// without being applied.
+func (c *Client) Preflight() []models.PreflightCheck {
+	policyCheck := models.PreflightCheck{Name: fmt.Sprintf("firewall policy %s", c.firewallPolicy)}
+	fp, err := c.getFirewallPolicy()
+	if err != nil {
+		policyCheck.Err = err
+	}
+	checks := []models.PreflightCheck{policyCheck}
+
+	listCheck := models.PreflightCheck{Name: "rule groups listing"}
+	if _, err := c.svc.ListRuleGroups(&networkfirewall.ListRuleGroupsInput{MaxResults: aws.Int64(1)}); err != nil {
+		listCheck.Err = fmt.Errorf("unable to list rule groups: %s", err)
+	}
+	checks = append(checks, listCheck)
+
+	createCheck := models.PreflightCheck{Name: "simulated rule group creation"}
+	input := c.getCreateRuleGroupInput(&models.FirewallRule{
+		Name:         preflightRuleGroupName,
+		SourceRanges: map[string]bool{"192.0.2.1/32": true},
+		Priority:     c.ruleGroupPriority,
+	})
+	input.DryRun = aws.Bool(true)
+	if _, err := c.svc.CreateRuleGroup(input); err != nil {
+		createCheck.Err = fmt.Errorf("unable to create rule group: %s", err)
+	}
+	checks = append(checks, createCheck)
+
+	if fp == nil {
+		return checks
+	}
+	updateCheck := models.PreflightCheck{Name: "simulated firewall policy update"}
+	_, err = c.svc.UpdateFirewallPolicy(&networkfirewall.UpdateFirewallPolicyInput{
+		DryRun:            aws.Bool(true),
+		FirewallPolicyArn: fp.FirewallPolicyResponse.FirewallPolicyArn,
+		FirewallPolicy:    fp.FirewallPolicy,
+		UpdateToken:       fp.UpdateToken,
+	})
+	if err != nil {
+		updateCheck.Err = fmt.Errorf("unable to update firewall policy %s: %s", c.firewallPolicy, err)
+	}
+	return append(checks, updateCheck)
+}
+
+func (c *Client) addRuleToFirewallPolicy(ruleARN string, priority int64, fp *networkfirewall.DescribeFirewallPolicyOutput) error {
 	newRuleRef := networkfirewall.StatelessRuleGroupReference{
-		Priority:    aws.Int64(int64(c.ruleGroupPriority)),
+		Priority:    aws.Int64(priority),
 		ResourceArn: &ruleARN,
 	}
 	rules := append(fp.FirewallPolicy.StatelessRuleGroupReferences, &newRuleRef)
@@ -109,20 +259,25 @@ func (c *Client) addRuleToFirewallPolicy(ruleARN string, fp *networkfirewall.Des
 	}
 	_, err := c.svc.UpdateFirewallPolicy(&input)
 	if err != nil {
-		log.Fatalf("unable to update firewall policy %s: %s", *fp.FirewallPolicyResponse.FirewallPolicyName, err)
+		return fmt.Errorf("unable to update firewall policy %s: %s", *fp.FirewallPolicyResponse.FirewallPolicyName, err)
 	}
 	log.Infof("update of firewall policy %s successful", *fp.FirewallPolicyResponse.FirewallPolicyName)
+	return nil
 }
 
-func (c *Client) removeRuleFromFirewallPolicy(ruleARN string, fp *networkfirewall.DescribeFirewallPolicyOutput) {
-	fpRulesRef := fp.FirewallPolicy.StatelessRuleGroupReferences
-	fpRulesRefLen := len(fpRulesRef)
-	for i, rule := range fpRulesRef {
-		if *rule.ResourceArn == ruleARN {
-			fpRulesRef[i] = fpRulesRef[fpRulesRefLen-1]
+// removeRuleFromFirewallPolicy removes the references to the rule group from the firewall policy. The policy is left
+// untouched when it does not reference the rule group.
+func (c *Client) removeRuleFromFirewallPolicy(ruleARN string, fp *networkfirewall.DescribeFirewallPolicyOutput) error {
+	fpRulesRef := []*networkfirewall.StatelessRuleGroupReference{}
+	for _, rule := range fp.FirewallPolicy.StatelessRuleGroupReferences {
+		if *rule.ResourceArn != ruleARN {
+			fpRulesRef = append(fpRulesRef, rule)
 		}
 	}
-	fpRulesRef = fpRulesRef[:fpRulesRefLen-1]
+	if len(fpRulesRef) == len(fp.FirewallPolicy.StatelessRuleGroupReferences) {
+		log.Debugf("rule %s is not in firewall policy %s", ruleARN, *fp.FirewallPolicyResponse.FirewallPolicyName)
+		return nil
+	}
 	fp.FirewallPolicy.SetStatelessRuleGroupReferences(fpRulesRef)
 
 	input := networkfirewall.UpdateFirewallPolicyInput{
@@ -132,9 +287,10 @@ func (c *Client) removeRuleFromFirewallPolicy(ruleARN string, fp *networkfirewal
 	}
 	_, err := c.svc.UpdateFirewallPolicy(&input)
 	if err != nil {
-		log.Fatalf("unable to update firewall policy %s: %s", *fp.FirewallPolicyResponse.FirewallPolicyName, err)
+		return fmt.Errorf("unable to update firewall policy %s: %s", *fp.FirewallPolicyResponse.FirewallPolicyName, err)
 	}
 	log.Infof("successfully removed rule %s from firewall policy %s", ruleARN, *fp.FirewallPolicyResponse.FirewallPolicyName)
+	return nil
 }
 
 func convertSourceMapToAWSSlice(sources map[string]bool) []*networkfirewall.Address {
@@ -147,6 +303,47 @@ func convertSourceMapToAWSSlice(sources map[string]bool) []*networkfirewall.Addr
 	return slice
 }
 
+// getMatchAttributes returns the match attributes of the stateless rule, matching the sources of the rule
+// as destinations for the egress direction.
+func getMatchAttributes(rule *models.FirewallRule) *networkfirewall.MatchAttributes {
+	if models.GetDirection(rule.Direction) == models.Egress {
+		return &networkfirewall.MatchAttributes{
+			Destinations: convertSourceMapToAWSSlice(rule.SourceRanges),
+		}
+	}
+	return &networkfirewall.MatchAttributes{
+		Sources: convertSourceMapToAWSSlice(rule.SourceRanges),
+	}
+}
+
+// getActions returns the actions of the stateless rule: the standard action followed by the custom action, if any.
+func (c *Client) getActions() []*string {
+	actions := []*string{aws.String(c.action)}
+	if c.customAction.Name != "" {
+		actions = append(actions, aws.String(c.customAction.Name))
+	}
+	return actions
+}
+
+// getCustomActions returns the custom action definitions of the rule group.
+func (c *Client) getCustomActions() []*networkfirewall.CustomAction {
+	if c.customAction.Name == "" {
+		return nil
+	}
+	dimensions := []*networkfirewall.Dimension{}
+	for _, dimension := range c.customAction.Dimensions {
+		dimensions = append(dimensions, &networkfirewall.Dimension{Value: aws.String(dimension)})
+	}
+	return []*networkfirewall.CustomAction{{
+		ActionName: aws.String(c.customAction.Name),
+		ActionDefinition: &networkfirewall.ActionDefinition{
+			PublishMetricAction: &networkfirewall.PublishMetricAction{
+				Dimensions: dimensions,
+			},
+		},
+	}}
+}
+
 func (c *Client) GetRules(ruleNamePrefix string) ([]*models.FirewallRule, error) {
 
 	fp, err := c.getFirewallPolicy()
@@ -156,31 +353,79 @@ func (c *Client) GetRules(ruleNamePrefix string) ([]*models.FirewallRule, error)
 
 	var rules []*models.FirewallRule
 	for _, ruleGroup := range fp.FirewallPolicy.StatelessRuleGroupReferences {
-		if strings.Contains(*ruleGroup.ResourceArn, ruleNamePrefix) {
-			res, err := c.svc.DescribeRuleGroup(&networkfirewall.DescribeRuleGroupInput{
-				RuleGroupArn: ruleGroup.ResourceArn,
-			})
-			if err != nil {
-				return nil, fmt.Errorf("unable to get rule group %s: %s", *ruleGroup.ResourceArn, err)
-			}
-			if *res.RuleGroupResponse.RuleGroupStatus == networkfirewall.ResourceStatusDeleting {
-				log.Debugf("skipping rule %s because it is being deleted", *res.RuleGroupResponse.RuleGroupName)
-				break
-			}
-			var sources []string
-			log.Debugf("found rule %s", *res.RuleGroupResponse.RuleGroupName)
-			if len(res.RuleGroup.RulesSource.StatelessRulesAndCustomActions.StatelessRules) > 0 {
-				for _, source := range res.RuleGroup.RulesSource.StatelessRulesAndCustomActions.StatelessRules[0].RuleDefinition.MatchAttributes.Sources {
-					sources = append(sources, *source.AddressDefinition)
-				}
+		// Other rule groups are returned so that their priorities are not assigned to new rule groups.
+		foreignRule := &models.FirewallRule{
+			Name:     *ruleGroup.ResourceArn,
+			Priority: aws.Int64Value(ruleGroup.Priority),
+			Owner:    models.ForeignOwner,
+		}
+		if !strings.Contains(*ruleGroup.ResourceArn, ruleNamePrefix) {
+			rules = append(rules, foreignRule)
+			continue
+		}
+		res, err := c.svc.DescribeRuleGroup(&networkfirewall.DescribeRuleGroupInput{
+			RuleGroupArn: ruleGroup.ResourceArn,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get rule group %s: %s", *ruleGroup.ResourceArn, err)
+		}
+		foreignRule.Name = *res.RuleGroupResponse.RuleGroupName
+		if *res.RuleGroupResponse.RuleGroupStatus == networkfirewall.ResourceStatusDeleting {
+			log.Debugf("skipping rule %s because it is being deleted", *res.RuleGroupResponse.RuleGroupName)
+			rules = append(rules, foreignRule)
+			continue
+		}
+		var sources []string
+		direction := models.Ingress
+		log.Debugf("found rule %s", *res.RuleGroupResponse.RuleGroupName)
+		if len(res.RuleGroup.RulesSource.StatelessRulesAndCustomActions.StatelessRules) > 0 {
+			matchAttributes := res.RuleGroup.RulesSource.StatelessRulesAndCustomActions.StatelessRules[0].RuleDefinition.MatchAttributes
+			addresses := matchAttributes.Sources
+			// Egress rules only match destinations.
+			if len(matchAttributes.Sources) == 0 && len(matchAttributes.Destinations) > 0 {
+				direction = models.Egress
+				addresses = matchAttributes.Destinations
 			}
-			log.Infof("%s  (%d sources): %#v", *res.RuleGroupResponse.RuleGroupName, len(sources), sources)
-			rule := models.FirewallRule{
-				Name:         *res.RuleGroupResponse.RuleGroupName,
-				SourceRanges: models.ConvertSourceRangesSliceToMap(sources),
-				Priority:     *res.RuleGroup.RulesSource.StatelessRulesAndCustomActions.StatelessRules[0].Priority,
+			for _, source := range addresses {
+				sources = append(sources, *source.AddressDefinition)
 			}
-			rules = append(rules, &rule)
+		}
+		owner := getOwner(res.RuleGroupResponse.Tags)
+		if owner == "" && aws.StringValue(res.RuleGroupResponse.Description) != description {
+			log.Warningf("rule group %s was not created by the bouncer, it will not be updated", *res.RuleGroupResponse.RuleGroupName)
+			rules = append(rules, foreignRule)
+			continue
+		}
+		log.Debugf("%s  (%s, %d sources): %#v", *res.RuleGroupResponse.RuleGroupName, direction, len(sources), sources)
+		rule := models.FirewallRule{
+			Name:         *res.RuleGroupResponse.RuleGroupName,
+			SourceRanges: models.ConvertSourceRangesSliceToMap(sources),
+			Priority:     *res.RuleGroup.RulesSource.StatelessRulesAndCustomActions.StatelessRules[0].Priority,
+			Direction:    direction,
+			Owner:        owner,
+		}
+		if owner == "" && !models.IsLegacyRuleName(ruleNamePrefix, rule.Name) {
+			log.Debugf("rule group %s has no owner tag and is not named after %s, it is left to its bouncer", rule.Name, ruleNamePrefix)
+			rule.Owner = models.ForeignOwner
+		} else if owner == "" {
+			log.Infof("rule group %s has no owner tag, it will be patched", rule.Name)
+			rule.Owner = ruleNamePrefix
+			rule.State = models.Modified
+		}
+		rules = append(rules, &rule)
+	}
+	// rule group names are unique across the account and region, including the rule groups not referenced by the policy
+	names, err := c.listRuleGroupNames(ruleNamePrefix)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool)
+	for _, rule := range rules {
+		listed[rule.Name] = true
+	}
+	for _, name := range names {
+		if !listed[name] {
+			rules = append(rules, &models.FirewallRule{Name: name, Owner: models.ReservedNameOwner})
 		}
 	}
 	log.Infof("found %d rule(s)", len(rules))
@@ -188,33 +433,78 @@ func (c *Client) GetRules(ruleNamePrefix string) ([]*models.FirewallRule, error)
 	return rules, nil
 }
 
-func (c *Client) CreateRule(rule *models.FirewallRule) error {
-	log.Infof("creating rule group %s with %#v", rule.Name, rule.SourceRanges)
-	ruleType := networkfirewall.RuleGroupTypeStateless
+// listRuleGroupNames returns the names of the rule groups of the account starting with the rule name prefix.
+func (c *Client) listRuleGroupNames(ruleNamePrefix string) ([]string, error) {
+	names := []string{}
+	err := c.svc.ListRuleGroupsPages(&networkfirewall.ListRuleGroupsInput{}, func(page *networkfirewall.ListRuleGroupsOutput, lastPage bool) bool {
+		for _, ruleGroup := range page.RuleGroups {
+			if strings.HasPrefix(aws.StringValue(ruleGroup.Name), ruleNamePrefix) {
+				names = append(names, aws.StringValue(ruleGroup.Name))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list rule groups: %s", err)
+	}
+	return names, nil
+}
 
+// getOwner returns the owner recorded in the tags of a rule group, or an empty owner for rule groups created before owner tags.
+func getOwner(tags []*networkfirewall.Tag) string {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == ownerTagKey {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
+
+// checkOwnership checks that the rule group is not owned by another bouncer than the owner of the rule.
+func checkOwnership(rule *models.FirewallRule, ruleGroup *networkfirewall.RuleGroupResponse) error {
+	if owner := getOwner(ruleGroup.Tags); owner != "" && owner != rule.Owner {
+		return fmt.Errorf("refusing to update rule group %s owned by %s", rule.Name, owner)
+	}
+	return nil
+}
+
+// getOwnerTags returns the tags recording the owner of the rule group.
+func getOwnerTags(rule *models.FirewallRule) []*networkfirewall.Tag {
+	return []*networkfirewall.Tag{{
+		Key:   aws.String(ownerTagKey),
+		Value: aws.String(rule.Owner),
+	}}
+}
+
+// getCreateRuleGroupInput returns the request creating the rule group of the rule.
+func (c *Client) getCreateRuleGroupInput(rule *models.FirewallRule) *networkfirewall.CreateRuleGroupInput {
 	awsRule := networkfirewall.StatelessRule{
 		Priority: aws.Int64(rule.Priority),
 		RuleDefinition: &networkfirewall.RuleDefinition{
-			MatchAttributes: &networkfirewall.MatchAttributes{
-				Sources: convertSourceMapToAWSSlice(rule.SourceRanges),
-			},
-			Actions: []*string{aws.String("aws:drop")},
+			MatchAttributes: getMatchAttributes(rule),
+			Actions:         c.getActions(),
 		},
 	}
-
-	rg, err := c.svc.CreateRuleGroup(&networkfirewall.CreateRuleGroupInput{
+	return &networkfirewall.CreateRuleGroupInput{
 		Capacity:      aws.Int64(int64(c.capacity)),
-		Description:   aws.String("Blocklist generated by CrowdSec Cloud Firewall Bouncer"),
+		Description:   aws.String(description),
 		RuleGroupName: &rule.Name,
+		Tags:          getOwnerTags(rule),
 		RuleGroup: &networkfirewall.RuleGroup{
 			RulesSource: &networkfirewall.RulesSource{
 				StatelessRulesAndCustomActions: &networkfirewall.StatelessRulesAndCustomActions{
 					StatelessRules: []*networkfirewall.StatelessRule{&awsRule},
+					CustomActions:  c.getCustomActions(),
 				},
 			},
 		},
-		Type: &ruleType,
-	})
+		Type: aws.String(networkfirewall.RuleGroupTypeStateless),
+	}
+}
+
+func (c *Client) CreateRule(rule *models.FirewallRule) error {
+	log.Infof("creating rule group %s with %#v", rule.Name, rule.SourceRanges)
+	rg, err := c.svc.CreateRuleGroup(c.getCreateRuleGroupInput(rule))
 	if err != nil {
 		return fmt.Errorf("unable to create rule group %s: %s", rule.Name, err)
 	}
@@ -222,7 +512,9 @@ func (c *Client) CreateRule(rule *models.FirewallRule) error {
 	if err != nil {
 		return err
 	}
-	c.addRuleToFirewallPolicy(*rg.RuleGroupResponse.RuleGroupArn, fp)
+	if err = c.addRuleToFirewallPolicy(*rg.RuleGroupResponse.RuleGroupArn, rule.Priority, fp); err != nil {
+		return err
+	}
 
 	log.Infof("creation of rule group %s successful", rule.Name)
 	return nil
@@ -237,11 +529,16 @@ func (c *Client) DeleteRule(rule *models.FirewallRule) error {
 	if err != nil {
 		return fmt.Errorf("unable to get rule group %s: %s", rule.Name, err)
 	}
+	if err = checkOwnership(rule, res.RuleGroupResponse); err != nil {
+		return err
+	}
 	fp, err := c.getFirewallPolicy()
 	if err != nil {
 		return err
 	}
-	c.removeRuleFromFirewallPolicy(*res.RuleGroupResponse.RuleGroupArn, fp)
+	if err = c.removeRuleFromFirewallPolicy(*res.RuleGroupResponse.RuleGroupArn, fp); err != nil {
+		return err
+	}
 
 	input := networkfirewall.DeleteRuleGroupInput{
 		RuleGroupArn: res.RuleGroupResponse.RuleGroupArn,
@@ -274,7 +571,18 @@ func (c *Client) PatchRule(rule *models.FirewallRule) error {
 	if err != nil {
 		return fmt.Errorf("unable to get rule group %s: %s", rule.Name, err)
 	}
-	res.RuleGroup.RulesSource.StatelessRulesAndCustomActions.StatelessRules[0].RuleDefinition.MatchAttributes.Sources = convertSourceMapToAWSSlice(rule.SourceRanges)
+	if err = checkOwnership(rule, res.RuleGroupResponse); err != nil {
+		return err
+	}
+	rulesAndCustomActions := res.RuleGroup.RulesSource.StatelessRulesAndCustomActions
+	matchAttributes := rulesAndCustomActions.StatelessRules[0].RuleDefinition.MatchAttributes
+	if models.GetDirection(rule.Direction) == models.Egress {
+		matchAttributes.Destinations = convertSourceMapToAWSSlice(rule.SourceRanges)
+	} else {
+		matchAttributes.Sources = convertSourceMapToAWSSlice(rule.SourceRanges)
+	}
+	rulesAndCustomActions.StatelessRules[0].RuleDefinition.Actions = c.getActions()
+	rulesAndCustomActions.CustomActions = c.getCustomActions()
 
 	input := networkfirewall.UpdateRuleGroupInput{
 		RuleGroupName: &rule.Name,
@@ -286,6 +594,15 @@ func (c *Client) PatchRule(rule *models.FirewallRule) error {
 	if err != nil {
 		return fmt.Errorf("unable to patch firewall rule %s: %s", rule.Name, err)
 	}
+	if getOwner(res.RuleGroupResponse.Tags) == "" && rule.Owner != "" {
+		_, err = c.svc.TagResource(&networkfirewall.TagResourceInput{
+			ResourceArn: res.RuleGroupResponse.RuleGroupArn,
+			Tags:        getOwnerTags(rule),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to tag firewall rule %s: %s", rule.Name, err)
+		}
+	}
 	log.Infof("patch of rule %s successful", rule.Name)
 	return nil
 }
@@ -2,6 +2,9 @@ package aws
 
 import (
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -13,6 +16,8 @@ import (
 
 type mockedAWSSvc struct {
 	networkfirewalliface.NetworkFirewallAPI
+	tagged  []*networkfirewall.TagResourceInput
+	updated []*networkfirewall.UpdateFirewallPolicyInput
 }
 
 func (s *mockedAWSSvc) DescribeFirewallPolicy(*networkfirewall.DescribeFirewallPolicyInput) (*networkfirewall.DescribeFirewallPolicyOutput, error) {
@@ -34,7 +39,8 @@ func (s *mockedAWSSvc) DescribeFirewallPolicy(*networkfirewall.DescribeFirewallP
 		UpdateToken: aws.String("token"),
 	}, nil
 }
-func (s *mockedAWSSvc) UpdateFirewallPolicy(*networkfirewall.UpdateFirewallPolicyInput) (*networkfirewall.UpdateFirewallPolicyOutput, error) {
+func (s *mockedAWSSvc) UpdateFirewallPolicy(input *networkfirewall.UpdateFirewallPolicyInput) (*networkfirewall.UpdateFirewallPolicyOutput, error) {
+	s.updated = append(s.updated, input)
 	return &networkfirewall.UpdateFirewallPolicyOutput{}, nil
 }
 func (s *mockedAWSSvc) DescribeRuleGroup(input *networkfirewall.DescribeRuleGroupInput) (*networkfirewall.DescribeRuleGroupOutput, error) {
@@ -44,6 +50,7 @@ func (s *mockedAWSSvc) DescribeRuleGroup(input *networkfirewall.DescribeRuleGrou
 				RuleGroupArn:    aws.String("arn:aws:crowdsec-bingo-jumbo"),
 				RuleGroupName:   aws.String("crowdsec-bingo-jumbo"),
 				RuleGroupStatus: aws.String(networkfirewall.ResourceStatusActive),
+				Tags:            []*networkfirewall.Tag{{Key: aws.String("crowdsec-bouncer-owner"), Value: aws.String("crowdsec")}},
 			},
 			RuleGroup: &networkfirewall.RuleGroup{
 				RulesSource: &networkfirewall.RulesSource{
@@ -89,6 +96,19 @@ func (s *mockedAWSSvc) CreateRuleGroup(*networkfirewall.CreateRuleGroupInput) (*
 		},
 	}, nil
 }
+func (s *mockedAWSSvc) ListRuleGroupsPages(input *networkfirewall.ListRuleGroupsInput, fn func(*networkfirewall.ListRuleGroupsOutput, bool) bool) error {
+	fn(&networkfirewall.ListRuleGroupsOutput{RuleGroups: []*networkfirewall.RuleGroupMetadata{
+		{Name: aws.String("crowdsec-bingo-jumbo"), Arn: aws.String("arn:aws:crowdsec-bingo-jumbo")},
+		{Name: aws.String("crowdsec-aws-0"), Arn: aws.String("arn:aws:crowdsec-aws-0")},
+		{Name: aws.String("other"), Arn: aws.String("arn:aws:other")},
+	}}, true)
+	return nil
+}
+func (s *mockedAWSSvc) TagResource(input *networkfirewall.TagResourceInput) (*networkfirewall.TagResourceOutput, error) {
+	s.tagged = append(s.tagged, input)
+	return &networkfirewall.TagResourceOutput{}, nil
+}
+
 func TestGetRules(t *testing.T) {
 
 	mockSvc := &mockedAWSSvc{}
@@ -99,8 +119,15 @@ func TestGetRules(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	assert.Equal(t, 1, len(rules))
+	assert.Equal(t, 3, len(rules))
 	assert.Equal(t, "crowdsec-bingo-jumbo", rules[0].Name)
+	assert.Equal(t, "crowdsec", rules[0].Owner)
+	// rule groups being deleted are not updated
+	assert.Equal(t, "crowdsec-deleting", rules[1].Name)
+	assert.Equal(t, models.ForeignOwner, rules[1].Owner)
+	// the rule groups not referenced by the policy only reserve their name
+	assert.Equal(t, "crowdsec-aws-0", rules[2].Name)
+	assert.Equal(t, models.ReservedNameOwner, rules[2].Owner)
 }
 func TestCreateRule(t *testing.T) {
 
@@ -128,8 +155,38 @@ func TestDeleteRule(t *testing.T) {
 	rule := models.FirewallRule{
 		Name:         "crowdsec-bingo-jumbo",
 		SourceRanges: map[string]bool{},
+		Owner:        "crowdsec",
+	}
+	err := c.DeleteRule(&rule)
+	assert.NilError(t, err)
+	assert.Equal(t, len(mockSvc.updated), 1)
+	refs := mockSvc.updated[0].FirewallPolicy.StatelessRuleGroupReferences
+	assert.Equal(t, len(refs), 1)
+	assert.Equal(t, *refs[0].ResourceArn, "arn:aws:crowdsec-deleting")
+}
+
+func TestRemoveRuleFromFirewallPolicy(t *testing.T) {
+	mockSvc := &mockedAWSSvc{}
+	c := Client{
+		svc: mockSvc,
 	}
-	_ = c.DeleteRule(&rule)
+	fp, _ := mockSvc.DescribeFirewallPolicy(nil)
+	err := c.removeRuleFromFirewallPolicy("arn:aws:crowdsec-aws-0", fp)
+	assert.NilError(t, err)
+	assert.Equal(t, len(mockSvc.updated), 0)
+	assert.Equal(t, len(fp.FirewallPolicy.StatelessRuleGroupReferences), 2)
+
+	c.svc = &mockedFailingUpdateSvc{mockSvc}
+	err = c.removeRuleFromFirewallPolicy("arn:aws:crowdsec-bingo-jumbo", fp)
+	assert.Error(t, err, "unable to update firewall policy firewall-policy: throttled")
+}
+
+type mockedFailingUpdateSvc struct {
+	*mockedAWSSvc
+}
+
+func (s *mockedFailingUpdateSvc) UpdateFirewallPolicy(*networkfirewall.UpdateFirewallPolicyInput) (*networkfirewall.UpdateFirewallPolicyOutput, error) {
+	return nil, fmt.Errorf("throttled")
 }
 
 func TestPatchRule(t *testing.T) {
@@ -153,4 +210,201 @@ func TestAssignDefaultConfig(t *testing.T) {
 	assignDefault(&config)
 	assert.Equal(t, defaultCapacity, config.Capacity)
 	assert.Equal(t, defaultPriority, config.RuleGroupPriority)
+	assert.Equal(t, defaultAction, config.Action)
+	assert.Equal(t, defaultDirection, config.Direction)
+
+	config = models.AWSConfig{PriorityRange: models.PriorityRange{Min: 100, Max: 110}}
+	assignDefault(&config)
+	assert.Equal(t, int64(100), config.RuleGroupPriority)
+}
+
+func TestGetStaticCredentials(t *testing.T) {
+	dir := t.TempDir()
+	keyIDFile := filepath.Join(dir, "access_key_id")
+	secretFile := filepath.Join(dir, "secret_access_key")
+	emptyFile := filepath.Join(dir, "empty")
+	assert.NilError(t, ioutil.WriteFile(keyIDFile, []byte("AKIAEXAMPLE\n"), 0600))
+	assert.NilError(t, ioutil.WriteFile(secretFile, []byte("secret\n"), 0600))
+	assert.NilError(t, ioutil.WriteFile(emptyFile, []byte("\n"), 0600))
+
+	creds, err := getStaticCredentials(&models.AWSConfig{AccessKeyIDFile: keyIDFile, SecretAccessKeyFile: secretFile})
+	assert.NilError(t, err)
+	value, err := creds.Get()
+	assert.NilError(t, err)
+	assert.Equal(t, "AKIAEXAMPLE", value.AccessKeyID)
+	assert.Equal(t, "secret", value.SecretAccessKey)
+
+	for _, config := range []*models.AWSConfig{
+		{AccessKeyIDFile: keyIDFile},
+		{AccessKeyIDFile: keyIDFile, SecretAccessKeyFile: emptyFile},
+		{AccessKeyIDFile: filepath.Join(dir, "missing"), SecretAccessKeyFile: secretFile},
+	} {
+		_, err := getStaticCredentials(config)
+		assert.Assert(t, err != nil, "config %+v", config)
+	}
+}
+
+func TestGetActions(t *testing.T) {
+	c := Client{action: "aws:drop"}
+	actions := c.getActions()
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, "aws:drop", *actions[0])
+	assert.Assert(t, c.getCustomActions() == nil)
+
+	c.customAction = models.AWSCustomActionConfig{Name: "CrowdSecMetrics", Dimensions: []string{"blocked"}}
+	actions = c.getActions()
+	assert.Equal(t, 2, len(actions))
+	assert.Equal(t, "CrowdSecMetrics", *actions[1])
+	customActions := c.getCustomActions()
+	assert.Equal(t, 1, len(customActions))
+	assert.Equal(t, "blocked", *customActions[0].ActionDefinition.PublishMetricAction.Dimensions[0].Value)
+}
+
+func TestRuleSetsDirections(t *testing.T) {
+	c := Client{ruleGroupPriority: 5, direction: models.Both}
+	ruleSets := c.RuleSets()
+	assert.Equal(t, 2, len(ruleSets))
+	assert.Equal(t, models.Ingress, ruleSets[0].Direction)
+	assert.Equal(t, int64(5), ruleSets[0].Priority)
+	assert.Equal(t, models.Egress, ruleSets[1].Direction)
+	assert.Equal(t, int64(6), ruleSets[1].Priority)
+	assert.Equal(t, 1, ruleSets[1].MaxRules)
+
+	c.direction = models.Egress
+	ruleSets = c.RuleSets()
+	assert.Equal(t, 1, len(ruleSets))
+	assert.Equal(t, int64(5), ruleSets[0].Priority)
+}
+
+func TestGetMatchAttributes(t *testing.T) {
+	rule := models.FirewallRule{SourceRanges: map[string]bool{"1.2.3.4/32": true}}
+	matchAttributes := getMatchAttributes(&rule)
+	assert.Equal(t, 1, len(matchAttributes.Sources))
+	assert.Equal(t, 0, len(matchAttributes.Destinations))
+
+	rule.Direction = models.Egress
+	matchAttributes = getMatchAttributes(&rule)
+	assert.Equal(t, 0, len(matchAttributes.Sources))
+	assert.Equal(t, "1.2.3.4/32", *matchAttributes.Destinations[0].AddressDefinition)
+}
+
+type mockedOwnershipSvc struct {
+	mockedAWSSvc
+}
+
+func (s *mockedOwnershipSvc) DescribeFirewallPolicy(*networkfirewall.DescribeFirewallPolicyInput) (*networkfirewall.DescribeFirewallPolicyOutput, error) {
+	return &networkfirewall.DescribeFirewallPolicyOutput{
+		FirewallPolicyResponse: &networkfirewall.FirewallPolicyResponse{
+			FirewallPolicyName: aws.String("firewall-policy"),
+		},
+		FirewallPolicy: &networkfirewall.FirewallPolicy{
+			StatelessRuleGroupReferences: []*networkfirewall.StatelessRuleGroupReference{
+				{ResourceArn: aws.String("arn:aws:crowdsec-bingo-jumbo")},
+				{ResourceArn: aws.String("arn:aws:crowdsec-prod-aws-0")},
+				{ResourceArn: aws.String("arn:aws:crowdsec-manual")},
+				{ResourceArn: aws.String("arn:aws:crowdsec-prod-yoga-zebra")},
+			},
+		},
+	}, nil
+}
+
+func (s *mockedOwnershipSvc) DescribeRuleGroup(input *networkfirewall.DescribeRuleGroupInput) (*networkfirewall.DescribeRuleGroupOutput, error) {
+	name := strings.TrimPrefix(aws.StringValue(input.RuleGroupArn), "arn:aws:")
+	if input.RuleGroupName != nil {
+		name = *input.RuleGroupName
+	}
+	response := &networkfirewall.RuleGroupResponse{
+		RuleGroupArn:    aws.String("arn:aws:" + name),
+		RuleGroupName:   aws.String(name),
+		RuleGroupStatus: aws.String(networkfirewall.ResourceStatusActive),
+	}
+	switch name {
+	case "crowdsec-bingo-jumbo", "crowdsec-prod-yoga-zebra":
+		response.Description = aws.String("Blocklist generated by CrowdSec Cloud Firewall Bouncer")
+	case "crowdsec-prod-aws-0":
+		response.Tags = []*networkfirewall.Tag{{Key: aws.String("crowdsec-bouncer-owner"), Value: aws.String("crowdsec-prod")}}
+	}
+	return &networkfirewall.DescribeRuleGroupOutput{
+		RuleGroupResponse: response,
+		RuleGroup: &networkfirewall.RuleGroup{
+			RulesSource: &networkfirewall.RulesSource{
+				StatelessRulesAndCustomActions: &networkfirewall.StatelessRulesAndCustomActions{
+					StatelessRules: []*networkfirewall.StatelessRule{{
+						RuleDefinition: &networkfirewall.RuleDefinition{
+							MatchAttributes: &networkfirewall.MatchAttributes{
+								Sources: []*networkfirewall.Address{{AddressDefinition: aws.String("1.2.3.4/32")}},
+							},
+						},
+						Priority: aws.Int64(1),
+					}},
+				},
+			},
+		},
+	}, nil
+}
+
+func TestGetRulesOwnership(t *testing.T) {
+
+	mockSvc := &mockedOwnershipSvc{}
+	c := Client{
+		svc: mockSvc,
+	}
+	rules, err := c.GetRules("crowdsec")
+	assert.NilError(t, err)
+	assert.Equal(t, 5, len(rules))
+	assert.Equal(t, "crowdsec-bingo-jumbo", rules[0].Name)
+	assert.Equal(t, "crowdsec", rules[0].Owner)
+	assert.Equal(t, models.Modified, rules[0].State)
+	assert.Equal(t, "crowdsec-prod-aws-0", rules[1].Name)
+	assert.Equal(t, "crowdsec-prod", rules[1].Owner)
+	assert.Equal(t, "crowdsec-manual", rules[2].Name)
+	assert.Equal(t, models.ForeignOwner, rules[2].Owner)
+	// the legacy rule group of the crowdsec-prod bouncer is not adopted
+	assert.Equal(t, "crowdsec-prod-yoga-zebra", rules[3].Name)
+	assert.Equal(t, models.ForeignOwner, rules[3].Owner)
+	assert.Equal(t, "", string(rules[3].State))
+	assert.Equal(t, "crowdsec-aws-0", rules[4].Name)
+	assert.Equal(t, models.ReservedNameOwner, rules[4].Owner)
+
+	err = c.PatchRule(&models.FirewallRule{Name: "crowdsec-prod-aws-0", Owner: "crowdsec"})
+	assert.ErrorContains(t, err, "refusing to update rule group crowdsec-prod-aws-0 owned by crowdsec-prod")
+
+	assert.NilError(t, c.PatchRule(rules[0]))
+	assert.Equal(t, 1, len(mockSvc.tagged))
+	assert.Equal(t, "arn:aws:crowdsec-bingo-jumbo", *mockSvc.tagged[0].ResourceArn)
+	assert.Equal(t, "crowdsec", getOwner(mockSvc.tagged[0].Tags))
+}
+
+type mockedPreflightSvc struct {
+	mockedAWSSvc
+	requests []string
+}
+
+func (s *mockedPreflightSvc) ListRuleGroups(*networkfirewall.ListRuleGroupsInput) (*networkfirewall.ListRuleGroupsOutput, error) {
+	return nil, fmt.Errorf("AccessDeniedException")
+}
+
+func (s *mockedPreflightSvc) CreateRuleGroup(input *networkfirewall.CreateRuleGroupInput) (*networkfirewall.CreateRuleGroupOutput, error) {
+	s.requests = append(s.requests, fmt.Sprintf("create %s dry-run=%t", *input.RuleGroupName, aws.BoolValue(input.DryRun)))
+	return &networkfirewall.CreateRuleGroupOutput{}, nil
+}
+
+func (s *mockedPreflightSvc) UpdateFirewallPolicy(input *networkfirewall.UpdateFirewallPolicyInput) (*networkfirewall.UpdateFirewallPolicyOutput, error) {
+	s.requests = append(s.requests, fmt.Sprintf("update %s dry-run=%t", *input.FirewallPolicyArn, aws.BoolValue(input.DryRun)))
+	return &networkfirewall.UpdateFirewallPolicyOutput{}, nil
+}
+
+func TestPreflight(t *testing.T) {
+	svc := &mockedPreflightSvc{}
+	client := &Client{svc: svc, capacity: 100, firewallPolicy: "firewall-policy", ruleGroupPriority: 1, action: defaultAction}
+	checks := client.Preflight()
+	assert.Equal(t, 4, len(checks))
+	assert.NilError(t, checks[0].Err)
+	assert.ErrorContains(t, checks[1].Err, "unable to list rule groups")
+	assert.NilError(t, checks[2].Err)
+	assert.NilError(t, checks[3].Err)
+	assert.DeepEqual(t, []string{
+		"create crowdsec-bouncer-preflight dry-run=true",
+		"update arn:aws:firewall-policy dry-run=true",
+	}, svc.requests)
 }
@@ -0,0 +1,214 @@
+package cloudarmor
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/networksecurity/v1"
+	"google.golang.org/api/option"
+)
+
+// operationPollInterval is the interval between two checks of a pending network security operation.
+const operationPollInterval = 2 * time.Second
+
+type AddressGroupsServiceIface interface {
+	GetAddressGroup(name string) (*networksecurity.AddressGroup, error)
+	CreateAddressGroup(parent string, id string, addressGroup *networksecurity.AddressGroup) error
+	PatchAddressGroupItems(name string, items []string) error
+	DeleteAddressGroup(name string) error
+}
+
+// AddressGroupsService manages Network Security address groups, waiting for their operations to complete.
+type AddressGroupsService struct {
+	svc *networksecurity.Service
+}
+
+// NewAddressGroupsService creates the network security service.
+func NewAddressGroupsService(endpoint string, credentials ...option.ClientOption) *AddressGroupsService {
+	svc, err := networksecurity.NewService(context.Background(), getClientOptions(endpoint, credentials)...)
+	if err != nil {
+		log.Fatalf("Unable to create new network security service: %s", err)
+	}
+	return &AddressGroupsService{svc}
+}
+
+func (s *AddressGroupsService) GetAddressGroup(name string) (*networksecurity.AddressGroup, error) {
+	return s.svc.Projects.Locations.AddressGroups.Get(name).Do()
+}
+
+func (s *AddressGroupsService) CreateAddressGroup(parent string, id string, addressGroup *networksecurity.AddressGroup) error {
+	op, err := s.svc.Projects.Locations.AddressGroups.Create(parent, addressGroup).AddressGroupId(id).Do()
+	if err != nil {
+		return err
+	}
+	return s.waitOperation(op)
+}
+
+func (s *AddressGroupsService) PatchAddressGroupItems(name string, items []string) error {
+	addressGroup := &networksecurity.AddressGroup{Items: items}
+	if len(items) == 0 {
+		addressGroup.NullFields = []string{"Items"}
+	}
+	op, err := s.svc.Projects.Locations.AddressGroups.Patch(name, addressGroup).UpdateMask("items").Do()
+	if err != nil {
+		return err
+	}
+	return s.waitOperation(op)
+}
+
+func (s *AddressGroupsService) DeleteAddressGroup(name string) error {
+	op, err := s.svc.Projects.Locations.AddressGroups.Delete(name).Do()
+	if err != nil {
+		return err
+	}
+	return s.waitOperation(op)
+}
+
+func (s *AddressGroupsService) waitOperation(op *networksecurity.Operation) error {
+	var err error
+	for !op.Done {
+		time.Sleep(operationPollInterval)
+		op, err = s.svc.Projects.Locations.Operations.Get(op.Name).Do()
+		if err != nil {
+			return fmt.Errorf("problem waiting on operation: %s", err)
+		}
+	}
+	if op.Error != nil {
+		return fmt.Errorf("operation %s failed: %s", op.Name, op.Error.Message)
+	}
+	return nil
+}
+
+const (
+	// maxAddressGroupIDLength is the maximum length of an address group ID.
+	maxAddressGroupIDLength = 63
+	// addressGroupHashLength is the length of the hash replacing the end of the rule names too long for an ID.
+	addressGroupHashLength = 8
+)
+
+// getAddressGroupIDs returns the IDs of the IPv4 and IPv6 address groups of the rule.
+func getAddressGroupIDs(ruleName string) (string, string) {
+	return getAddressGroupID(ruleName, "ipv4"), getAddressGroupID(ruleName, "ipv6")
+}
+
+// getAddressGroupID returns the ID of an address group of the rule. The end of a rule name too long for an ID is
+// replaced by a hash of the name, so that the rules sharing the beginning of their name get different IDs.
+func getAddressGroupID(ruleName string, suffix string) string {
+	if len(ruleName)+len(suffix)+1 > maxAddressGroupIDLength {
+		hash := fmt.Sprintf("%x", sha256.Sum256([]byte(ruleName)))[:addressGroupHashLength]
+		ruleName = strings.TrimRight(ruleName[:maxAddressGroupIDLength-len(suffix)-addressGroupHashLength-2], "-") + "-" + hash
+	}
+	return fmt.Sprintf("%s-%s", ruleName, suffix)
+}
+
+// splitSourcesByFamily returns the IPv4 and the IPv6 sources.
+func splitSourcesByFamily(sources map[string]bool) ([]string, []string) {
+	ipv4 := []string{}
+	ipv6 := []string{}
+	for _, source := range models.ConvertSourceRangesMapToSlice(sources) {
+		if strings.Contains(source, ":") {
+			ipv6 = append(ipv6, source)
+		} else {
+			ipv4 = append(ipv4, source)
+		}
+	}
+	return ipv4, ipv6
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusNotFound
+}
+
+func (c *Client) usesAddressGroups(rule *models.FirewallRule) bool {
+	return c.addressGroups.Enabled && rule.Scope == models.IPScope
+}
+
+func (c *Client) getAddressGroupsParent() string {
+	return fmt.Sprintf("projects/%s/locations/%s", c.project, c.location)
+}
+
+func (c *Client) getAddressGroupName(id string) string {
+	return fmt.Sprintf("%s/addressGroups/%s", c.getAddressGroupsParent(), id)
+}
+
+// getAddressGroupsItems returns the IP ranges of the address groups.
+func (c *Client) getAddressGroupsItems(ids []string) ([]string, error) {
+	items := []string{}
+	for _, id := range ids {
+		addressGroup, err := c.addressGroupsSvc.GetAddressGroup(c.getAddressGroupName(id))
+		if err != nil {
+			return nil, fmt.Errorf("unable to get address group %s: %s", id, err)
+		}
+		items = append(items, addressGroup.Items...)
+	}
+	return items, nil
+}
+
+func (c *Client) createAddressGroup(id string, addressGroupType string, items []string) error {
+	log.Infof("creating address group %s with %d items", id, len(items))
+	addressGroup := &networksecurity.AddressGroup{
+		Type:        addressGroupType,
+		Capacity:    c.addressGroups.Capacity,
+		Items:       items,
+		Description: "Managed by the CrowdSec cloud firewall bouncer",
+	}
+	if err := c.addressGroupsSvc.CreateAddressGroup(c.getAddressGroupsParent(), id, addressGroup); err != nil {
+		return fmt.Errorf("unable to create address group %s: %s", id, err)
+	}
+	return nil
+}
+
+// createAddressGroups creates the IPv4 and IPv6 address groups of the rule.
+func (c *Client) createAddressGroups(rule *models.FirewallRule) error {
+	ipv4ID, ipv6ID := getAddressGroupIDs(rule.Name)
+	ipv4, ipv6 := splitSourcesByFamily(rule.SourceRanges)
+	if err := c.createAddressGroup(ipv4ID, "IPV4", ipv4); err != nil {
+		return err
+	}
+	return c.createAddressGroup(ipv6ID, "IPV6", ipv6)
+}
+
+// patchAddressGroups replaces the items of the address groups of the rule. Missing address groups,
+// such as the ones of rules created before enabling address groups, are created.
+func (c *Client) patchAddressGroups(rule *models.FirewallRule) error {
+	ipv4ID, ipv6ID := getAddressGroupIDs(rule.Name)
+	ipv4, ipv6 := splitSourcesByFamily(rule.SourceRanges)
+	groups := []struct {
+		id               string
+		addressGroupType string
+		items            []string
+	}{
+		{ipv4ID, "IPV4", ipv4},
+		{ipv6ID, "IPV6", ipv6},
+	}
+	for _, group := range groups {
+		log.Infof("patching address group %s with %d items", group.id, len(group.items))
+		err := c.addressGroupsSvc.PatchAddressGroupItems(c.getAddressGroupName(group.id), group.items)
+		if isNotFound(err) {
+			err = c.createAddressGroup(group.id, group.addressGroupType, group.items)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to patch address group %s: %s", group.id, err)
+		}
+	}
+	return nil
+}
+
+// deleteAddressGroups deletes the address groups of the rule, ignoring the ones that do not exist.
+func (c *Client) deleteAddressGroups(rule *models.FirewallRule) error {
+	ipv4ID, ipv6ID := getAddressGroupIDs(rule.Name)
+	for _, id := range []string{ipv4ID, ipv6ID} {
+		log.Infof("deleting address group %s", id)
+		if err := c.addressGroupsSvc.DeleteAddressGroup(c.getAddressGroupName(id)); err != nil && !isNotFound(err) {
+			return fmt.Errorf("unable to delete address group %s: %s", id, err)
+		}
+	}
+	return nil
+}
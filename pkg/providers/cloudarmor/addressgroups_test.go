@@ -0,0 +1,158 @@
+package cloudarmor
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/networksecurity/v1"
+	"gotest.tools/assert"
+)
+
+type mockAddressGroupsSvc struct {
+	AddressGroupsServiceIface
+	groups  map[string][]string
+	created []*networksecurity.AddressGroup
+	deleted []string
+}
+
+func (s *mockAddressGroupsSvc) GetAddressGroup(name string) (*networksecurity.AddressGroup, error) {
+	items, ok := s.groups[name]
+	if !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound}
+	}
+	return &networksecurity.AddressGroup{Name: name, Items: items}, nil
+}
+
+func (s *mockAddressGroupsSvc) CreateAddressGroup(parent string, id string, addressGroup *networksecurity.AddressGroup) error {
+	s.groups[parent+"/addressGroups/"+id] = addressGroup.Items
+	s.created = append(s.created, addressGroup)
+	return nil
+}
+
+func (s *mockAddressGroupsSvc) PatchAddressGroupItems(name string, items []string) error {
+	if _, ok := s.groups[name]; !ok {
+		return &googleapi.Error{Code: http.StatusNotFound}
+	}
+	s.groups[name] = items
+	return nil
+}
+
+func (s *mockAddressGroupsSvc) DeleteAddressGroup(name string) error {
+	s.deleted = append(s.deleted, name)
+	if _, ok := s.groups[name]; !ok {
+		return &googleapi.Error{Code: http.StatusNotFound}
+	}
+	delete(s.groups, name)
+	return nil
+}
+
+type mockAddressGroupsPolicySvc struct {
+	mockPreviewSvc
+}
+
+func (s *mockAddressGroupsPolicySvc) GetFirewallPolicy(project string, policyName string) (*compute.SecurityPolicy, error) {
+	return &compute.SecurityPolicy{
+		Rules: []*compute.SecurityPolicyRule{
+			{
+				Description: "crowdsec-bingo-jumbo",
+				Match: &compute.SecurityPolicyRuleMatcher{
+					Expr: &compute.Expr{
+						Expression: "evaluateAddressGroup('crowdsec-bingo-jumbo-ipv4', origin.ip) || evaluateAddressGroup('crowdsec-bingo-jumbo-ipv6', origin.ip)",
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+func newAddressGroupsClient() (*Client, *mockAddressGroupsSvc, *mockAddressGroupsPolicySvc) {
+	addressGroupsSvc := &mockAddressGroupsSvc{groups: map[string][]string{}}
+	svc := &mockAddressGroupsPolicySvc{mockPreviewSvc{patched: map[int64]*compute.SecurityPolicyRule{}}}
+	c := &Client{
+		svc:              svc,
+		project:          "project",
+		action:           "deny(403)",
+		addressGroupsSvc: addressGroupsSvc,
+		addressGroups:    models.CloudArmorAddressGroupsConfig{Enabled: true, Capacity: 1000},
+		location:         "global",
+	}
+	return c, addressGroupsSvc, svc
+}
+
+func TestAddressGroupsCreateRule(t *testing.T) {
+	c, addressGroupsSvc, svc := newAddressGroupsClient()
+	rule := models.FirewallRule{
+		Name:         "crowdsec-bingo-jumbo",
+		SourceRanges: map[string]bool{"1.0.0.0/32": true, "2001:db8::/32": true},
+	}
+	assert.NilError(t, c.CreateRule(&rule))
+	assert.Equal(t, 1000, c.MaxSourcesPerRule())
+	assert.Equal(t, 2, len(addressGroupsSvc.created))
+	assert.Equal(t, "IPV4", addressGroupsSvc.created[0].Type)
+	assert.Equal(t, int64(1000), addressGroupsSvc.created[0].Capacity)
+	assert.DeepEqual(t, []string{"1.0.0.0/32"}, addressGroupsSvc.groups["projects/project/locations/global/addressGroups/crowdsec-bingo-jumbo-ipv4"])
+	assert.DeepEqual(t, []string{"2001:db8::/32"}, addressGroupsSvc.groups["projects/project/locations/global/addressGroups/crowdsec-bingo-jumbo-ipv6"])
+	assert.Equal(t, 1, len(svc.added))
+	assert.Equal(t, "evaluateAddressGroup('crowdsec-bingo-jumbo-ipv4', origin.ip) || evaluateAddressGroup('crowdsec-bingo-jumbo-ipv6', origin.ip)", svc.added[0].Match.Expr.Expression)
+}
+
+func TestAddressGroupsGetRules(t *testing.T) {
+	c, addressGroupsSvc, _ := newAddressGroupsClient()
+	addressGroupsSvc.groups["projects/project/locations/global/addressGroups/crowdsec-bingo-jumbo-ipv4"] = []string{"1.0.0.0/32", "1.1.0.0/32"}
+	addressGroupsSvc.groups["projects/project/locations/global/addressGroups/crowdsec-bingo-jumbo-ipv6"] = []string{"2001:db8::/32"}
+	rules, err := c.GetRules("crowdsec")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(rules))
+	assert.Equal(t, models.IPScope, rules[0].Scope)
+	assert.Equal(t, 3, len(rules[0].SourceRanges))
+	assert.Equal(t, true, rules[0].SourceRanges["2001:db8::/32"])
+}
+
+func TestAddressGroupsPatchRule(t *testing.T) {
+	c, addressGroupsSvc, svc := newAddressGroupsClient()
+	addressGroupsSvc.groups["projects/project/locations/global/addressGroups/crowdsec-bingo-jumbo-ipv4"] = []string{"1.0.0.0/32"}
+	rule := models.FirewallRule{
+		Name:         "crowdsec-bingo-jumbo",
+		SourceRanges: map[string]bool{"1.1.0.0/32": true},
+	}
+	assert.NilError(t, c.PatchRule(&rule))
+	assert.DeepEqual(t, []string{"1.1.0.0/32"}, addressGroupsSvc.groups["projects/project/locations/global/addressGroups/crowdsec-bingo-jumbo-ipv4"])
+	// the missing IPv6 address group is created
+	assert.Equal(t, 1, len(addressGroupsSvc.created))
+	assert.Equal(t, "IPV6", addressGroupsSvc.created[0].Type)
+	assert.Assert(t, strings.HasPrefix(svc.patched[0].Match.Expr.Expression, "evaluateAddressGroup"))
+}
+
+func TestAddressGroupsDeleteRule(t *testing.T) {
+	c, addressGroupsSvc, _ := newAddressGroupsClient()
+	addressGroupsSvc.groups["projects/project/locations/global/addressGroups/crowdsec-bingo-jumbo-ipv4"] = []string{}
+	rule := models.FirewallRule{
+		Name:         "crowdsec-bingo-jumbo",
+		SourceRanges: map[string]bool{},
+	}
+	assert.NilError(t, c.DeleteRule(&rule))
+	assert.Equal(t, 2, len(addressGroupsSvc.deleted))
+	assert.Equal(t, 0, len(addressGroupsSvc.groups))
+}
+
+func TestGetAddressGroupIDs(t *testing.T) {
+	ipv4, ipv6 := getAddressGroupIDs("crowdsec-bingo-jumbo")
+	assert.Equal(t, "crowdsec-bingo-jumbo-ipv4", ipv4)
+	assert.Equal(t, "crowdsec-bingo-jumbo-ipv6", ipv6)
+
+	// the rules of a long prefix sharing the beginning of their name get different IDs
+	prefix := strings.Repeat("a", 44)
+	ids := map[string]bool{}
+	for i := 100; i < 110; i++ {
+		ipv4, _ = getAddressGroupIDs(fmt.Sprintf("%s-cloudarmor-%d", prefix, i))
+		assert.Assert(t, len(ipv4) <= maxAddressGroupIDLength)
+		assert.Assert(t, strings.HasPrefix(ipv4, prefix+"-clou"))
+		ids[ipv4] = true
+	}
+	assert.Equal(t, 10, len(ids))
+}
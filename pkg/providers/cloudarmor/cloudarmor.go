@@ -1,27 +1,60 @@
 package cloudarmor
 
 import (
-	"context"
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/providers/googleauth"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/oauth2/google"
 	"google.golang.org/api/compute/v1"
 )
 
 type Client struct {
-	svc      GoogleComputeServiceIface
-	project  string
-	policy   string
-	priority int64
-	maxRules int
+	svc        GoogleComputeServiceIface
+	project    string
+	policy     string
+	policyType string
+	priority   int64
+	maxRules   int
+	action     string
+	redirect   models.CloudArmorRedirectConfig
+	rateLimit  models.CloudArmorRateLimitConfig
+	captcha    models.CloudArmorCaptchaConfig
+	ruleSets   []models.RuleSet
+	preview    bool
+	// addressGroupsSvc is only set when address groups are enabled.
+	addressGroupsSvc AddressGroupsServiceIface
+	addressGroups    models.CloudArmorAddressGroupsConfig
+	location         string
 }
 
 const (
-	providerName    = "cloudarmor"
-	defaultMaxRules = 100
+	providerName        = "cloudarmor"
+	defaultMaxRules     = 100
+	defaultAction       = "deny(403)"
+	defaultPolicyType   = "CLOUD_ARMOR"
+	defaultExceedAction = "deny(429)"
+	defaultEnforceOnKey = "IP"
+	// defaultCaptchaMaxRules is the default maximum number of rules enforcing captcha decisions.
+	defaultCaptchaMaxRules = 20
+	// defaultExpressionsMaxRules is the default maximum number of expression rules per scope and decision type.
+	defaultExpressionsMaxRules = 10
+	// maxSubexpressionsPerRule is the maximum number of subexpressions of a cloud armor rule expression.
+	maxSubexpressionsPerRule = 5
+	// defaultAddressGroupCapacity is the default maximum number of IP ranges of an address group.
+	defaultAddressGroupCapacity = 1000
+)
+
+var (
+	countryExpression      = regexp.MustCompile(`origin\.region_code == '([A-Z]{2})'`)
+	asExpression           = regexp.MustCompile(`origin\.asn == (\d+)`)
+	countryCode            = regexp.MustCompile(`^[A-Z]{2}$`)
+	asNumber               = regexp.MustCompile(`^\d+$`)
+	addressGroupExpression = regexp.MustCompile(`evaluateAddressGroup\('([a-z0-9-]+)', origin\.ip\)`)
 )
 
 var log *logrus.Entry
@@ -31,6 +64,9 @@ func init() {
 }
 
 func (c *Client) MaxSourcesPerRule() int {
+	if c.addressGroups.Enabled {
+		return int(c.addressGroups.Capacity)
+	}
 	return 10
 }
 func (c *Client) MaxRules() int {
@@ -40,16 +76,79 @@ func (c *Client) Priority() int64 {
 	return c.priority
 }
 
-func getProjectIDFromCredentials(config *models.CloudArmorConfig) (string, error) {
-	ctx := context.Background()
-	credentials, error := google.FindDefaultCredentials(ctx, compute.ComputeScope)
-	if error != nil {
-		return "", error
+// RuleSets returns the rule sets maintained in the security policy.
+func (c *Client) RuleSets() []models.RuleSet {
+	return c.ruleSets
+}
+
+// getRuleSets returns the rule set enforcing bans and, if enabled, the rule set enforcing captcha decisions.
+// When expressions are enabled, each decision type also gets a rule set for the country scope and for the AS scope,
+// allocated one after the other starting at the expressions priority.
+func getRuleSets(config *models.CloudArmorConfig) []models.RuleSet {
+	ruleSets := []models.RuleSet{{
+		Type:        models.Ban,
+		Priority:    config.Priority,
+		MaxRules:    config.MaxRules,
+		MaxPriority: config.PriorityRange.Max,
+	}}
+	types := []string{models.Ban}
+	if config.Captcha.Enabled {
+		ruleSets = append(ruleSets, models.RuleSet{
+			Type:        models.Captcha,
+			Priority:    config.Captcha.Priority,
+			MaxRules:    config.Captcha.MaxRules,
+			MaxPriority: config.PriorityRange.Max,
+		})
+		types = append(types, models.Captcha)
+	}
+	if !config.Expressions.Enabled {
+		return ruleSets
+	}
+	priority := config.Expressions.Priority
+	for _, ruleType := range types {
+		for _, scope := range []string{models.CountryScope, models.ASScope} {
+			ruleSets = append(ruleSets, models.RuleSet{
+				Type:              ruleType,
+				Scope:             scope,
+				Priority:          priority,
+				MaxRules:          config.Expressions.MaxRules,
+				MaxSourcesPerRule: maxSubexpressionsPerRule,
+				MaxPriority:       config.PriorityRange.Max,
+			})
+			priority += int64(config.Expressions.MaxRules)
+		}
 	}
-	if credentials.ProjectID == "" {
-		return "", fmt.Errorf("Default credentials does not have a project ID associated")
+	return ruleSets
+}
+
+// checkRuleSetsPriority checks that the priority ranges of the rule sets are within the priority range and do not overlap.
+func checkRuleSetsPriority(ruleSets []models.RuleSet, priorityRange models.PriorityRange) error {
+	for i, a := range ruleSets {
+		aLast := a.Priority + int64(a.MaxRules) - 1
+		if !priorityRange.Contains(a.Priority) || !priorityRange.Contains(aLast) {
+			return fmt.Errorf("priority range %d-%d of %s %s rules is not within priority_range %d-%d",
+				a.Priority, aLast, a.Type, getScopeName(a.Scope), priorityRange.Min, priorityRange.Max)
+		}
+		for _, b := range ruleSets[i+1:] {
+			bLast := b.Priority + int64(b.MaxRules) - 1
+			if a.Priority <= bLast && b.Priority <= aLast {
+				return fmt.Errorf("priority range %d-%d of %s %s rules overlaps priority range %d-%d of %s %s rules",
+					b.Priority, bLast, b.Type, getScopeName(b.Scope), a.Priority, aLast, a.Type, getScopeName(a.Scope))
+			}
+		}
 	}
-	return credentials.ProjectID, nil
+	return nil
+}
+
+func getScopeName(scope string) string {
+	if scope == models.IPScope {
+		return "IP"
+	}
+	return scope
+}
+
+func getProjectIDFromCredentials(config *models.CloudArmorConfig) (string, error) {
+	return googleauth.GetProjectID(config.CredentialsFile)
 }
 
 func checkCloudArmorConfig(config *models.CloudArmorConfig) error {
@@ -69,7 +168,46 @@ func checkCloudArmorConfig(config *models.CloudArmorConfig) error {
 	if config.MaxRules == 0 {
 		config.MaxRules = defaultMaxRules
 	}
-	return nil
+	if config.Priority == 0 {
+		config.Priority = config.PriorityRange.Min
+	}
+	if config.PolicyType == "" {
+		config.PolicyType = defaultPolicyType
+	}
+	if config.Action == "" {
+		config.Action = defaultAction
+	}
+	if config.Action == "throttle" {
+		if config.RateLimit.ExceedAction == "" {
+			config.RateLimit.ExceedAction = defaultExceedAction
+		}
+		if config.RateLimit.EnforceOnKey == "" {
+			config.RateLimit.EnforceOnKey = defaultEnforceOnKey
+		}
+	}
+	if config.Captcha.Enabled {
+		if config.Captcha.Priority == 0 {
+			config.Captcha.Priority = config.Priority + int64(config.MaxRules)
+		}
+		if config.Captcha.MaxRules == 0 {
+			config.Captcha.MaxRules = defaultCaptchaMaxRules
+		}
+	}
+	if config.AddressGroups.Enabled && config.AddressGroups.Capacity == 0 {
+		config.AddressGroups.Capacity = defaultAddressGroupCapacity
+	}
+	if config.Expressions.Enabled {
+		if config.Expressions.Priority == 0 {
+			config.Expressions.Priority = config.Priority + int64(config.MaxRules)
+			if config.Captcha.Enabled && config.Captcha.Priority+int64(config.Captcha.MaxRules) > config.Expressions.Priority {
+				config.Expressions.Priority = config.Captcha.Priority + int64(config.Captcha.MaxRules)
+			}
+		}
+		if config.Expressions.MaxRules == 0 {
+			config.Expressions.MaxRules = defaultExpressionsMaxRules
+		}
+	}
+	return checkRuleSetsPriority(getRuleSets(config), config.PriorityRange)
 }
 
 // NewClient creates a new GCP client
@@ -79,16 +217,89 @@ func NewClient(config *models.CloudArmorConfig) (*Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error while checking GCP config: %s", err)
 	}
+	credentials, err := googleauth.GetClientOptions(config.CredentialsFile, config.ImpersonateServiceAccount)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading credentials: %s", err)
+	}
+
+	location := "global"
+	if config.Region != "" {
+		location = config.Region
+	}
+	var addressGroupsSvc AddressGroupsServiceIface
+	if config.AddressGroups.Enabled {
+		addressGroupsSvc = NewAddressGroupsService(config.Endpoint, credentials...)
+	}
 
 	return &Client{
-		svc:      NewGoogleComputeService(config.Endpoint),
-		project:  config.ProjectID,
-		policy:   config.Policy,
-		priority: config.Priority,
-		maxRules: config.MaxRules,
+		svc:              NewGoogleComputeService(config.Endpoint, config.Region, credentials...),
+		project:          config.ProjectID,
+		policy:           config.Policy,
+		policyType:       config.PolicyType,
+		priority:         config.Priority,
+		maxRules:         config.MaxRules,
+		action:           config.Action,
+		redirect:         config.Redirect,
+		rateLimit:        config.RateLimit,
+		captcha:          config.Captcha,
+		ruleSets:         getRuleSets(config),
+		preview:          config.Preview,
+		addressGroupsSvc: addressGroupsSvc,
+		addressGroups:    config.AddressGroups,
+		location:         location,
 	}, nil
 }
 
+// getPermissions returns the permissions needed to maintain the rules of the security policy and the address groups.
+func (c *Client) getPermissions() []string {
+	permissions := []string{"compute.securityPolicies.get", "compute.securityPolicies.update"}
+	if c.location != "global" {
+		permissions = []string{"compute.regionSecurityPolicies.get", "compute.regionSecurityPolicies.update"}
+	}
+	if c.addressGroupsSvc != nil {
+		permissions = append(permissions,
+			"networksecurity.addressGroups.create",
+			"networksecurity.addressGroups.delete",
+			"networksecurity.addressGroups.get",
+			"networksecurity.addressGroups.update",
+		)
+	}
+	return permissions
+}
+
+// Preflight checks that the security policy exists and that the permissions needed to maintain its rules are granted
+// on the project.
+func (c *Client) Preflight() []models.PreflightCheck {
+	policyCheck := models.PreflightCheck{Name: fmt.Sprintf("security policy %s", c.policy)}
+	if _, err := c.svc.GetFirewallPolicy(c.project, c.policy); err != nil {
+		policyCheck.Err = fmt.Errorf("unable to get security policy %s in %s of project %s: %s", c.policy, c.location, c.project, err)
+	}
+	permissionsCheck := models.PreflightCheck{Name: fmt.Sprintf("permissions on project %s", c.project)}
+	permissions := c.getPermissions()
+	granted, err := c.svc.TestPermissions(c.project, permissions)
+	if err != nil {
+		permissionsCheck.Err = fmt.Errorf("unable to test permissions: %s", err)
+	} else if missing := getMissingPermissions(permissions, granted); len(missing) > 0 {
+		permissionsCheck.Err = fmt.Errorf("missing permission(s) %s", strings.Join(missing, ", "))
+	}
+	return []models.PreflightCheck{policyCheck, permissionsCheck}
+}
+
+// getMissingPermissions returns the required permissions that are not granted.
+func getMissingPermissions(required []string, granted []string) []string {
+	grantedMap := make(map[string]bool)
+	for _, permission := range granted {
+		grantedMap[permission] = true
+	}
+	missing := []string{}
+	for _, permission := range required {
+		if !grantedMap[permission] {
+			missing = append(missing, permission)
+		}
+	}
+	return missing
+}
+
 func (c *Client) GetProviderName() string {
 	return providerName
 }
@@ -98,39 +309,221 @@ func (c *Client) GetRules(ruleNamePrefix string) ([]*models.FirewallRule, error)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get firewall policy %s: %s", c.policy, err)
 	}
+	if c.policyType != "" && res.Type != "" && res.Type != c.policyType {
+		return nil, fmt.Errorf("firewall policy %s is of type %s, expecting %s", c.policy, res.Type, c.policyType)
+	}
 
 	var rules []*models.FirewallRule
 	for _, r := range res.Rules {
-		if !strings.HasPrefix(r.Description, ruleNamePrefix) {
+		marker := getRuleMarker(r.Description)
+		if !strings.HasPrefix(marker.Name, ruleNamePrefix) {
+			// Other policy rules are returned so that their priorities are not assigned to new rules.
+			rules = append(rules, &models.FirewallRule{Name: marker.Name, Priority: r.Priority, Owner: models.ForeignOwner})
 			continue
 		}
-		log.Infof("%s  (%d sources): %#v", r.Description, len(r.Match.Config.SrcIpRanges), r.Match.Config.SrcIpRanges)
+		scope, sources, err := c.getPolicyRuleSources(r)
+		if err != nil {
+			log.Warningf("policy rule %s will not be updated: %s", marker.Name, err)
+			rules = append(rules, &models.FirewallRule{Name: marker.Name, Priority: r.Priority, Owner: models.ForeignOwner})
+			continue
+		}
+		log.Debugf("%s  (%d sources): %#v", marker.Name, len(sources), sources)
 		rule := models.FirewallRule{
-			Name:         r.Description,
-			SourceRanges: models.ConvertSourceRangesSliceToMap(r.Match.Config.SrcIpRanges),
+			Name:         marker.Name,
+			SourceRanges: models.ConvertSourceRangesSliceToMap(sources),
 			Priority:     r.Priority,
+			Type:         c.getRuleType(r),
+			Scope:        scope,
+			Owner:        marker.Owner,
+		}
+		if marker.Owner == "" && !models.IsLegacyRuleName(ruleNamePrefix, marker.Name) {
+			log.Debugf("policy rule %s has no ownership marker and is not named after %s, it is left to its bouncer", marker.Name, ruleNamePrefix)
+			rule.Owner = models.ForeignOwner
+		} else if marker.Owner == "" {
+			log.Infof("policy rule %s has no ownership marker, it will be patched", marker.Name)
+			rule.Owner = ruleNamePrefix
+			rule.State = models.Modified
 		}
 		rules = append(rules, &rule)
 	}
 	return rules, nil
 }
 
+// ruleMarker is the ownership marker stored as JSON in the description of the policy rules.
+type ruleMarker struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+}
+
+// getRuleMarker returns the marker stored in the description of a policy rule. Rules created before
+// ownership markers have the rule name as description and get an empty owner.
+func getRuleMarker(description string) ruleMarker {
+	marker := ruleMarker{}
+	if err := json.Unmarshal([]byte(description), &marker); err != nil || marker.Name == "" {
+		return ruleMarker{Name: description}
+	}
+	return marker
+}
+
+// getDescription returns the description of the policy rule, holding its name and owner.
+func getDescription(rule *models.FirewallRule) string {
+	description, _ := json.Marshal(ruleMarker{Name: rule.Name, Owner: rule.Owner})
+	return string(description)
+}
+
+// getPolicyRuleSources returns the scope and the sources matched by the policy rule, including the IP ranges
+// of the address groups it references when address groups are enabled.
+func (c *Client) getPolicyRuleSources(policyRule *compute.SecurityPolicyRule) (string, []string, error) {
+	if c.addressGroups.Enabled && policyRule.Match != nil && policyRule.Match.Expr != nil {
+		matches := addressGroupExpression.FindAllStringSubmatch(policyRule.Match.Expr.Expression, -1)
+		if len(matches) > 0 {
+			sources, err := c.getAddressGroupsItems(getSubmatches(matches))
+			return models.IPScope, sources, err
+		}
+	}
+	return getRuleSources(policyRule)
+}
+
+// getRuleSources returns the scope and the sources matched by the policy rule,
+// either from its source IP ranges or from its country or AS expression.
+func getRuleSources(policyRule *compute.SecurityPolicyRule) (string, []string, error) {
+	if policyRule.Match == nil {
+		return "", nil, fmt.Errorf("rule has no matcher")
+	}
+	if policyRule.Match.Expr == nil {
+		if policyRule.Match.Config == nil {
+			return "", nil, fmt.Errorf("rule has no source ip ranges")
+		}
+		return models.IPScope, policyRule.Match.Config.SrcIpRanges, nil
+	}
+	expression := policyRule.Match.Expr.Expression
+	if matches := countryExpression.FindAllStringSubmatch(expression, -1); len(matches) > 0 {
+		return models.CountryScope, getSubmatches(matches), nil
+	}
+	if matches := asExpression.FindAllStringSubmatch(expression, -1); len(matches) > 0 {
+		return models.ASScope, getSubmatches(matches), nil
+	}
+	return "", nil, fmt.Errorf("unable to parse expression %s", expression)
+}
+
+func getSubmatches(matches [][]string) []string {
+	submatches := []string{}
+	for _, match := range matches {
+		submatches = append(submatches, match[1])
+	}
+	return submatches
+}
+
+// getExpression returns the expression matching any of the countries or AS numbers of the sources.
+// Sources that are not valid country codes or AS numbers are ignored.
+func getExpression(scope string, sources map[string]bool) string {
+	subexpressions := []string{}
+	for _, source := range models.ConvertSourceRangesMapToSlice(sources) {
+		switch {
+		case scope == models.CountryScope && countryCode.MatchString(source):
+			subexpressions = append(subexpressions, fmt.Sprintf("origin.region_code == '%s'", source))
+		case scope == models.ASScope && asNumber.MatchString(source):
+			subexpressions = append(subexpressions, fmt.Sprintf("origin.asn == %s", source))
+		default:
+			log.Warningf("ignoring invalid %s source %s", scope, source)
+		}
+	}
+	sort.Strings(subexpressions)
+	return strings.Join(subexpressions, " || ")
+}
+
+// getMatcher returns the matcher of the policy rule: source IP ranges for the IP scope, an expression otherwise.
+func getMatcher(rule *models.FirewallRule) *compute.SecurityPolicyRuleMatcher {
+	if rule.Scope != models.IPScope {
+		return &compute.SecurityPolicyRuleMatcher{
+			Expr: &compute.Expr{
+				Expression: getExpression(rule.Scope, rule.SourceRanges),
+			},
+		}
+	}
+	return &compute.SecurityPolicyRuleMatcher{
+		Config: &compute.SecurityPolicyRuleMatcherConfig{
+			SrcIpRanges: models.ConvertSourceRangesMapToSlice(rule.SourceRanges),
+		},
+		VersionedExpr: "SRC_IPS_V1",
+	}
+}
+
+// getMatcher returns the matcher of the policy rule, referencing the address groups of the rule for the IP scope
+// when address groups are enabled.
+func (c *Client) getMatcher(rule *models.FirewallRule) *compute.SecurityPolicyRuleMatcher {
+	if !c.addressGroups.Enabled || rule.Scope != models.IPScope {
+		return getMatcher(rule)
+	}
+	ipv4, ipv6 := getAddressGroupIDs(rule.Name)
+	return &compute.SecurityPolicyRuleMatcher{
+		Expr: &compute.Expr{
+			Expression: fmt.Sprintf("evaluateAddressGroup('%s', origin.ip) || evaluateAddressGroup('%s', origin.ip)", ipv4, ipv6),
+		},
+	}
+}
+
+// getRuleType returns the decision type enforced by the policy rule.
+// Rules redirecting to reCAPTCHA enforce captcha decisions when captcha is enabled, all other rules enforce bans.
+func (c *Client) getRuleType(policyRule *compute.SecurityPolicyRule) string {
+	if c.captcha.Enabled && policyRule.Action == "redirect" && policyRule.RedirectOptions != nil && policyRule.RedirectOptions.Type == "GOOGLE_RECAPTCHA" {
+		return models.Captcha
+	}
+	return models.Ban
+}
+
+// setAction sets the action, and its options, enforcing the decision type of the rule on the policy rule.
+// Captcha decisions are redirected to reCAPTCHA, all other decisions use the configured action.
+func (c *Client) setAction(policyRule *compute.SecurityPolicyRule, ruleType string) {
+	if ruleType == models.Captcha {
+		policyRule.Action = "redirect"
+		policyRule.RedirectOptions = &compute.SecurityPolicyRuleRedirectOptions{
+			Type: "GOOGLE_RECAPTCHA",
+		}
+		return
+	}
+	policyRule.Action = c.action
+	switch c.action {
+	case "redirect":
+		policyRule.RedirectOptions = &compute.SecurityPolicyRuleRedirectOptions{
+			Type:   c.redirect.Type,
+			Target: c.redirect.Target,
+		}
+	case "throttle":
+		policyRule.RateLimitOptions = &compute.SecurityPolicyRuleRateLimitOptions{
+			ConformAction: "allow",
+			ExceedAction:  c.rateLimit.ExceedAction,
+			EnforceOnKey:  c.rateLimit.EnforceOnKey,
+			RateLimitThreshold: &compute.SecurityPolicyRuleRateLimitOptionsThreshold{
+				Count:       c.rateLimit.ThresholdCount,
+				IntervalSec: c.rateLimit.IntervalSec,
+			},
+		}
+	}
+}
+
 func (c *Client) CreateRule(rule *models.FirewallRule) error {
 	log.Infof("creating cloud armor policy rule %s with %#v", rule.Name, rule.SourceRanges)
 
+	if c.usesAddressGroups(rule) {
+		if err := c.createAddressGroups(rule); err != nil {
+			return err
+		}
+	}
 	policyRule := compute.SecurityPolicyRule{
-		Action: "deny(403)",
-		Match: &compute.SecurityPolicyRuleMatcher{
-			Config: &compute.SecurityPolicyRuleMatcherConfig{
-				SrcIpRanges: models.ConvertSourceRangesMapToSlice(rule.SourceRanges),
-			},
-			VersionedExpr: "SRC_IPS_V1",
-		},
-		Description: rule.Name,
+		Match:       c.getMatcher(rule),
+		Description: getDescription(rule),
 		Priority:    rule.Priority,
+		Preview:     c.preview,
 	}
+	c.setAction(&policyRule, rule.Type)
 	op, err := c.svc.AddRule(c.project, c.policy, &policyRule)
 	if err != nil {
+		if c.usesAddressGroups(rule) {
+			if err := c.deleteAddressGroups(rule); err != nil {
+				log.Warningf("unable to clean up the address groups of policy rule %s: %s", rule.Name, err)
+			}
+		}
 		return fmt.Errorf("unable to create policy rule %s: %s", rule.Name, err)
 	}
 	if err = c.svc.WaitOperation(c.project, op.Name); err != nil {
@@ -140,8 +533,25 @@ func (c *Client) CreateRule(rule *models.FirewallRule) error {
 	return nil
 }
 
+// checkOwnership checks that the policy rule at the priority of the rule is the rule of the owner, since policy rules
+// are updated and deleted by priority.
+func (c *Client) checkOwnership(rule *models.FirewallRule) error {
+	policyRule, err := c.svc.GetRule(c.project, c.policy, rule.Priority)
+	if err != nil {
+		return fmt.Errorf("unable to get policy rule %s: %s", rule.Name, err)
+	}
+	marker := getRuleMarker(policyRule.Description)
+	if marker.Name != rule.Name || (marker.Owner != "" && marker.Owner != rule.Owner) {
+		return fmt.Errorf("refusing to update policy rule at priority %d: it is %s instead of %s", rule.Priority, policyRule.Description, rule.Name)
+	}
+	return nil
+}
+
 func (c *Client) DeleteRule(rule *models.FirewallRule) error {
 	log.Infof("deleting policy rule %s", rule.Name)
+	if err := c.checkOwnership(rule); err != nil {
+		return err
+	}
 	op, err := c.svc.RemoveRule(c.project, c.policy, rule.Priority)
 	if err != nil {
 		return fmt.Errorf("unable to delete policy rule %s: %s", rule.Name, err)
@@ -149,19 +559,37 @@ func (c *Client) DeleteRule(rule *models.FirewallRule) error {
 	if err = c.svc.WaitOperation(c.project, op.Name); err != nil {
 		return fmt.Errorf("problem waiting on operation %s: %s", op.Name, err)
 	}
+	if c.usesAddressGroups(rule) {
+		if err := c.deleteAddressGroups(rule); err != nil {
+			return err
+		}
+	}
 	log.Infof("deletion of policy rule %s successful", rule.Name)
 	return nil
 }
 
 func (c *Client) PatchRule(rule *models.FirewallRule) error {
 	log.Infof("patching policy rule %s with %#v", rule.Name, rule.SourceRanges)
+	if err := c.checkOwnership(rule); err != nil {
+		return err
+	}
+	if c.usesAddressGroups(rule) {
+		if err := c.patchAddressGroups(rule); err != nil {
+			return err
+		}
+	}
 	rulePatchRequest := compute.SecurityPolicyRule{
-		Match: &compute.SecurityPolicyRuleMatcher{
-			Config: &compute.SecurityPolicyRuleMatcherConfig{
-				SrcIpRanges: models.ConvertSourceRangesMapToSlice(rule.SourceRanges),
-			},
-			VersionedExpr: "SRC_IPS_V1",
-		},
+		Match:       c.getMatcher(rule),
+		Description: getDescription(rule),
+	}
+	c.setAction(&rulePatchRequest, rule.Type)
+	// Options of a previously configured action are cleared so that changing the action takes effect.
+	if rulePatchRequest.RedirectOptions == nil {
+		rulePatchRequest.NullFields = append(rulePatchRequest.NullFields, "RedirectOptions")
+	}
+	// The preview flag is left untouched so that promoted rules keep being enforced.
+	if rulePatchRequest.RateLimitOptions == nil {
+		rulePatchRequest.NullFields = append(rulePatchRequest.NullFields, "RateLimitOptions")
 	}
 	op, err := c.svc.PatchRule(c.project, c.policy, &rulePatchRequest, rule.Priority)
 	if err != nil {
@@ -173,3 +601,33 @@ func (c *Client) PatchRule(rule *models.FirewallRule) error {
 	log.Infof("patching of policy rule %s successful", rule.Name)
 	return nil
 }
+
+// PromoteRules switches the policy rules matching the ruleNamePrefix from preview to enforcing.
+func (c *Client) PromoteRules(ruleNamePrefix string) (int, error) {
+	res, err := c.svc.GetFirewallPolicy(c.project, c.policy)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get firewall policy %s: %s", c.policy, err)
+	}
+	promoted := 0
+	for _, r := range res.Rules {
+		marker := getRuleMarker(r.Description)
+		if !strings.HasPrefix(marker.Name, ruleNamePrefix) || (marker.Owner != "" && marker.Owner != ruleNamePrefix) || !r.Preview {
+			continue
+		}
+		log.Infof("promoting policy rule %s", marker.Name)
+		rulePatchRequest := compute.SecurityPolicyRule{
+			Preview:         false,
+			ForceSendFields: []string{"Preview"},
+		}
+		op, err := c.svc.PatchRule(c.project, c.policy, &rulePatchRequest, r.Priority)
+		if err != nil {
+			return promoted, fmt.Errorf("unable to promote policy rule %s: %s", marker.Name, err)
+		}
+		if err = c.svc.WaitOperation(c.project, op.Name); err != nil {
+			return promoted, fmt.Errorf("problem waiting on operation %s: %s", op.Name, err)
+		}
+		promoted++
+	}
+	log.Infof("promoted %d policy rule(s) to enforcing", promoted)
+	return promoted, nil
+}
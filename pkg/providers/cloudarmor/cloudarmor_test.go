@@ -1,6 +1,7 @@
 package cloudarmor
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
@@ -24,10 +25,43 @@ func (s *mockGoogleSvc) GetFirewallPolicy(project string, policyName string) (*c
 					},
 				},
 			},
+			{
+				Description: "crowdsec-country",
+				Priority:    1,
+				Preview:     true,
+				Match: &compute.SecurityPolicyRuleMatcher{
+					Expr: &compute.Expr{
+						Expression: "origin.region_code == 'CN'",
+					},
+				},
+			},
+			{
+				Description: "manual-rule",
+				Match: &compute.SecurityPolicyRuleMatcher{
+					Expr: &compute.Expr{
+						Expression: "request.path.matches('/admin')",
+					},
+				},
+			},
 		},
 	}, nil
 }
 
+func (s *mockGoogleSvc) GetRule(project string, policyName string, rulePriority int64) (*compute.SecurityPolicyRule, error) {
+	policy, _ := s.GetFirewallPolicy(project, policyName)
+	return findRule(policy, rulePriority)
+}
+
+// findRule returns the first rule of the policy at the priority.
+func findRule(policy *compute.SecurityPolicy, rulePriority int64) (*compute.SecurityPolicyRule, error) {
+	for _, rule := range policy.Rules {
+		if rule.Priority == rulePriority {
+			return rule, nil
+		}
+	}
+	return nil, fmt.Errorf("no rule at priority %d", rulePriority)
+}
+
 func (s *mockGoogleSvc) AddRule(project string, policyName string, rule *compute.SecurityPolicyRule) (*compute.Operation, error) {
 	return &compute.Operation{}, nil
 }
@@ -54,9 +88,39 @@ func TestGetRules(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	assert.Equal(t, 1, len(rules))
+	assert.Equal(t, 3, len(rules))
 	assert.Equal(t, "crowdsec-bingo-jumbo", rules[0].Name)
+	assert.Equal(t, models.IPScope, rules[0].Scope)
+	assert.Equal(t, "crowdsec-country", rules[1].Name)
+	assert.Equal(t, models.CountryScope, rules[1].Scope)
+	assert.Equal(t, true, rules[1].SourceRanges["CN"])
+	// other policy rules are returned as foreign rules so that their priorities are not reused
+	assert.Equal(t, "manual-rule", rules[2].Name)
+	assert.Equal(t, models.ForeignOwner, rules[2].Owner)
 }
+
+type mockEdgeSvc struct {
+	mockGoogleSvc
+}
+
+func (s *mockEdgeSvc) GetFirewallPolicy(project string, policyName string) (*compute.SecurityPolicy, error) {
+	return &compute.SecurityPolicy{Type: "CLOUD_ARMOR_EDGE"}, nil
+}
+
+func TestGetRulesPolicyType(t *testing.T) {
+
+	c := Client{
+		svc:        &mockEdgeSvc{},
+		policyType: "CLOUD_ARMOR",
+	}
+	_, err := c.GetRules("crowdsec")
+	assert.ErrorContains(t, err, "CLOUD_ARMOR_EDGE")
+
+	c.policyType = "CLOUD_ARMOR_EDGE"
+	_, err = c.GetRules("crowdsec")
+	assert.NilError(t, err)
+}
+
 func TestCreateRule(t *testing.T) {
 
 	mockSvc := &mockGoogleSvc{}
@@ -102,3 +166,308 @@ func TestPatchRule(t *testing.T) {
 	}
 	_ = c.PatchRule(&rule)
 }
+
+type mockPreviewSvc struct {
+	mockGoogleSvc
+	added   []*compute.SecurityPolicyRule
+	patched map[int64]*compute.SecurityPolicyRule
+}
+
+func (s *mockPreviewSvc) AddRule(project string, policyName string, rule *compute.SecurityPolicyRule) (*compute.Operation, error) {
+	s.added = append(s.added, rule)
+	return &compute.Operation{}, nil
+}
+
+func (s *mockPreviewSvc) PatchRule(project string, policyName string, rule *compute.SecurityPolicyRule, rulePriority int64) (*compute.Operation, error) {
+	s.patched[rulePriority] = rule
+	return &compute.Operation{}, nil
+}
+
+func TestPreview(t *testing.T) {
+
+	mockSvc := &mockPreviewSvc{patched: map[int64]*compute.SecurityPolicyRule{}}
+	c := Client{
+		svc:     mockSvc,
+		action:  "deny(403)",
+		preview: true,
+	}
+	rule := models.FirewallRule{
+		Name:         "crowdsec-bingo-jumbo",
+		SourceRanges: map[string]bool{"1.0.0.0/32": true},
+	}
+	assert.NilError(t, c.CreateRule(&rule))
+	assert.Equal(t, 1, len(mockSvc.added))
+	assert.Equal(t, true, mockSvc.added[0].Preview)
+
+	assert.NilError(t, c.PatchRule(&rule))
+	assert.DeepEqual(t, []string(nil), mockSvc.patched[0].ForceSendFields)
+}
+
+func TestPromoteRules(t *testing.T) {
+
+	mockSvc := &mockPreviewSvc{patched: map[int64]*compute.SecurityPolicyRule{}}
+	c := Client{
+		svc: mockSvc,
+	}
+	promoted, err := c.PromoteRules("crowdsec")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, promoted)
+	assert.Equal(t, 1, len(mockSvc.patched))
+	assert.Equal(t, false, mockSvc.patched[1].Preview)
+	assert.DeepEqual(t, []string{"Preview"}, mockSvc.patched[1].ForceSendFields)
+}
+
+type mockOwnershipSvc struct {
+	mockPreviewSvc
+}
+
+func (s *mockOwnershipSvc) GetFirewallPolicy(project string, policyName string) (*compute.SecurityPolicy, error) {
+	match := &compute.SecurityPolicyRuleMatcher{
+		Config: &compute.SecurityPolicyRuleMatcherConfig{
+			SrcIpRanges: []string{"1.2.3.4/32"},
+		},
+	}
+	return &compute.SecurityPolicy{
+		Rules: []*compute.SecurityPolicyRule{
+			{Description: `{"name":"crowdsec-cloudarmor-0","owner":"crowdsec"}`, Priority: 0, Match: match, Preview: true},
+			{Description: "crowdsec-bingo-jumbo", Priority: 1, Match: match},
+			{Description: `{"name":"crowdsec-prod-cloudarmor-0","owner":"crowdsec-prod"}`, Priority: 2, Match: match, Preview: true},
+		},
+	}, nil
+}
+
+func (s *mockOwnershipSvc) GetRule(project string, policyName string, rulePriority int64) (*compute.SecurityPolicyRule, error) {
+	policy, _ := s.GetFirewallPolicy(project, policyName)
+	return findRule(policy, rulePriority)
+}
+
+func TestGetRulesOwnership(t *testing.T) {
+
+	mockSvc := &mockOwnershipSvc{mockPreviewSvc{patched: map[int64]*compute.SecurityPolicyRule{}}}
+	c := Client{
+		svc: mockSvc,
+	}
+	rules, err := c.GetRules("crowdsec")
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(rules))
+	assert.Equal(t, "crowdsec-cloudarmor-0", rules[0].Name)
+	assert.Equal(t, "crowdsec", rules[0].Owner)
+	assert.Assert(t, rules[0].State != models.Modified)
+	assert.Equal(t, "crowdsec-bingo-jumbo", rules[1].Name)
+	assert.Equal(t, "crowdsec", rules[1].Owner)
+	assert.Equal(t, models.Modified, rules[1].State)
+	assert.Equal(t, "crowdsec-prod-cloudarmor-0", rules[2].Name)
+	assert.Equal(t, "crowdsec-prod", rules[2].Owner)
+
+	assert.NilError(t, c.PatchRule(rules[1]))
+	assert.Equal(t, `{"name":"crowdsec-bingo-jumbo","owner":"crowdsec"}`, mockSvc.patched[1].Description)
+
+	// rules at a priority held by another rule are not updated
+	err = c.PatchRule(&models.FirewallRule{Name: "crowdsec-cloudarmor-1", Priority: 2, Owner: "crowdsec"})
+	assert.ErrorContains(t, err, "refusing to update policy rule at priority 2")
+	err = c.DeleteRule(&models.FirewallRule{Name: "crowdsec-prod-cloudarmor-0", Priority: 2, Owner: "crowdsec"})
+	assert.ErrorContains(t, err, "refusing to update policy rule at priority 2")
+
+	// only the rules of the owner are promoted
+	promoted, err := c.PromoteRules("crowdsec")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, promoted)
+	assert.Assert(t, mockSvc.patched[2] == nil)
+}
+
+func TestSetAction(t *testing.T) {
+
+	c := Client{action: "deny(404)"}
+	rule := compute.SecurityPolicyRule{}
+	c.setAction(&rule, models.Ban)
+	assert.Equal(t, "deny(404)", rule.Action)
+	assert.Assert(t, rule.RedirectOptions == nil)
+	assert.Assert(t, rule.RateLimitOptions == nil)
+
+	c = Client{action: "redirect", redirect: models.CloudArmorRedirectConfig{Type: "GOOGLE_RECAPTCHA"}}
+	rule = compute.SecurityPolicyRule{}
+	c.setAction(&rule, models.Ban)
+	assert.Equal(t, "redirect", rule.Action)
+	assert.Equal(t, "GOOGLE_RECAPTCHA", rule.RedirectOptions.Type)
+
+	c = Client{action: "throttle", rateLimit: models.CloudArmorRateLimitConfig{ThresholdCount: 100, IntervalSec: 60, ExceedAction: "deny(429)", EnforceOnKey: "IP"}}
+	rule = compute.SecurityPolicyRule{}
+	c.setAction(&rule, models.Ban)
+	assert.Equal(t, "throttle", rule.Action)
+	assert.Equal(t, "allow", rule.RateLimitOptions.ConformAction)
+	assert.Equal(t, "deny(429)", rule.RateLimitOptions.ExceedAction)
+	assert.Equal(t, int64(100), rule.RateLimitOptions.RateLimitThreshold.Count)
+	assert.Equal(t, int64(60), rule.RateLimitOptions.RateLimitThreshold.IntervalSec)
+}
+
+func TestRuleSets(t *testing.T) {
+
+	config := models.CloudArmorConfig{Priority: 0, MaxRules: 100}
+	ruleSets := getRuleSets(&config)
+	assert.Equal(t, 1, len(ruleSets))
+	assert.Equal(t, models.Ban, ruleSets[0].Type)
+
+	config.Captcha = models.CloudArmorCaptchaConfig{Enabled: true, Priority: 1000, MaxRules: 20}
+	ruleSets = getRuleSets(&config)
+	assert.Equal(t, 2, len(ruleSets))
+	assert.Equal(t, models.Captcha, ruleSets[1].Type)
+	assert.Equal(t, int64(1000), ruleSets[1].Priority)
+	assert.Equal(t, 20, ruleSets[1].MaxRules)
+
+	config.Expressions = models.CloudArmorExpressionsConfig{Enabled: true, Priority: 2000, MaxRules: 10}
+	ruleSets = getRuleSets(&config)
+	assert.Equal(t, 6, len(ruleSets))
+	assert.Equal(t, models.Ban, ruleSets[2].Type)
+	assert.Equal(t, models.CountryScope, ruleSets[2].Scope)
+	assert.Equal(t, int64(2000), ruleSets[2].Priority)
+	assert.Equal(t, maxSubexpressionsPerRule, ruleSets[2].MaxSourcesPerRule)
+	assert.Equal(t, models.ASScope, ruleSets[3].Scope)
+	assert.Equal(t, int64(2010), ruleSets[3].Priority)
+	assert.Equal(t, models.Captcha, ruleSets[5].Type)
+	assert.Equal(t, models.ASScope, ruleSets[5].Scope)
+	assert.Equal(t, int64(2030), ruleSets[5].Priority)
+	assert.NilError(t, checkRuleSetsPriority(ruleSets, models.PriorityRange{}))
+	assert.NilError(t, checkRuleSetsPriority(ruleSets, models.PriorityRange{Min: 0, Max: 2039}))
+	assert.ErrorContains(t, checkRuleSetsPriority(ruleSets, models.PriorityRange{Min: 0, Max: 2038}), "not within priority_range 0-2038")
+}
+
+func TestCaptchaRule(t *testing.T) {
+
+	c := Client{action: "deny(403)", captcha: models.CloudArmorCaptchaConfig{Enabled: true}}
+	rule := compute.SecurityPolicyRule{}
+	c.setAction(&rule, models.Captcha)
+	assert.Equal(t, "redirect", rule.Action)
+	assert.Equal(t, "GOOGLE_RECAPTCHA", rule.RedirectOptions.Type)
+	assert.Equal(t, models.Captcha, c.getRuleType(&rule))
+
+	c.captcha.Enabled = false
+	assert.Equal(t, models.Ban, c.getRuleType(&rule))
+}
+
+func TestCheckCloudArmorConfigCaptcha(t *testing.T) {
+	config := models.CloudArmorConfig{
+		ProjectID: "project",
+		Policy:    "policy",
+		Captcha:   models.CloudArmorCaptchaConfig{Enabled: true},
+	}
+	err := checkCloudArmorConfig(&config)
+	assert.NilError(t, err)
+	assert.Equal(t, int64(defaultMaxRules), config.Captcha.Priority)
+	assert.Equal(t, defaultCaptchaMaxRules, config.Captcha.MaxRules)
+
+	config.Captcha.Priority = 50
+	err = checkCloudArmorConfig(&config)
+	assert.ErrorContains(t, err, "overlaps")
+}
+
+func TestCheckCloudArmorConfigPriorityRange(t *testing.T) {
+	config := models.CloudArmorConfig{
+		ProjectID:     "project",
+		Policy:        "policy",
+		PriorityRange: models.PriorityRange{Min: 1000, Max: 1199},
+		Captcha:       models.CloudArmorCaptchaConfig{Enabled: true},
+	}
+	err := checkCloudArmorConfig(&config)
+	assert.NilError(t, err)
+	assert.Equal(t, int64(1000), config.Priority)
+	assert.Equal(t, int64(1100), config.Captcha.Priority)
+	for _, ruleSet := range getRuleSets(&config) {
+		assert.Equal(t, int64(1199), ruleSet.MaxPriority)
+	}
+
+	config.Captcha.MaxRules = 200
+	err = checkCloudArmorConfig(&config)
+	assert.ErrorContains(t, err, "not within priority_range")
+}
+
+func TestCheckCloudArmorConfigExpressions(t *testing.T) {
+	config := models.CloudArmorConfig{
+		ProjectID:   "project",
+		Policy:      "policy",
+		Captcha:     models.CloudArmorCaptchaConfig{Enabled: true},
+		Expressions: models.CloudArmorExpressionsConfig{Enabled: true},
+	}
+	err := checkCloudArmorConfig(&config)
+	assert.NilError(t, err)
+	assert.Equal(t, int64(defaultMaxRules+defaultCaptchaMaxRules), config.Expressions.Priority)
+	assert.Equal(t, defaultExpressionsMaxRules, config.Expressions.MaxRules)
+}
+
+func TestGetRuleSources(t *testing.T) {
+	scope, sources, err := getRuleSources(&compute.SecurityPolicyRule{
+		Match: &compute.SecurityPolicyRuleMatcher{
+			Expr: &compute.Expr{Expression: "origin.region_code == 'CN' || origin.region_code == 'RU'"},
+		},
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, models.CountryScope, scope)
+	assert.DeepEqual(t, []string{"CN", "RU"}, sources)
+
+	scope, sources, err = getRuleSources(&compute.SecurityPolicyRule{
+		Match: &compute.SecurityPolicyRuleMatcher{
+			Expr: &compute.Expr{Expression: "origin.asn == 4134"},
+		},
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, models.ASScope, scope)
+	assert.DeepEqual(t, []string{"4134"}, sources)
+
+	_, _, err = getRuleSources(&compute.SecurityPolicyRule{
+		Match: &compute.SecurityPolicyRuleMatcher{
+			Expr: &compute.Expr{Expression: "request.path.matches('/admin')"},
+		},
+	})
+	assert.ErrorContains(t, err, "unable to parse")
+}
+
+func TestGetExpression(t *testing.T) {
+	expression := getExpression(models.CountryScope, map[string]bool{"RU": true, "CN": true, "C'N": true})
+	assert.Equal(t, "origin.region_code == 'CN' || origin.region_code == 'RU'", expression)
+
+	expression = getExpression(models.ASScope, map[string]bool{"4134": true, "AS1": true})
+	assert.Equal(t, "origin.asn == 4134", expression)
+}
+
+type mockPreflightSvc struct {
+	mockGoogleSvc
+	tested []string
+}
+
+func (s *mockPreflightSvc) TestPermissions(project string, permissions []string) ([]string, error) {
+	s.tested = permissions
+	return []string{"compute.regionSecurityPolicies.get"}, nil
+}
+
+func TestPreflight(t *testing.T) {
+	svc := &mockPreflightSvc{}
+	client := &Client{svc: svc, project: "test", policy: "policy-test", location: "us-central1"}
+	checks := client.Preflight()
+	assert.Equal(t, 2, len(checks))
+	assert.NilError(t, checks[0].Err)
+	assert.Error(t, checks[1].Err, "missing permission(s) compute.regionSecurityPolicies.update")
+
+	client = &Client{svc: svc, project: "test", policy: "policy-test", location: "global", addressGroupsSvc: &mockAddressGroupsSvc{}}
+	client.Preflight()
+	assert.DeepEqual(t, []string{
+		"compute.securityPolicies.get",
+		"compute.securityPolicies.update",
+		"networksecurity.addressGroups.create",
+		"networksecurity.addressGroups.delete",
+		"networksecurity.addressGroups.get",
+		"networksecurity.addressGroups.update",
+	}, svc.tested)
+}
+
+func TestGetOperationError(t *testing.T) {
+	assert.NilError(t, getOperationError(&compute.Operation{Status: "DONE"}))
+	err := getOperationError(&compute.Operation{
+		Name:   "operation",
+		Status: "DONE",
+		Error: &compute.OperationError{
+			Errors: []*compute.OperationErrorErrors{
+				{Code: "QUOTA_EXCEEDED", Message: "Quota 'SECURITY_POLICY_RULES' exceeded"},
+			},
+		},
+	})
+	assert.Error(t, err, "operation operation failed: QUOTA_EXCEEDED: Quota 'SECURITY_POLICY_RULES' exceeded")
+}
@@ -2,28 +2,36 @@ package cloudarmor
 
 import (
 	"context"
+	"fmt"
+	"strings"
 
 	"golang.org/x/oauth2"
+	"google.golang.org/api/cloudresourcemanager/v1"
 	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/option"
 )
 
 type GoogleComputeServiceIface interface {
 	GetFirewallPolicy(project string, policyName string) (*compute.SecurityPolicy, error)
+	GetRule(project string, policyName string, rulePriority int64) (*compute.SecurityPolicyRule, error)
 	AddRule(project string, policyName string, rule *compute.SecurityPolicyRule) (*compute.Operation, error)
 	RemoveRule(project string, policyName string, rulePriority int64) (*compute.Operation, error)
 	PatchRule(project string, policyName string, rule *compute.SecurityPolicyRule, rulePriority int64) (*compute.Operation, error)
 	WaitOperation(project string, operation string) error
+	TestPermissions(project string, permissions []string) ([]string, error)
 }
 
+// GoogleComputeService calls the global security policies API, or the regional one when a region is set.
 type GoogleComputeService struct {
-	svc *compute.Service
+	svc    *compute.Service
+	crm    *cloudresourcemanager.Service
+	region string
 }
 
-// NewGoogleComputeService creates the compute service.
+// getClientOptions returns the options of the Google API clients, authenticated with the credentials options.
 // The default endpoint can be overriden for testing purpose (to make calls to a mock server instead of the real Google servers).
-func NewGoogleComputeService(endpoint string) *GoogleComputeService {
-	opts := []option.ClientOption{}
+func getClientOptions(endpoint string, credentials []option.ClientOption) []option.ClientOption {
+	opts := credentials
 	if endpoint != "" {
 		config := &oauth2.Config{
 			Endpoint: oauth2.Endpoint{
@@ -36,32 +44,97 @@ func NewGoogleComputeService(endpoint string) *GoogleComputeService {
 		if err != nil {
 			log.Fatalf("Couldn't create dummy token for new Google compute service: %s", err)
 		}
-		opts = append(opts, option.WithEndpoint(endpoint), option.WithTokenSource(config.TokenSource(ctx, token)))
+		opts = []option.ClientOption{option.WithEndpoint(endpoint), option.WithTokenSource(config.TokenSource(ctx, token))}
 	}
-	svc, err := compute.NewService(context.Background(), opts...)
+	return opts
+}
+
+// NewGoogleComputeService creates the compute service.
+func NewGoogleComputeService(endpoint string, region string, credentials ...option.ClientOption) *GoogleComputeService {
+	svc, err := compute.NewService(context.Background(), getClientOptions(endpoint, credentials)...)
 	if err != nil {
 		log.Fatalf("Unable to create new compute service: %s", err)
 	}
-	return &GoogleComputeService{svc}
+	crm, err := cloudresourcemanager.NewService(context.Background(), getClientOptions(endpoint, credentials)...)
+	if err != nil {
+		log.Fatalf("Unable to create new resource manager service: %s", err)
+	}
+	return &GoogleComputeService{svc, crm, region}
 }
 
 func (s *GoogleComputeService) GetFirewallPolicy(project string, policyName string) (*compute.SecurityPolicy, error) {
+	if s.region != "" {
+		return s.svc.RegionSecurityPolicies.Get(project, s.region, policyName).Do()
+	}
 	return s.svc.SecurityPolicies.Get(project, policyName).Do()
 }
 
+func (s *GoogleComputeService) GetRule(project string, policyName string, rulePriority int64) (*compute.SecurityPolicyRule, error) {
+	if s.region != "" {
+		return s.svc.RegionSecurityPolicies.GetRule(project, s.region, policyName).Priority(rulePriority).Do()
+	}
+	return s.svc.SecurityPolicies.GetRule(project, policyName).Priority(rulePriority).Do()
+}
+
 func (s *GoogleComputeService) AddRule(project string, policyName string, rule *compute.SecurityPolicyRule) (*compute.Operation, error) {
+	if s.region != "" {
+		return s.svc.RegionSecurityPolicies.AddRule(project, s.region, policyName, rule).Do()
+	}
 	return s.svc.SecurityPolicies.AddRule(project, policyName, rule).Do()
 }
 
 func (s *GoogleComputeService) RemoveRule(project string, policyName string, rulePriority int64) (*compute.Operation, error) {
+	if s.region != "" {
+		return s.svc.RegionSecurityPolicies.RemoveRule(project, s.region, policyName).Priority(rulePriority).Do()
+	}
 	return s.svc.SecurityPolicies.RemoveRule(project, policyName).Priority(rulePriority).Do()
 }
 
 func (s *GoogleComputeService) PatchRule(project string, policyName string, rule *compute.SecurityPolicyRule, rulePriority int64) (*compute.Operation, error) {
+	if s.region != "" {
+		return s.svc.RegionSecurityPolicies.PatchRule(project, s.region, policyName, rule).Priority(rulePriority).Do()
+	}
 	return s.svc.SecurityPolicies.PatchRule(project, policyName, rule).Priority(rulePriority).Do()
 }
 
+// WaitOperation waits for the global or regional operation to be done and returns the operation errors, if any.
+// A single wait call returns after 2 minutes at most, so it is repeated until the operation is done.
 func (s *GoogleComputeService) WaitOperation(project string, operation string) error {
-	_, err := s.svc.GlobalOperations.Wait(project, operation).Do()
-	return err
+	for {
+		var op *compute.Operation
+		var err error
+		if s.region != "" {
+			op, err = s.svc.RegionOperations.Wait(project, s.region, operation).Do()
+		} else {
+			op, err = s.svc.GlobalOperations.Wait(project, operation).Do()
+		}
+		if err != nil {
+			return err
+		}
+		if op.Status != "DONE" {
+			continue
+		}
+		return getOperationError(op)
+	}
+}
+
+// getOperationError returns the errors of a done operation, such as an exceeded quota or an invalid rule.
+func getOperationError(op *compute.Operation) error {
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+	messages := []string{}
+	for _, e := range op.Error.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", e.Code, e.Message))
+	}
+	return fmt.Errorf("operation %s failed: %s", op.Name, strings.Join(messages, ", "))
+}
+
+// TestPermissions returns the permissions granted on the project among the given permissions.
+func (s *GoogleComputeService) TestPermissions(project string, permissions []string) ([]string, error) {
+	res, err := s.crm.Projects.TestIamPermissions(project, &cloudresourcemanager.TestIamPermissionsRequest{Permissions: permissions}).Do()
+	if err != nil {
+		return nil, err
+	}
+	return res.Permissions, nil
 }
@@ -0,0 +1,77 @@
+package cloudarmor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+	"gotest.tools/assert"
+)
+
+// newMockServer returns a server answering the token exchange and every compute call, recording the requested paths.
+func newMockServer(paths *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/" {
+			_, _ = w.Write([]byte(`{"access_token": "dummy", "token_type": "Bearer"}`))
+			return
+		}
+		*paths = append(*paths, r.Method+" "+r.URL.Path)
+		_, _ = w.Write([]byte(`{"name": "operation", "status": "DONE"}`))
+	}))
+}
+
+func TestGoogleComputeService(t *testing.T) {
+	tests := []struct {
+		name   string
+		region string
+		want   []string
+	}{
+		{
+			name:   "global",
+			region: "",
+			want: []string{
+				"GET /projects/project/global/securityPolicies/policy",
+				"GET /projects/project/global/securityPolicies/policy/getRule",
+				"POST /projects/project/global/securityPolicies/policy/addRule",
+				"POST /projects/project/global/securityPolicies/policy/patchRule",
+				"POST /projects/project/global/securityPolicies/policy/removeRule",
+				"POST /projects/project/global/operations/operation/wait",
+			},
+		},
+		{
+			name:   "regional",
+			region: "us-central1",
+			want: []string{
+				"GET /projects/project/regions/us-central1/securityPolicies/policy",
+				"GET /projects/project/regions/us-central1/securityPolicies/policy/getRule",
+				"POST /projects/project/regions/us-central1/securityPolicies/policy/addRule",
+				"POST /projects/project/regions/us-central1/securityPolicies/policy/patchRule",
+				"POST /projects/project/regions/us-central1/securityPolicies/policy/removeRule",
+				"POST /projects/project/regions/us-central1/operations/operation/wait",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths := []string{}
+			server := newMockServer(&paths)
+			defer server.Close()
+
+			s := NewGoogleComputeService(server.URL+"/", tt.region)
+			_, err := s.GetFirewallPolicy("project", "policy")
+			assert.NilError(t, err)
+			_, err = s.GetRule("project", "policy", 1)
+			assert.NilError(t, err)
+			_, err = s.AddRule("project", "policy", &compute.SecurityPolicyRule{})
+			assert.NilError(t, err)
+			_, err = s.PatchRule("project", "policy", &compute.SecurityPolicyRule{}, 1)
+			assert.NilError(t, err)
+			_, err = s.RemoveRule("project", "policy", 1)
+			assert.NilError(t, err)
+			assert.NilError(t, s.WaitOperation("project", "operation"))
+			assert.DeepEqual(t, tt.want, paths)
+		})
+	}
+}
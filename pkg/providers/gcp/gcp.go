@@ -1,28 +1,58 @@
 package gcp
 
 import (
-	"context"
 	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/providers/googleauth"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/oauth2/google"
 	"google.golang.org/api/compute/v1"
 )
 
 type Client struct {
-	svc      GoogleComputeServiceIface
-	project  string
-	network  string
-	maxRules int
-	priority int64
+	svc                   GoogleComputeServiceIface
+	project               string
+	network               string
+	maxRules              int
+	priority              int64
+	priorityRange         models.PriorityRange
+	protocols             []models.GCPProtocolConfig
+	targetTags            []string
+	targetServiceAccounts []string
+	enableLogging         bool
+	logMetadata           string
+	direction             string
+	// ignoredRules contains the rules already reported as ignored, so that they are only reported once.
+	ignoredRules map[string]bool
 }
 
 const (
-	providerName    = "gcp"
-	defaultMaxRules = 10
+	providerName       = "gcp"
+	defaultMaxRules    = 10
+	defaultAction      = "deny"
+	defaultLogMetadata = "INCLUDE_ALL_METADATA"
+	defaultDirection   = models.Ingress
+	description        = "Blocklist generated by CrowdSec Cloud Firewall Bouncer"
 )
 
+// ownerMarker matches the ownership marker appended to the description of the firewall rules.
+var ownerMarker = regexp.MustCompile(`^` + regexp.QuoteMeta(description) + ` \[owner=([a-z0-9-]+)\]$`)
+
+// permissions are the permissions needed to maintain the firewall rules of the network.
+var permissions = []string{
+	"compute.firewalls.create",
+	"compute.firewalls.delete",
+	"compute.firewalls.get",
+	"compute.firewalls.list",
+	"compute.firewalls.update",
+	"compute.globalOperations.get",
+	"compute.networks.updatePolicy",
+}
+
 var log *logrus.Entry
 
 func init() {
@@ -39,16 +69,55 @@ func (c *Client) Priority() int64 {
 	return c.priority
 }
 
-func getProjectIDFromCredentials(config *models.GCPConfig) (string, error) {
-	ctx := context.Background()
-	credentials, error := google.FindDefaultCredentials(ctx, compute.ComputeScope)
-	if error != nil {
-		return "", error
+// RuleSets returns a ban rule set for each blocked direction. Ingress and egress rules share the same priority range.
+func (c *Client) RuleSets() []models.RuleSet {
+	ruleSets := []models.RuleSet{}
+	for _, direction := range models.GetDirections(c.direction) {
+		ruleSets = append(ruleSets, models.RuleSet{
+			Type:        models.Ban,
+			Priority:    c.priority,
+			MaxRules:    c.maxRules,
+			Direction:   direction,
+			MaxPriority: c.priorityRange.Max,
+		})
+	}
+	return ruleSets
+}
+
+// Preflight checks that the network exists and that the permissions needed to maintain the firewall rules are granted
+// on the project.
+func (c *Client) Preflight() []models.PreflightCheck {
+	networkCheck := models.PreflightCheck{Name: fmt.Sprintf("network %s", c.network)}
+	if _, err := c.svc.GetNetwork(c.project, c.network); err != nil {
+		networkCheck.Err = fmt.Errorf("unable to get network %s in project %s: %s", c.network, c.project, err)
 	}
-	if credentials.ProjectID == "" {
-		return "", fmt.Errorf("Default credentials does not have a project ID associated")
+	permissionsCheck := models.PreflightCheck{Name: fmt.Sprintf("permissions on project %s", c.project)}
+	granted, err := c.svc.TestPermissions(c.project, permissions)
+	if err != nil {
+		permissionsCheck.Err = fmt.Errorf("unable to test permissions: %s", err)
+	} else if missing := getMissingPermissions(permissions, granted); len(missing) > 0 {
+		permissionsCheck.Err = fmt.Errorf("missing permission(s) %s", strings.Join(missing, ", "))
 	}
-	return credentials.ProjectID, nil
+	return []models.PreflightCheck{networkCheck, permissionsCheck}
+}
+
+// getMissingPermissions returns the required permissions that are not granted.
+func getMissingPermissions(required []string, granted []string) []string {
+	grantedMap := make(map[string]bool)
+	for _, permission := range granted {
+		grantedMap[permission] = true
+	}
+	missing := []string{}
+	for _, permission := range required {
+		if !grantedMap[permission] {
+			missing = append(missing, permission)
+		}
+	}
+	return missing
+}
+
+func getProjectIDFromCredentials(config *models.GCPConfig) (string, error) {
+	return googleauth.GetProjectID(config.CredentialsFile)
 }
 
 func checkGCPConfig(config *models.GCPConfig) error {
@@ -68,6 +137,18 @@ func checkGCPConfig(config *models.GCPConfig) error {
 	if config.MaxRules == 0 {
 		config.MaxRules = defaultMaxRules
 	}
+	if config.Priority == 0 {
+		config.Priority = config.PriorityRange.Min
+	}
+	if config.Action == "" {
+		config.Action = defaultAction
+	}
+	if config.EnableLogging && config.LogMetadata == "" {
+		config.LogMetadata = defaultLogMetadata
+	}
+	if config.Direction == "" {
+		config.Direction = defaultDirection
+	}
 	return nil
 }
 
@@ -78,13 +159,24 @@ func NewClient(config *models.GCPConfig) (*Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error while checking GCP config: %s", err)
 	}
+	credentials, err := googleauth.GetClientOptions(config.CredentialsFile, config.ImpersonateServiceAccount)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading credentials: %s", err)
+	}
 
 	return &Client{
-		svc:      NewGoogleComputeService(config.Endpoint),
-		project:  config.ProjectID,
-		network:  config.Network,
-		priority: config.Priority,
-		maxRules: config.MaxRules,
+		svc:                   NewGoogleComputeService(config.Endpoint, credentials...),
+		project:               config.ProjectID,
+		network:               config.Network,
+		priority:              config.Priority,
+		priorityRange:         config.PriorityRange,
+		maxRules:              config.MaxRules,
+		protocols:             config.Protocols,
+		targetTags:            config.TargetTags,
+		targetServiceAccounts: config.TargetServiceAccounts,
+		enableLogging:         config.EnableLogging,
+		logMetadata:           config.LogMetadata,
+		direction:             config.Direction,
 	}, nil
 }
 
@@ -92,51 +184,218 @@ func (c *Client) GetProviderName() string {
 	return providerName
 }
 
+// warnIgnoredRule logs the reason why the rule is ignored, once per rule.
+func (c *Client) warnIgnoredRule(ruleName string, format string, args ...interface{}) {
+	if c.ignoredRules == nil {
+		c.ignoredRules = make(map[string]bool)
+	}
+	if c.ignoredRules[ruleName] {
+		return
+	}
+	c.ignoredRules[ruleName] = true
+	log.Warningf(format, args...)
+}
+
 func (c *Client) GetRules(ruleNamePrefix string) ([]*models.FirewallRule, error) {
 	res, err := c.svc.ListFirewallRules(c.project, ruleNamePrefix)
 	if err != nil {
 		return nil, fmt.Errorf("unable to list firewall rules: %s", err)
 	}
 	var rules []*models.FirewallRule
-	log.Infof("found %d rule(s)", len(res.Items))
 	for _, gcpRule := range res.Items {
-		log.Infof("%s: %#v", gcpRule.Name, gcpRule.SourceRanges)
+		if !c.isInNetwork(gcpRule) {
+			c.warnIgnoredRule(gcpRule.Name, "ignoring rule %s: it belongs to network %s instead of %s", gcpRule.Name, gcpRule.Network, c.network)
+			// firewall rule names are unique across the networks of the project
+			rules = append(rules, &models.FirewallRule{Name: gcpRule.Name, Owner: models.ReservedNameOwner})
+			continue
+		}
+		direction := models.Ingress
+		sources := gcpRule.SourceRanges
+		if gcpRule.Direction == "EGRESS" {
+			direction = models.Egress
+			sources = gcpRule.DestinationRanges
+		}
+		owner, ok := getOwner(gcpRule.Description)
+		if !ok {
+			c.warnIgnoredRule(gcpRule.Name, "rule %s was not created by the bouncer, it will not be updated", gcpRule.Name)
+			owner = models.ForeignOwner
+		}
+		log.Debugf("%s (%s): %#v", gcpRule.Name, direction, sources)
 		rule := models.FirewallRule{
 			Name:         gcpRule.Name,
-			SourceRanges: models.ConvertSourceRangesSliceToMap(gcpRule.SourceRanges),
+			SourceRanges: models.ConvertSourceRangesSliceToMap(sources),
 			Priority:     gcpRule.Priority,
+			Direction:    direction,
+			Owner:        owner,
+		}
+		if owner == "" && !models.IsLegacyRuleName(ruleNamePrefix, gcpRule.Name) {
+			log.Debugf("rule %s has no ownership marker and is not named after %s, it is left to its bouncer", gcpRule.Name, ruleNamePrefix)
+			rule.Owner = models.ForeignOwner
+		} else if owner == "" {
+			log.Infof("rule %s has no ownership marker, it will be patched", gcpRule.Name)
+			rule.Owner = ruleNamePrefix
+			rule.State = models.Modified
+		} else if owner == ruleNamePrefix && c.isOutdated(gcpRule) {
+			log.Infof("settings of rule %s changed, it will be patched", gcpRule.Name)
+			rule.State = models.Modified
 		}
 		rules = append(rules, &rule)
 	}
+	log.Infof("found %d rule(s)", len(rules))
 	return rules, nil
 }
 
-func (c *Client) CreateRule(rule *models.FirewallRule) error {
-	log.Infof("creating GCP firewall rule %s with %#v", rule.Name, rule.SourceRanges)
+// getDescription returns the description of the firewall rules, with the ownership marker of the owner.
+func getDescription(owner string) string {
+	return fmt.Sprintf("%s [owner=%s]", description, owner)
+}
 
-	denied := compute.FirewallDenied{
-		IPProtocol: "all",
+// getOwner returns the owner recorded in the description of a firewall rule. The owner is empty for rules created
+// before ownership markers. It returns false if the firewall rule was not created by the bouncer.
+func getOwner(ruleDescription string) (string, bool) {
+	if ruleDescription == description {
+		return "", true
+	}
+	if matches := ownerMarker.FindStringSubmatch(ruleDescription); matches != nil {
+		return matches[1], true
 	}
+	return "", false
+}
+
+// isInNetwork returns true if the firewall rule belongs to the configured network.
+// The network of a listed rule is the full URL of the network resource.
+func (c *Client) isInNetwork(rule *compute.Firewall) bool {
+	network := fmt.Sprintf("global/networks/%s", c.network)
+	return rule.Network == network || strings.HasSuffix(rule.Network, "/"+network)
+}
 
-	firewall := compute.Firewall{
-		Direction:    "INGRESS",
-		Denied:       []*compute.FirewallDenied{&denied},
-		Network:      fmt.Sprintf("global/networks/%s", c.network),
-		SourceRanges: models.ConvertSourceRangesMapToSlice(rule.SourceRanges),
-		Name:         rule.Name,
-		Description:  "Blocklist generated by CrowdSec Cloud Firewall Bouncer",
-		Priority:     rule.Priority,
+// getDenied returns the protocols and ports denied by the firewall rules. All protocols are denied if none is configured.
+func (c *Client) getDenied() []*compute.FirewallDenied {
+	if len(c.protocols) == 0 {
+		return []*compute.FirewallDenied{{IPProtocol: "all"}}
+	}
+	denied := []*compute.FirewallDenied{}
+	for _, protocol := range c.protocols {
+		denied = append(denied, &compute.FirewallDenied{
+			IPProtocol: strings.ToLower(protocol.Protocol),
+			Ports:      protocol.Ports,
+		})
 	}
-	if err := c.svc.InsertFirewallRule(c.project, &firewall); err != nil {
+	return denied
+}
+
+func (c *Client) getLogConfig() *compute.FirewallLogConfig {
+	logConfig := &compute.FirewallLogConfig{
+		Enable:          c.enableLogging,
+		ForceSendFields: []string{"Enable"},
+	}
+	if c.enableLogging {
+		logConfig.Metadata = c.logMetadata
+	}
+	return logConfig
+}
+
+func getDeniedKeys(denied []*compute.FirewallDenied) []string {
+	keys := []string{}
+	for _, d := range denied {
+		keys = append(keys, fmt.Sprintf("%s:%s", d.IPProtocol, strings.Join(d.Ports, ",")))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func equalStrings(a []string, b []string) bool {
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
+
+// isOutdated returns true if the denied protocols, targets or logging of the firewall rule do not match the configuration.
+func (c *Client) isOutdated(gcpRule *compute.Firewall) bool {
+	if !reflect.DeepEqual(getDeniedKeys(gcpRule.Denied), getDeniedKeys(c.getDenied())) {
+		return true
+	}
+	if !equalStrings(gcpRule.TargetTags, c.targetTags) || !equalStrings(gcpRule.TargetServiceAccounts, c.targetServiceAccounts) {
+		return true
+	}
+	logEnabled := gcpRule.LogConfig != nil && gcpRule.LogConfig.Enable
+	return logEnabled != c.enableLogging || (logEnabled && gcpRule.LogConfig.Metadata != c.logMetadata)
+}
+
+// newFirewall returns the firewall rule with the configured protocols, targets and logging.
+func (c *Client) newFirewall(name string, owner string, direction string, sources []string, priority int64) *compute.Firewall {
+	firewall := &compute.Firewall{
+		Direction:             direction,
+		Denied:                c.getDenied(),
+		Network:               fmt.Sprintf("global/networks/%s", c.network),
+		Name:                  name,
+		Description:           getDescription(owner),
+		Priority:              priority,
+		TargetTags:            c.targetTags,
+		TargetServiceAccounts: c.targetServiceAccounts,
+		LogConfig:             c.getLogConfig(),
+	}
+	if direction == "EGRESS" {
+		firewall.DestinationRanges = sources
+	} else {
+		firewall.SourceRanges = sources
+	}
+	return firewall
+}
+
+// newFirewallPatchRequest returns the patch request updating the sources, protocols, targets, logging and ownership marker of a firewall rule.
+func (c *Client) newFirewallPatchRequest(owner string, direction string, sources []string) *compute.Firewall {
+	firewallPatchRequest := &compute.Firewall{
+		Description:           getDescription(owner),
+		Denied:                c.getDenied(),
+		TargetTags:            c.targetTags,
+		TargetServiceAccounts: c.targetServiceAccounts,
+		LogConfig:             c.getLogConfig(),
+	}
+	if direction == "EGRESS" {
+		firewallPatchRequest.DestinationRanges = sources
+	} else {
+		firewallPatchRequest.SourceRanges = sources
+	}
+	// Targets removed from the configuration are cleared so that the rule applies to all instances again.
+	if len(c.targetTags) == 0 {
+		firewallPatchRequest.NullFields = append(firewallPatchRequest.NullFields, "TargetTags")
+	}
+	if len(c.targetServiceAccounts) == 0 {
+		firewallPatchRequest.NullFields = append(firewallPatchRequest.NullFields, "TargetServiceAccounts")
+	}
+	return firewallPatchRequest
+}
+
+// getGCPDirection returns the GCP direction of the rule: INGRESS or EGRESS.
+func getGCPDirection(rule *models.FirewallRule) string {
+	return strings.ToUpper(models.GetDirection(rule.Direction))
+}
+
+func (c *Client) CreateRule(rule *models.FirewallRule) error {
+	log.Infof("creating GCP firewall rule %s with %#v", rule.Name, rule.SourceRanges)
+
+	sources := models.ConvertSourceRangesMapToSlice(rule.SourceRanges)
+	op, err := c.svc.InsertFirewallRule(c.project, c.newFirewall(rule.Name, rule.Owner, getGCPDirection(rule), sources, rule.Priority))
+	if err != nil {
 		return fmt.Errorf("unable to create firewall rules %s: %s", rule.Name, err)
 	}
+	if err = c.svc.WaitOperation(c.project, op.Name); err != nil {
+		return fmt.Errorf("unable to create firewall rule %s: %s", rule.Name, err)
+	}
 	log.Infof("creation of rule %s successful", rule.Name)
 	return nil
 }
 
 func (c *Client) DeleteRule(rule *models.FirewallRule) error {
 	log.Infof("deleting GCP firewall rule %s", rule.Name)
-	if err := c.svc.DeleteFirewallRule(c.project, rule.Name); err != nil {
+	op, err := c.svc.DeleteFirewallRule(c.project, rule.Name)
+	if err != nil {
+		return fmt.Errorf("unable to delete firewall rule %s: %s", rule.Name, err)
+	}
+	if err = c.svc.WaitOperation(c.project, op.Name); err != nil {
 		return fmt.Errorf("unable to delete firewall rule %s: %s", rule.Name, err)
 	}
 	log.Infof("deletion of rule %s successful", rule.Name)
@@ -145,10 +404,12 @@ func (c *Client) DeleteRule(rule *models.FirewallRule) error {
 
 func (c *Client) PatchRule(rule *models.FirewallRule) error {
 	log.Infof("patching GCP firewall rule %s with %#v", rule.Name, rule.SourceRanges)
-	firewallPatchRequest := compute.Firewall{
-		SourceRanges: models.ConvertSourceRangesMapToSlice(rule.SourceRanges),
+	sources := models.ConvertSourceRangesMapToSlice(rule.SourceRanges)
+	op, err := c.svc.PatchFirewallRule(c.project, rule.Name, c.newFirewallPatchRequest(rule.Owner, getGCPDirection(rule), sources))
+	if err != nil {
+		return fmt.Errorf("unable to patch firewall rule %s: %s", rule.Name, err)
 	}
-	if err := c.svc.PatchFirewallRule(c.project, rule.Name, &firewallPatchRequest); err != nil {
+	if err = c.svc.WaitOperation(c.project, op.Name); err != nil {
 		return fmt.Errorf("unable to patch firewall rule %s: %s", rule.Name, err)
 	}
 	log.Infof("patching of rule %s successful", rule.Name)
@@ -1,13 +1,21 @@
 package gcp
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/models"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"google.golang.org/api/compute/v1"
 	"gotest.tools/assert"
 )
 
+const (
+	defaultNetwork   = "https://www.googleapis.com/compute/v1/projects/project/global/networks/default"
+	ownedDescription = "Blocklist generated by CrowdSec Cloud Firewall Bouncer [owner=crowdsec]"
+)
+
 type mockGoogleSvc struct {
 	GoogleComputeServiceIface
 }
@@ -17,19 +25,30 @@ func (s *mockGoogleSvc) ListFirewallRules(project string, ruleNamePrefix string)
 		Items: []*compute.Firewall{
 			{
 				Name:         "crowdsec-bingo-jumbo",
+				Network:      defaultNetwork,
+				Description:  ownedDescription,
 				SourceRanges: []string{"1.2.3.4/32"},
 			},
+			{
+				Name:         "crowdsec-other-network",
+				Network:      "https://www.googleapis.com/compute/v1/projects/project/global/networks/other",
+				Description:  ownedDescription,
+				SourceRanges: []string{"1.2.3.5/32"},
+			},
 		},
 	}, nil
 }
 
-func (s *mockGoogleSvc) InsertFirewallRule(project string, firewall *compute.Firewall) error {
-	return nil
+func (s *mockGoogleSvc) InsertFirewallRule(project string, firewall *compute.Firewall) (*compute.Operation, error) {
+	return &compute.Operation{}, nil
 }
-func (s *mockGoogleSvc) DeleteFirewallRule(project string, ruleName string) error {
-	return nil
+func (s *mockGoogleSvc) DeleteFirewallRule(project string, ruleName string) (*compute.Operation, error) {
+	return &compute.Operation{}, nil
+}
+func (s *mockGoogleSvc) PatchFirewallRule(project string, ruleName string, firewallPatchRequest *compute.Firewall) (*compute.Operation, error) {
+	return &compute.Operation{}, nil
 }
-func (s *mockGoogleSvc) PatchFirewallRule(project string, ruleName string, firewallPatchRequest *compute.Firewall) error {
+func (s *mockGoogleSvc) WaitOperation(project string, operation string) error {
 	return nil
 }
 
@@ -37,14 +56,19 @@ func TestGetRules(t *testing.T) {
 
 	mockSvc := &mockGoogleSvc{}
 	c := Client{
-		svc: mockSvc,
+		svc:     mockSvc,
+		network: "default",
 	}
 	rules, err := c.GetRules("crowdsec")
 	if err != nil {
 		log.Fatal(err)
 	}
-	assert.Equal(t, 1, len(rules))
+	assert.Equal(t, 2, len(rules))
 	assert.Equal(t, "crowdsec-bingo-jumbo", rules[0].Name)
+	// the rule of another network only reserves its name
+	assert.Equal(t, "crowdsec-other-network", rules[1].Name)
+	assert.Equal(t, models.ReservedNameOwner, rules[1].Owner)
+	assert.Equal(t, 0, len(rules[1].SourceRanges))
 }
 func TestCreateRule(t *testing.T) {
 
@@ -91,3 +115,319 @@ func TestPatchRule(t *testing.T) {
 	}
 	_ = c.PatchRule(&rule)
 }
+
+func TestGetDenied(t *testing.T) {
+
+	c := Client{}
+	denied := c.getDenied()
+	assert.Equal(t, 1, len(denied))
+	assert.Equal(t, "all", denied[0].IPProtocol)
+
+	c.protocols = []models.GCPProtocolConfig{
+		{Protocol: "TCP", Ports: []string{"22", "8000-9000"}},
+		{Protocol: "icmp"},
+	}
+	denied = c.getDenied()
+	assert.Equal(t, 2, len(denied))
+	assert.Equal(t, "tcp", denied[0].IPProtocol)
+	assert.DeepEqual(t, []string{"22", "8000-9000"}, denied[0].Ports)
+	assert.Equal(t, "icmp", denied[1].IPProtocol)
+}
+
+type mockRecordingSvc struct {
+	GoogleComputeServiceIface
+	rules    []*compute.Firewall
+	inserted []*compute.Firewall
+	patched  map[string]*compute.Firewall
+	deleted  []string
+	waited   []string
+	// waitErr is returned when waiting on the operations.
+	waitErr error
+}
+
+func (s *mockRecordingSvc) ListFirewallRules(project string, ruleNamePrefix string) (*compute.FirewallList, error) {
+	return &compute.FirewallList{Items: s.rules}, nil
+}
+
+func (s *mockRecordingSvc) InsertFirewallRule(project string, firewall *compute.Firewall) (*compute.Operation, error) {
+	s.inserted = append(s.inserted, firewall)
+	return &compute.Operation{Name: "insert-" + firewall.Name}, nil
+}
+func (s *mockRecordingSvc) DeleteFirewallRule(project string, ruleName string) (*compute.Operation, error) {
+	s.deleted = append(s.deleted, ruleName)
+	return &compute.Operation{Name: "delete-" + ruleName}, nil
+}
+func (s *mockRecordingSvc) PatchFirewallRule(project string, ruleName string, firewallPatchRequest *compute.Firewall) (*compute.Operation, error) {
+	s.patched[ruleName] = firewallPatchRequest
+	return &compute.Operation{Name: "patch-" + ruleName}, nil
+}
+func (s *mockRecordingSvc) WaitOperation(project string, operation string) error {
+	s.waited = append(s.waited, operation)
+	return s.waitErr
+}
+
+func newRecordingSvc(rules ...*compute.Firewall) *mockRecordingSvc {
+	return &mockRecordingSvc{rules: rules, patched: map[string]*compute.Firewall{}}
+}
+
+func TestGetRulesOutdated(t *testing.T) {
+
+	upToDate := &compute.Firewall{
+		Name:         "crowdsec-up-to-date",
+		Network:      defaultNetwork,
+		Description:  ownedDescription,
+		Direction:    "INGRESS",
+		SourceRanges: []string{"1.2.3.4/32"},
+		Denied:       []*compute.FirewallDenied{{IPProtocol: "all"}},
+		TargetTags:   []string{"web"},
+		LogConfig:    &compute.FirewallLogConfig{Enable: false},
+	}
+	outdated := &compute.Firewall{
+		Name:         "crowdsec-outdated",
+		Network:      defaultNetwork,
+		Description:  ownedDescription,
+		Direction:    "INGRESS",
+		SourceRanges: []string{"1.2.3.5/32"},
+		Denied:       []*compute.FirewallDenied{{IPProtocol: "all"}},
+	}
+	egress := &compute.Firewall{
+		Name:              "crowdsec-egress",
+		Network:           defaultNetwork,
+		Description:       ownedDescription,
+		Direction:         "EGRESS",
+		DestinationRanges: []string{"1.2.3.6/32"},
+		Denied:            []*compute.FirewallDenied{{IPProtocol: "all"}},
+		TargetTags:        []string{"web"},
+	}
+	c := Client{
+		svc:        newRecordingSvc(upToDate, outdated, egress),
+		network:    "default",
+		targetTags: []string{"web"},
+	}
+	rules, err := c.GetRules("crowdsec")
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(rules))
+	assert.Equal(t, "crowdsec-up-to-date", rules[0].Name)
+	assert.Assert(t, rules[0].State != models.Modified)
+	assert.Equal(t, models.Ingress, rules[0].Direction)
+	assert.Equal(t, "crowdsec-outdated", rules[1].Name)
+	assert.Equal(t, models.Modified, rules[1].State)
+	assert.Equal(t, models.Egress, rules[2].Direction)
+	assert.Equal(t, true, rules[2].SourceRanges["1.2.3.6/32"])
+	assert.Assert(t, rules[2].State != models.Modified)
+
+	c.enableLogging = true
+	c.logMetadata = "INCLUDE_ALL_METADATA"
+	rules, err = c.GetRules("crowdsec")
+	assert.NilError(t, err)
+	assert.Equal(t, models.Modified, rules[0].State)
+}
+
+func TestRuleSetsDirections(t *testing.T) {
+
+	c := Client{priority: 10, maxRules: 5}
+	ruleSets := c.RuleSets()
+	assert.Equal(t, 1, len(ruleSets))
+	assert.Equal(t, models.Ingress, ruleSets[0].Direction)
+
+	c.direction = models.Both
+	ruleSets = c.RuleSets()
+	assert.Equal(t, 2, len(ruleSets))
+	assert.Equal(t, models.Egress, ruleSets[1].Direction)
+	assert.Equal(t, int64(10), ruleSets[1].Priority)
+	assert.Equal(t, 5, ruleSets[1].MaxRules)
+
+	c.priorityRange = models.PriorityRange{Min: 10, Max: 20}
+	ruleSets = c.RuleSets()
+	assert.Equal(t, int64(20), ruleSets[0].MaxPriority)
+	assert.Equal(t, int64(20), ruleSets[1].MaxPriority)
+}
+
+func TestCreateRuleDirections(t *testing.T) {
+
+	mockSvc := newRecordingSvc()
+	c := Client{
+		svc:           mockSvc,
+		network:       "default",
+		targetTags:    []string{"web"},
+		enableLogging: true,
+		logMetadata:   "EXCLUDE_ALL_METADATA",
+	}
+	rule := models.FirewallRule{
+		Name:         "crowdsec-bingo-jumbo",
+		SourceRanges: map[string]bool{"1.0.0.0/32": true},
+		Priority:     10,
+	}
+	assert.NilError(t, c.CreateRule(&rule))
+	rule.Direction = models.Egress
+	assert.NilError(t, c.CreateRule(&rule))
+	assert.Equal(t, 2, len(mockSvc.inserted))
+	assert.Equal(t, "INGRESS", mockSvc.inserted[0].Direction)
+	assert.DeepEqual(t, []string{"1.0.0.0/32"}, mockSvc.inserted[0].SourceRanges)
+	assert.DeepEqual(t, []string{"web"}, mockSvc.inserted[0].TargetTags)
+	assert.Equal(t, true, mockSvc.inserted[0].LogConfig.Enable)
+	assert.Equal(t, "EXCLUDE_ALL_METADATA", mockSvc.inserted[0].LogConfig.Metadata)
+	assert.Equal(t, "EGRESS", mockSvc.inserted[1].Direction)
+	assert.DeepEqual(t, []string{"1.0.0.0/32"}, mockSvc.inserted[1].DestinationRanges)
+	assert.Equal(t, 0, len(mockSvc.inserted[1].SourceRanges))
+}
+
+func TestPatchRuleDirections(t *testing.T) {
+
+	mockSvc := newRecordingSvc()
+	c := Client{
+		svc: mockSvc,
+	}
+	rule := models.FirewallRule{
+		Name:         "crowdsec-bingo-jumbo",
+		SourceRanges: map[string]bool{"1.0.0.0/32": true},
+	}
+	assert.NilError(t, c.PatchRule(&rule))
+	assert.DeepEqual(t, []string{"1.0.0.0/32"}, mockSvc.patched["crowdsec-bingo-jumbo"].SourceRanges)
+	assert.DeepEqual(t, []string{"TargetTags", "TargetServiceAccounts"}, mockSvc.patched["crowdsec-bingo-jumbo"].NullFields)
+
+	rule.Name = "crowdsec-egress"
+	rule.Direction = models.Egress
+	assert.NilError(t, c.PatchRule(&rule))
+	assert.DeepEqual(t, []string{"1.0.0.0/32"}, mockSvc.patched["crowdsec-egress"].DestinationRanges)
+}
+
+func TestWaitOperations(t *testing.T) {
+
+	mockSvc := newRecordingSvc()
+	c := Client{
+		svc: mockSvc,
+	}
+	rule := models.FirewallRule{
+		Name:         "crowdsec-bingo-jumbo",
+		SourceRanges: map[string]bool{"1.0.0.0/32": true},
+	}
+	assert.NilError(t, c.CreateRule(&rule))
+	assert.NilError(t, c.PatchRule(&rule))
+	assert.NilError(t, c.DeleteRule(&rule))
+	assert.DeepEqual(t, []string{"insert-crowdsec-bingo-jumbo", "patch-crowdsec-bingo-jumbo", "delete-crowdsec-bingo-jumbo"}, mockSvc.waited)
+
+	mockSvc.waitErr = fmt.Errorf("operation insert-crowdsec-bingo-jumbo failed: QUOTA_EXCEEDED: Quota 'FIREWALLS' exceeded")
+	assert.ErrorContains(t, c.CreateRule(&rule), "QUOTA_EXCEEDED")
+}
+
+func TestGetOperationError(t *testing.T) {
+
+	assert.NilError(t, getOperationError(&compute.Operation{Status: "DONE"}))
+	err := getOperationError(&compute.Operation{
+		Name:   "operation",
+		Status: "DONE",
+		Error: &compute.OperationError{
+			Errors: []*compute.OperationErrorErrors{
+				{Code: "QUOTA_EXCEEDED", Message: "Quota 'FIREWALLS' exceeded"},
+			},
+		},
+	})
+	assert.Error(t, err, "operation operation failed: QUOTA_EXCEEDED: Quota 'FIREWALLS' exceeded")
+}
+
+func TestGetRulesWarnsOnce(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	c := Client{svc: &mockGoogleSvc{}, network: "default"}
+	for i := 0; i < 2; i++ {
+		_, err := c.GetRules("crowdsec")
+		assert.NilError(t, err)
+	}
+	warnings := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.WarnLevel {
+			warnings++
+		}
+	}
+	// the rule of the other network is only reported by the first update
+	assert.Equal(t, 1, warnings)
+}
+
+func TestIsInNetwork(t *testing.T) {
+
+	c := Client{network: "default"}
+	assert.Equal(t, true, c.isInNetwork(&compute.Firewall{Network: defaultNetwork}))
+	assert.Equal(t, true, c.isInNetwork(&compute.Firewall{Network: "global/networks/default"}))
+	assert.Equal(t, false, c.isInNetwork(&compute.Firewall{Network: "https://www.googleapis.com/compute/v1/projects/project/global/networks/default-2"}))
+	assert.Equal(t, false, c.isInNetwork(&compute.Firewall{}))
+}
+
+func TestGetRulesOwnership(t *testing.T) {
+
+	owned := &compute.Firewall{
+		Name:         "crowdsec-gcp-0",
+		Network:      defaultNetwork,
+		Description:  ownedDescription,
+		SourceRanges: []string{"1.2.3.4/32"},
+		Denied:       []*compute.FirewallDenied{{IPProtocol: "all"}},
+	}
+	legacy := &compute.Firewall{
+		Name:         "crowdsec-bingo-jumbo",
+		Network:      defaultNetwork,
+		Description:  "Blocklist generated by CrowdSec Cloud Firewall Bouncer",
+		SourceRanges: []string{"1.2.3.5/32"},
+		Denied:       []*compute.FirewallDenied{{IPProtocol: "all"}},
+	}
+	foreign := &compute.Firewall{
+		Name:         "crowdsec-prod-gcp-0",
+		Network:      defaultNetwork,
+		Description:  "Blocklist generated by CrowdSec Cloud Firewall Bouncer [owner=crowdsec-prod]",
+		SourceRanges: []string{"1.2.3.6/32"},
+	}
+	unrelated := &compute.Firewall{
+		Name:         "crowdsec-allow-lapi",
+		Network:      defaultNetwork,
+		Description:  "Allow the bouncers to reach the local API",
+		SourceRanges: []string{"10.0.0.0/8"},
+	}
+	mockSvc := newRecordingSvc(owned, legacy, foreign, unrelated)
+	c := Client{
+		svc:     mockSvc,
+		network: "default",
+	}
+	rules, err := c.GetRules("crowdsec")
+	assert.NilError(t, err)
+	assert.Equal(t, 4, len(rules))
+	assert.Equal(t, "crowdsec", rules[0].Owner)
+	assert.Assert(t, rules[0].State != models.Modified)
+	assert.Equal(t, "crowdsec", rules[1].Owner)
+	assert.Equal(t, models.Modified, rules[1].State)
+	assert.Equal(t, "crowdsec-prod", rules[2].Owner)
+	assert.Assert(t, rules[2].State != models.Modified)
+	assert.Equal(t, models.ForeignOwner, rules[3].Owner)
+
+	assert.NilError(t, c.PatchRule(rules[1]))
+	assert.Equal(t, ownedDescription, mockSvc.patched["crowdsec-bingo-jumbo"].Description)
+	assert.NilError(t, c.CreateRule(&models.FirewallRule{Name: "crowdsec-gcp-1", Owner: "crowdsec"}))
+	assert.Equal(t, ownedDescription, mockSvc.inserted[0].Description)
+}
+
+type mockPreflightSvc struct {
+	mockGoogleSvc
+	granted []string
+}
+
+func (s *mockPreflightSvc) GetNetwork(project string, network string) (*compute.Network, error) {
+	if network != defaultNetwork {
+		return nil, fmt.Errorf("network %s not found", network)
+	}
+	return &compute.Network{Name: network}, nil
+}
+
+func (s *mockPreflightSvc) TestPermissions(project string, permissions []string) ([]string, error) {
+	return s.granted, nil
+}
+
+func TestPreflight(t *testing.T) {
+	client := &Client{svc: &mockPreflightSvc{granted: permissions}, project: "test", network: defaultNetwork}
+	checks := client.Preflight()
+	assert.Equal(t, 2, len(checks))
+	assert.NilError(t, checks[0].Err)
+	assert.NilError(t, checks[1].Err)
+
+	client = &Client{svc: &mockPreflightSvc{granted: permissions[1:]}, project: "test", network: "missing"}
+	checks = client.Preflight()
+	assert.ErrorContains(t, checks[0].Err, "unable to get network missing")
+	assert.Error(t, checks[1].Err, "missing permission(s) compute.firewalls.create")
+}
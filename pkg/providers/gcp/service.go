@@ -3,27 +3,33 @@ package gcp
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"golang.org/x/oauth2"
+	"google.golang.org/api/cloudresourcemanager/v1"
 	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/option"
 )
 
 type GoogleComputeServiceIface interface {
 	ListFirewallRules(project string, ruleNamePrefix string) (*compute.FirewallList, error)
-	InsertFirewallRule(project string, firewall *compute.Firewall) error
-	DeleteFirewallRule(project string, ruleName string) error
-	PatchFirewallRule(project string, ruleName string, firewallPatchRequest *compute.Firewall) error
+	InsertFirewallRule(project string, firewall *compute.Firewall) (*compute.Operation, error)
+	DeleteFirewallRule(project string, ruleName string) (*compute.Operation, error)
+	PatchFirewallRule(project string, ruleName string, firewallPatchRequest *compute.Firewall) (*compute.Operation, error)
+	WaitOperation(project string, operation string) error
+	GetNetwork(project string, network string) (*compute.Network, error)
+	TestPermissions(project string, permissions []string) ([]string, error)
 }
 
 type GoogleComputeService struct {
 	svc *compute.Service
+	crm *cloudresourcemanager.Service
 }
 
-// NewGoogleComputeService creates the compute service.
+// NewGoogleComputeService creates the compute service, authenticated with the credentials options.
 // The default endpoint can be overriden for testing purpose (to make calls to a mock server instead of the real Google servers).
-func NewGoogleComputeService(endpoint string) *GoogleComputeService {
-	opts := []option.ClientOption{}
+func NewGoogleComputeService(endpoint string, credentials ...option.ClientOption) *GoogleComputeService {
+	opts := credentials
 	if endpoint != "" {
 		config := &oauth2.Config{
 			Endpoint: oauth2.Endpoint{
@@ -36,28 +42,79 @@ func NewGoogleComputeService(endpoint string) *GoogleComputeService {
 		if err != nil {
 			log.Fatalf("Couldn't create dummy token for new Google compute service: %s", err)
 		}
-		opts = append(opts, option.WithEndpoint(endpoint), option.WithTokenSource(config.TokenSource(ctx, token)))
+		opts = []option.ClientOption{option.WithEndpoint(endpoint), option.WithTokenSource(config.TokenSource(ctx, token))}
 	}
 	svc, err := compute.NewService(context.Background(), opts...)
 	if err != nil {
 		log.Fatalf("Unable to create new compute service: %s", err)
 	}
-	return &GoogleComputeService{svc}
+	crm, err := cloudresourcemanager.NewService(context.Background(), opts...)
+	if err != nil {
+		log.Fatalf("Unable to create new resource manager service: %s", err)
+	}
+	return &GoogleComputeService{svc, crm}
 }
 
+// ListFirewallRules returns the firewall rules of all networks whose name starts with the prefix, going through all the result pages.
 func (s *GoogleComputeService) ListFirewallRules(project string, ruleNamePrefix string) (*compute.FirewallList, error) {
-	return s.svc.Firewalls.List(project).Filter(fmt.Sprintf("name=%s*", ruleNamePrefix)).Do()
+	rules := &compute.FirewallList{}
+	call := s.svc.Firewalls.List(project).Filter(fmt.Sprintf("name=%s*", ruleNamePrefix))
+	err := call.Pages(context.Background(), func(page *compute.FirewallList) error {
+		rules.Items = append(rules.Items, page.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (s *GoogleComputeService) InsertFirewallRule(project string, firewall *compute.Firewall) (*compute.Operation, error) {
+	return s.svc.Firewalls.Insert(project, firewall).Do()
+}
+func (s *GoogleComputeService) DeleteFirewallRule(project string, ruleName string) (*compute.Operation, error) {
+	return s.svc.Firewalls.Delete(project, ruleName).Do()
+}
+func (s *GoogleComputeService) PatchFirewallRule(project string, ruleName string, firewallPatchRequest *compute.Firewall) (*compute.Operation, error) {
+	return s.svc.Firewalls.Patch(project, ruleName, firewallPatchRequest).Do()
+}
+
+func (s *GoogleComputeService) GetNetwork(project string, network string) (*compute.Network, error) {
+	return s.svc.Networks.Get(project, network).Do()
 }
 
-func (s *GoogleComputeService) InsertFirewallRule(project string, firewall *compute.Firewall) error {
-	_, err := s.svc.Firewalls.Insert(project, firewall).Do()
-	return err
+// TestPermissions returns the permissions granted on the project among the given permissions.
+func (s *GoogleComputeService) TestPermissions(project string, permissions []string) ([]string, error) {
+	res, err := s.crm.Projects.TestIamPermissions(project, &cloudresourcemanager.TestIamPermissionsRequest{Permissions: permissions}).Do()
+	if err != nil {
+		return nil, err
+	}
+	return res.Permissions, nil
 }
-func (s *GoogleComputeService) DeleteFirewallRule(project string, ruleName string) error {
-	_, err := s.svc.Firewalls.Delete(project, ruleName).Do()
-	return err
+
+// WaitOperation waits for the global operation to be done and returns the operation errors, if any.
+// A single wait call returns after 2 minutes at most, so it is repeated until the operation is done.
+func (s *GoogleComputeService) WaitOperation(project string, operation string) error {
+	for {
+		op, err := s.svc.GlobalOperations.Wait(project, operation).Do()
+		if err != nil {
+			return err
+		}
+		if op.Status != "DONE" {
+			continue
+		}
+		return getOperationError(op)
+	}
 }
-func (s *GoogleComputeService) PatchFirewallRule(project string, ruleName string, firewallPatchRequest *compute.Firewall) error {
-	_, err := s.svc.Firewalls.Patch(project, ruleName, firewallPatchRequest).Do()
-	return err
+
+// getOperationError returns the errors of a done operation, such as quota exceeded or invalid source range.
+func getOperationError(op *compute.Operation) error {
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+	messages := []string{}
+	for _, e := range op.Error.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", e.Code, e.Message))
+	}
+	return fmt.Errorf("operation %s failed: %s", op.Name, strings.Join(messages, ", "))
 }
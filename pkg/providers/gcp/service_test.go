@@ -0,0 +1,36 @@
+package gcp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestListFirewallRulesPages(t *testing.T) {
+	pageTokens := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/" {
+			_, _ = w.Write([]byte(`{"access_token": "dummy", "token_type": "Bearer"}`))
+			return
+		}
+		pageToken := r.URL.Query().Get("pageToken")
+		pageTokens = append(pageTokens, pageToken)
+		if pageToken == "" {
+			_, _ = w.Write([]byte(`{"items": [{"name": "crowdsec-rule-1"}], "nextPageToken": "page-2"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"items": [{"name": "crowdsec-rule-2"}]}`))
+	}))
+	defer server.Close()
+
+	s := NewGoogleComputeService(server.URL + "/")
+	rules, err := s.ListFirewallRules("project", "crowdsec")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"", "page-2"}, pageTokens)
+	assert.Equal(t, 2, len(rules.Items))
+	assert.Equal(t, "crowdsec-rule-1", rules.Items[0].Name)
+	assert.Equal(t, "crowdsec-rule-2", rules.Items[1].Name)
+}
@@ -0,0 +1,69 @@
+// Package googleauth builds the credentials of the Google API clients shared by the gcp and cloudarmor providers.
+package googleauth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// scope is the OAuth scope of the credentials, covering the compute, resource manager and network security APIs.
+const scope = "https://www.googleapis.com/auth/cloud-platform"
+
+// GetClientOptions returns the options authenticating the Google API clients with the credentials file, or with
+// Application Default Credentials when it is empty, impersonating the service account if any. The credentials are
+// loaded immediately, so that invalid credentials are reported when the client is created.
+func GetClientOptions(credentialsFile string, impersonateServiceAccount string) ([]option.ClientOption, error) {
+	ctx := context.Background()
+	opts := []option.ClientOption{}
+	if credentialsFile != "" {
+		credentialsJSON, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read credentials_file: %s", err)
+		}
+		credentials, err := google.CredentialsFromJSON(ctx, credentialsJSON, scope)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load credentials_file %s: %s", credentialsFile, err)
+		}
+		opts = append(opts, option.WithCredentials(credentials))
+	}
+	if impersonateServiceAccount == "" {
+		return opts, nil
+	}
+	tokenSource, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: impersonateServiceAccount,
+		Scopes:          []string{scope},
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to impersonate %s: %s", impersonateServiceAccount, err)
+	}
+	return []option.ClientOption{option.WithTokenSource(tokenSource)}, nil
+}
+
+// GetProjectID returns the project of the credentials file, or of Application Default Credentials when it is empty.
+func GetProjectID(credentialsFile string) (string, error) {
+	ctx := context.Background()
+	var credentials *google.Credentials
+	var err error
+	if credentialsFile != "" {
+		var credentialsJSON []byte
+		credentialsJSON, err = ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read credentials_file: %s", err)
+		}
+		credentials, err = google.CredentialsFromJSON(ctx, credentialsJSON, scope)
+	} else {
+		credentials, err = google.FindDefaultCredentials(ctx, scope)
+	}
+	if err != nil {
+		return "", err
+	}
+	if credentials.ProjectID == "" {
+		return "", fmt.Errorf("Default credentials does not have a project ID associated")
+	}
+	return credentials.ProjectID, nil
+}
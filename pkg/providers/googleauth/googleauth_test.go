@@ -0,0 +1,48 @@
+package googleauth
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const authorizedUser = `{
+  "type": "authorized_user",
+  "client_id": "client-id",
+  "client_secret": "client-secret",
+  "refresh_token": "refresh-token"
+}`
+
+func TestGetClientOptions(t *testing.T) {
+	dir := t.TempDir()
+	validFile := filepath.Join(dir, "credentials.json")
+	invalidFile := filepath.Join(dir, "invalid.json")
+	assert.NilError(t, ioutil.WriteFile(validFile, []byte(authorizedUser), 0600))
+	assert.NilError(t, ioutil.WriteFile(invalidFile, []byte("not json"), 0600))
+
+	tests := []struct {
+		name                      string
+		credentialsFile           string
+		impersonateServiceAccount string
+		wantOpts                  int
+		wantErr                   bool
+	}{
+		{name: "credentials-file", credentialsFile: validFile, wantOpts: 1},
+		{name: "impersonation", credentialsFile: validFile, impersonateServiceAccount: "bouncer@project.iam.gserviceaccount.com", wantOpts: 1},
+		{name: "missing-file", credentialsFile: filepath.Join(dir, "missing.json"), wantErr: true},
+		{name: "invalid-file", credentialsFile: invalidFile, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := GetClientOptions(tt.credentialsFile, tt.impersonateServiceAccount)
+			if tt.wantErr {
+				assert.Assert(t, err != nil)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, tt.wantOpts, len(opts))
+		})
+	}
+}
@@ -23,3 +23,25 @@ type CloudClient interface {
 	// PatchRule updates the source ranges of the firewall rule at the cloud provider that matches the rule name.
 	PatchRule(rule *models.FirewallRule) error
 }
+
+// RuleSetsClient is an optional interface implemented by cloud clients that enforce decisions
+// in several rule sets, each with its own decision type, scope and priority range.
+// Clients not implementing it enforce every IP and range decision as a ban in a single rule set.
+type RuleSetsClient interface {
+	// RuleSets returns the rule sets maintained by the client. Decisions of a scope without a ban rule set are ignored.
+	RuleSets() []models.RuleSet
+}
+
+// PreviewClient is an optional interface implemented by cloud clients that can create rules in preview mode,
+// where matches are logged without enforcing the rule action.
+type PreviewClient interface {
+	// PromoteRules switches the rules matching the ruleNamePrefix from preview to enforcing and returns the number of promoted rules.
+	PromoteRules(ruleNamePrefix string) (int, error)
+}
+
+// PreflightClient is an optional interface implemented by cloud clients that can check, before processing decisions,
+// that the resources they update exist and that they have the permissions they need.
+type PreflightClient interface {
+	// Preflight runs the checks of the client without changing any resource and returns their results.
+	Preflight() []models.PreflightCheck
+}
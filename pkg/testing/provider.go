@@ -94,3 +94,66 @@ func (c *FakeClientExistingRules) DeleteRule(rule *models.FirewallRule) error {
 func (c *FakeClientExistingRules) PatchRule(rule *models.FirewallRule) error {
 	return nil
 }
+
+// FakeClientRuleSets is a fake client maintaining a ban and a captcha rule set, recording the rules it creates, patches
+// and deletes.
+type FakeClientRuleSets struct {
+	Created []*models.FirewallRule
+	Patched []*models.FirewallRule
+	Deleted []*models.FirewallRule
+}
+
+func (c *FakeClientRuleSets) GetProviderName() string {
+	return "fake-client-rule-sets"
+}
+
+func NewClientRuleSets() (*FakeClientRuleSets, error) {
+
+	return &FakeClientRuleSets{}, nil
+}
+
+func (c *FakeClientRuleSets) MaxSourcesPerRule() int {
+	return 3
+}
+
+func (c *FakeClientRuleSets) MaxRules() int {
+	return 2
+}
+
+func (c *FakeClientRuleSets) Priority() int64 {
+	return 0
+}
+
+func (c *FakeClientRuleSets) RuleSets() []models.RuleSet {
+	return []models.RuleSet{
+		{Type: models.Ban, Priority: 0, MaxRules: 2},
+		{Type: models.Captcha, Priority: 100, MaxRules: 2},
+	}
+}
+
+func (c *FakeClientRuleSets) GetRules(ruleNamePrefix string) ([]*models.FirewallRule, error) {
+
+	return []*models.FirewallRule{{
+		Name: "rule-ban",
+		SourceRanges: map[string]bool{
+			"1.0.0.0/32": true,
+		},
+		Priority: 0,
+		Type:     models.Ban,
+	}}, nil
+}
+
+func (c *FakeClientRuleSets) CreateRule(rule *models.FirewallRule) error {
+	c.Created = append(c.Created, rule)
+	return nil
+}
+
+func (c *FakeClientRuleSets) DeleteRule(rule *models.FirewallRule) error {
+	c.Deleted = append(c.Deleted, rule)
+	return nil
+}
+
+func (c *FakeClientRuleSets) PatchRule(rule *models.FirewallRule) error {
+	c.Patched = append(c.Patched, rule)
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	csmodels "github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/config"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/firewall"
+	log "github.com/sirupsen/logrus"
+)
+
+// runningBouncers are the firewall bouncers of the running configuration. They are only changed by the goroutine
+// processing the decisions, so that a reload never happens during an update.
+type runningBouncers struct {
+	config    config.BouncerConfig
+	bouncers  []*firewall.Bouncer
+	router    *firewall.Router
+	durations *firewall.DurationPolicy
+	decisions *firewall.DecisionCache
+}
+
+func newRunningBouncers(config config.BouncerConfig, bouncers []*firewall.Bouncer) (*runningBouncers, error) {
+	router, err := firewall.NewRouter(config.Routes)
+	if err != nil {
+		return nil, err
+	}
+	durations, err := firewall.NewDurationPolicy(config.Durations)
+	if err != nil {
+		return nil, err
+	}
+	return &runningBouncers{config: config, bouncers: bouncers, router: router, durations: durations, decisions: firewall.NewDecisionCache()}, nil
+}
+
+// update applies the decisions of the stream, bounded by the duration policy, routed to each bouncer.
+func (r *runningBouncers) update(decisions *csmodels.DecisionsStreamResponse) {
+	decisions = r.durations.Apply(decisions)
+	r.decisions.Update(decisions)
+	for _, fb := range r.bouncers {
+		routed := r.router.Route(decisions, fb.Client.GetProviderName())
+		if err := fb.Submit(routed); err != nil {
+			log.Errorf("unable to process decisions : %s", err)
+		} else {
+			log.Debugf("process completed")
+		}
+	}
+}
+
+// getProviderConfig returns the configuration of the provider, which is compared to detect its changes.
+func getProviderConfig(config config.BouncerConfig, providerName string) interface{} {
+	switch providerName {
+	case "gcp":
+		return config.CloudProviders.GCP
+	case "aws":
+		return config.CloudProviders.AWS
+	case "cloudarmor":
+		return config.CloudProviders.CloudArmor
+	}
+	return nil
+}
+
+// warnRestartSettings warns about the changed settings that are only applied when the bouncer is restarted.
+func warnRestartSettings(current config.BouncerConfig, next config.BouncerConfig) {
+	settings := []struct {
+		name    string
+		changed bool
+	}{
+		{"api_url", current.APIUrl != next.APIUrl},
+		{"api_key", current.APIKey != next.APIKey},
+		{"ca_cert_path", current.CACertPath != next.CACertPath},
+		{"cert_path", current.CertPath != next.CertPath},
+		{"key_path", current.KeyPath != next.KeyPath},
+		{"insecure_skip_verify", current.InsecureSkipVerify != next.InsecureSkipVerify},
+		{"update_frequency", current.UpdateFrequency != next.UpdateFrequency},
+		{"daemonize", current.Daemon != next.Daemon},
+		{"log_mode", current.LogMode != next.LogMode},
+		{"log_dir", current.LogDir != next.LogDir},
+	}
+	for _, setting := range settings {
+		if setting.changed {
+			log.Warningf("%s changed, restart the bouncer to apply it", setting.name)
+		}
+	}
+}
+
+// reloadPlan is the result of the comparison of the running configuration with the new one.
+type reloadPlan struct {
+	// bouncers are the bouncers of the new configuration.
+	bouncers []*firewall.Bouncer
+	// created are the new bouncers, which are not aware of the active decisions yet.
+	created []*firewall.Bouncer
+	// removed are the bouncers of the providers removed from the configuration, or whose rules are renamed.
+	removed []*firewall.Bouncer
+}
+
+// planReload returns the bouncers of the new configuration. The bouncers of the providers whose configuration did not
+// change are kept, the others are created and checked. Nothing is changed if a bouncer cannot be created, so that an
+// invalid configuration never replaces the running one.
+func (r *runningBouncers) planReload(next config.BouncerConfig) (*reloadPlan, error) {
+	running := map[string]*firewall.Bouncer{}
+	for _, fb := range r.bouncers {
+		running[fb.Client.GetProviderName()] = fb
+	}
+	prefixChanged := r.config.RuleNamePrefix != next.RuleNamePrefix
+	expansionChanged := !reflect.DeepEqual(r.config.DecisionExpansion, next.DecisionExpansion)
+	tiersChanged := !reflect.DeepEqual(r.config.Tiers, next.Tiers)
+
+	var expander firewall.DecisionExpander
+	expanderLoaded := false
+	if !expansionChanged && len(r.bouncers) > 0 {
+		// the databases are reloaded by the expander when their files change
+		expander = r.bouncers[0].Expander
+		expanderLoaded = true
+	}
+	plan := &reloadPlan{}
+	for _, providerName := range config.ProviderNames {
+		fb, ok := running[providerName]
+		if !isProviderEnabled(next, providerName) {
+			if ok {
+				plan.removed = append(plan.removed, fb)
+			}
+			continue
+		}
+		if ok && !prefixChanged && !expansionChanged && !tiersChanged && reflect.DeepEqual(getProviderConfig(r.config, providerName), getProviderConfig(next, providerName)) {
+			plan.bouncers = append(plan.bouncers, fb)
+			continue
+		}
+		client, err := newProviderClient(next, providerName)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get %s provider client: %s", providerName, err)
+		}
+		if !expanderLoaded {
+			if expander, err = getExpander(next); err != nil {
+				return nil, err
+			}
+			expanderLoaded = true
+		}
+		created := newFirewallBouncer(next, client, expander)
+		if err := created.CheckTiers(); err != nil {
+			return nil, fmt.Errorf("%s: %s", providerName, err)
+		}
+		if next.Preflight != config.PreflightDisabled {
+			if err := created.Preflight(); err != nil {
+				if next.Preflight == config.PreflightFailFast {
+					return nil, fmt.Errorf("%s: %s", providerName, err)
+				}
+				if ok && !prefixChanged {
+					log.Warningf("%s provider keeps its running configuration: %s", providerName, err)
+					plan.bouncers = append(plan.bouncers, fb)
+				} else {
+					log.Warningf("%s provider is disabled: %s", providerName, err)
+					if ok {
+						plan.removed = append(plan.removed, fb)
+					}
+				}
+				continue
+			}
+		}
+		plan.bouncers = append(plan.bouncers, created)
+		plan.created = append(plan.created, created)
+		if ok && prefixChanged {
+			plan.removed = append(plan.removed, fb)
+		} else if ok {
+			// the running bouncer is replaced, its batched decisions are applied by the new one
+			created.KeepBatch(fb)
+		}
+	}
+	if len(plan.bouncers) == 0 {
+		return nil, fmt.Errorf("at least one cloud provider must be configured")
+	}
+	return plan, nil
+}
+
+// reload reads the configuration file again and applies it to the bouncers, without interrupting the decision stream.
+// The running configuration is kept if the new one is invalid.
+func (r *runningBouncers) reload(configPath string) error {
+	next, err := config.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	router, err := firewall.NewRouter(next.Routes)
+	if err != nil {
+		return err
+	}
+	durations, err := firewall.NewDurationPolicy(next.Durations)
+	if err != nil {
+		return err
+	}
+	plan, err := r.planReload(*next)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(r.config.Routes, next.Routes) {
+		log.Infof("routes changed, they apply to the new decisions")
+	}
+	if r.config.Durations != next.Durations {
+		log.Infof("durations changed, they apply to the new decisions")
+	}
+	if !reflect.DeepEqual(r.config.Tiers, next.Tiers) {
+		log.Warningf("tiers changed, existing rules now belong to the tier of their priority band")
+	}
+	warnRestartSettings(r.config, *next)
+	if r.config.LogLevel != next.LogLevel {
+		log.SetLevel(next.LogLevel)
+	}
+
+	for _, fb := range plan.removed {
+		log.Infof("removing %s provider", fb.Client.GetProviderName())
+		if err := fb.ShutDown(); err != nil {
+			log.Errorf("unable to shut down %s provider: %s", fb.Client.GetProviderName(), err)
+		}
+	}
+	for _, fb := range plan.bouncers {
+		fb.CleanupOnShutdown = next.CleanupOnShutdown
+	}
+	r.config = *next
+	r.bouncers = plan.bouncers
+	r.router = router
+	durations.KeepTimers(r.durations)
+	r.durations = durations
+	for _, fb := range plan.created {
+		decisions := r.router.Route(r.decisions.Decisions(), fb.Client.GetProviderName())
+		log.Infof("starting %s provider with %d active decision(s)", fb.Client.GetProviderName(), len(decisions.New))
+		if err := fb.Update(decisions); err != nil {
+			log.Errorf("unable to process decisions : %s", err)
+		}
+	}
+	log.Infof("configuration reloaded, %d provider(s) kept, %d started, %d removed", len(plan.bouncers)-len(plan.created), len(plan.created), len(plan.removed))
+	return nil
+}
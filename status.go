@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/config"
+	"github.com/fallard84/cs-cloud-firewall-bouncer/pkg/firewall"
+)
+
+const (
+	tableOutput = "table"
+	jsonOutput  = "json"
+	csvOutput   = "csv"
+)
+
+var ruleColumns = []string{"PROVIDER", "NAME", "TYPE", "SCOPE", "DIRECTION", "PRIORITY", "TIER", "SOURCES", "MAX SOURCES"}
+
+func checkOutputValid(output string) error {
+	switch output {
+	case tableOutput, jsonOutput, csvOutput:
+		return nil
+	}
+	return fmt.Errorf("output %s is not supported, it must be one of %s, %s or %s", output, tableOutput, jsonOutput, csvOutput)
+}
+
+// getRuleRow returns the columns of the rule, followed by its sources when withSources is true.
+func getRuleRow(rule firewall.RuleStatus, withSources bool) []string {
+	row := []string{
+		rule.Provider,
+		rule.Name,
+		rule.Type,
+		rule.Scope,
+		rule.Direction,
+		strconv.FormatInt(rule.Priority, 10),
+		rule.Tier,
+		strconv.Itoa(rule.Sources),
+		strconv.Itoa(rule.MaxSources),
+	}
+	if withSources {
+		row = append(row, strings.Join(rule.SourceList, " "))
+	}
+	return row
+}
+
+// writeRules writes the rules as a table, or as CSV. Sources are written in an additional column when withSources is
+// true.
+func writeRules(w io.Writer, output string, rules []firewall.RuleStatus, withSources bool) error {
+	header := ruleColumns
+	if withSources {
+		header = append(append([]string{}, ruleColumns...), "SOURCE LIST")
+	}
+	if output == csvOutput {
+		csvWriter := csv.NewWriter(w)
+		if err := csvWriter.Write(header); err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if err := csvWriter.Write(getRuleRow(rule, withSources)); err != nil {
+				return err
+			}
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, rule := range rules {
+		fmt.Fprintln(tw, strings.Join(getRuleRow(rule, withSources), "\t"))
+	}
+	return tw.Flush()
+}
+
+// writeStatus writes the status of the providers in the output format. The table output starts with the utilisation
+// of each provider.
+func writeStatus(w io.Writer, output string, statuses []*firewall.ProviderStatus, withSources bool) error {
+	if output == jsonOutput {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	}
+	rules := []firewall.RuleStatus{}
+	for _, status := range statuses {
+		if output == tableOutput {
+			fmt.Fprintf(w, "%s: %d/%d rule(s), %d/%d source(s)\n", status.Provider, len(status.Rules), status.MaxRules, status.Sources, status.MaxSources)
+		}
+		rules = append(rules, status.Rules...)
+	}
+	if output == tableOutput {
+		fmt.Fprintln(w)
+	}
+	return writeRules(w, output, rules, withSources)
+}
+
+// getFirewallBouncersStatus returns the status of the rules owned by the bouncer at each configured provider.
+func getFirewallBouncersStatus(config config.BouncerConfig, withSources bool) ([]*firewall.ProviderStatus, error) {
+	clients, err := getProviderClients(config)
+	if err != nil {
+		return nil, err
+	}
+	statuses := []*firewall.ProviderStatus{}
+	for _, client := range clients {
+		fb := newFirewallBouncer(config, client, nil)
+		status, err := fb.Status(withSources)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get %s status: %s", client.GetProviderName(), err)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// printStatus prints the rules owned by the bouncer and their utilisation at each configured provider.
+func printStatus(config config.BouncerConfig, args []string) error {
+	statusFlags := flag.NewFlagSet("status", flag.ExitOnError)
+	output := statusFlags.String("o", tableOutput, "output format: table, json or csv")
+	withSources := statusFlags.Bool("sources", false, "include the sources of each rule")
+	statusFlags.Parse(args)
+	if err := checkOutputValid(*output); err != nil {
+		return err
+	}
+
+	statuses, err := getFirewallBouncersStatus(config, *withSources)
+	if err != nil {
+		return err
+	}
+	return writeStatus(os.Stdout, *output, statuses, *withSources)
+}
+
+// parseInterspersedFlags parses the flags of the arguments, including the flags following a positional argument,
+// and returns the positional arguments.
+func parseInterspersedFlags(flags *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	flags.Parse(args)
+	for flags.NArg() > 0 {
+		positional = append(positional, flags.Arg(0))
+		flags.Parse(flags.Args()[1:])
+	}
+	return positional
+}
+
+// lookupAddress prints the rules owned by the bouncer containing an IP address at each configured provider.
+func lookupAddress(config config.BouncerConfig, args []string) error {
+	lookupFlags := flag.NewFlagSet("lookup", flag.ExitOnError)
+	output := lookupFlags.String("o", tableOutput, "output format: table, json or csv")
+	// the flags may follow the IP address, such as lookup 1.2.3.4 -o json
+	addresses := parseInterspersedFlags(lookupFlags, args)
+	if err := checkOutputValid(*output); err != nil {
+		return err
+	}
+	if len(addresses) != 1 {
+		return fmt.Errorf("an IP address is required")
+	}
+	address := addresses[0]
+
+	clients, err := getProviderClients(config)
+	if err != nil {
+		return err
+	}
+	found := []firewall.RuleStatus{}
+	for _, client := range clients {
+		fb := newFirewallBouncer(config, client, nil)
+		rules, err := fb.Lookup(address)
+		if err != nil {
+			return fmt.Errorf("unable to lookup %s rules: %s", client.GetProviderName(), err)
+		}
+		found = append(found, rules...)
+	}
+	if *output == jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(found)
+	}
+	if *output == tableOutput && len(found) == 0 {
+		fmt.Printf("%s is not in any rule\n", address)
+		return nil
+	}
+	return writeRules(os.Stdout, *output, found, false)
+}